@@ -0,0 +1,380 @@
+package enough
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// ApprovalPolicyFile is where tlspark looks for a park's approval policy,
+// next to the CA cert.
+const ApprovalPolicyFile = "approval_policy.json"
+
+// ErrApprovalRequired is returned when a CA with an approval policy is asked
+// to issue something the policy covers without approvals.
+var ErrApprovalRequired = errors.New("issuance needs approval")
+
+// ApprovalPolicy makes sensitive issuance wait for Threshold of Admins to
+// sign off. Roles lists the park roles it covers; empty means server,
+// intermediate, code signing and timestamping, whose certs every member
+// trusts for more than its own identity.
+type ApprovalPolicy struct {
+	Threshold int      `json:"threshold"`
+	Roles     []string `json:"roles,omitempty"`
+	Admins    []Admin  `json:"admins"`
+}
+
+// Admin is one person who can approve issuance. Key is their "PUBLIC KEY"
+// PEM, eg the _pub.pem from tlspark keygen.
+type Admin struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+
+	pub *ecdsa.PublicKey
+	id  string
+}
+
+// ParseApprovalPolicy parses and checks a JSON approval policy.
+func ParseApprovalPolicy(data []byte) (*ApprovalPolicy, error) {
+	p := &ApprovalPolicy{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("invalid approval policy: %s", err)
+	}
+	if p.Threshold < 1 || p.Threshold > len(p.Admins) {
+		return nil, fmt.Errorf("approval threshold %d must be between 1 and the number of admins (%d)", p.Threshold, len(p.Admins))
+	}
+	seen := make(map[string]bool)
+	for i := range p.Admins {
+		a := &p.Admins[i]
+		pub, err := ParsePublicKeyPEM([]byte(a.Key))
+		if err != nil {
+			return nil, fmt.Errorf("admin %q: %s", a.Name, err)
+		}
+		id, err := pubKeyID(pub)
+		if err != nil {
+			return nil, err
+		}
+		a.pub, a.id = pub, hex.EncodeToString(id)
+		if seen[a.id] {
+			return nil, fmt.Errorf("admin %q has the same key as another admin", a.Name)
+		}
+		seen[a.id] = true
+	}
+	return p, nil
+}
+
+// LoadApprovalPolicy reads an approval policy from a file.
+func LoadApprovalPolicy(path string) (*ApprovalPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseApprovalPolicy(data)
+}
+
+// Requires reports whether issuing role needs approval under p.
+func (p *ApprovalPolicy) Requires(role string) bool {
+	if len(p.Roles) == 0 {
+		return role == RoleServer || role == RoleIntermediate || role == RoleCodeSigning || role == RoleTimestamping
+	}
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Check verifies that at least Threshold different admins have validly
+// approved r.
+func (p *ApprovalPolicy) Check(r *IssuanceRequest, approvals []Approval) error {
+	digest, err := r.digest()
+	if err != nil {
+		return err
+	}
+	approved := make(map[string]bool)
+	for _, a := range approvals {
+		for _, admin := range p.Admins {
+			if admin.id == a.KeyID && ecdsa.VerifyASN1(admin.pub, digest, a.Signature) {
+				approved[admin.id] = true
+			}
+		}
+	}
+	if len(approved) < p.Threshold {
+		return fmt.Errorf("%w: %d of %d approvals", ErrApprovalRequired, len(approved), p.Threshold)
+	}
+	return nil
+}
+
+// IssuanceRequest describes one pending issuance for admins to approve.
+// KeySHA256 pins the key to be certified: the requester makes the key up
+// front, and the CA will only certify that one under the approvals.
+type IssuanceRequest struct {
+	ID            string    `json:"id"`
+	CAFingerprint string    `json:"ca_sha256"`
+	Role          string    `json:"role"`
+	Name          string    `json:"name"`
+	KeySHA256     string    `json:"key_sha256,omitempty"`
+	PermitDNS     []string  `json:"permit_dns,omitempty"`
+	PermitIP      []string  `json:"permit_ip,omitempty"`
+	PermitURI     []string  `json:"permit_uri,omitempty"`
+	Created       time.Time `json:"created"`
+}
+
+// Approval is one admin's ECDSA signature over an IssuanceRequest.
+type Approval struct {
+	Admin     string    `json:"admin,omitempty"` // informational
+	KeyID     string    `json:"key_sha256"`
+	Time      time.Time `json:"time"` // informational
+	Signature []byte    `json:"signature"`
+}
+
+// PendingIssuance is a request together with the approvals gathered so
+// far. It's what gets passed from admin to admin, and kept in the park
+// inventory once issued.
+type PendingIssuance struct {
+	Request   IssuanceRequest `json:"request"`
+	Approvals []Approval      `json:"approvals"`
+}
+
+// NewIssuanceRequest starts a request for ca to certify key as a server
+// (name is the service), an intermediate CA (name is its service, nc its
+// constraints, which may be nil), a code signer or a timestamp authority.
+// Only the CA cert is needed.
+func (ca *CA) NewIssuanceRequest(role, name string, key *ecdsa.PublicKey, nc *NameConstraints) (*IssuanceRequest, error) {
+	switch role {
+	case RoleServer:
+	case RoleIntermediate, RoleCodeSigning, RoleTimestamping:
+		if err := ValidateMemberName(name); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("can't request approval for role %q", role)
+	}
+	if role != RoleIntermediate && nc != nil {
+		return nil, errors.New("only intermediates take name constraints")
+	}
+	if key == nil {
+		return nil, errors.New("a request must name the key to certify")
+	}
+	keyID, err := keyIDHex(key)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	r := &IssuanceRequest{
+		ID:            hex.EncodeToString(id),
+		CAFingerprint: Fingerprint(&ca.Raw.Certificate),
+		Role:          role,
+		Name:          name,
+		KeySHA256:     keyID,
+		Created:       ca.now().UTC(),
+	}
+	if nc != nil {
+		r.PermitDNS, r.PermitURI = nc.DNSDomains, nc.URIDomains
+		for _, n := range nc.IPRanges {
+			r.PermitIP = append(r.PermitIP, n.String())
+		}
+	}
+	return r, nil
+}
+
+// Constraints returns the name constraints requested for an intermediate,
+// or nil.
+func (r *IssuanceRequest) Constraints() (*NameConstraints, error) {
+	return ParseNameConstraints(strings.Join(r.PermitDNS, ","), strings.Join(r.PermitIP, ","), strings.Join(r.PermitURI, ","))
+}
+
+// digest is what admins sign: a label, so approvals can't be confused with
+// anything else an admin key signs, and the request as JSON.
+func (r *IssuanceRequest) digest() ([]byte, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	h.Write([]byte("enough issuance approval v1\x00"))
+	h.Write(data)
+	return h.Sum(nil), nil
+}
+
+// Approve signs r with an admin's key.
+func (r *IssuanceRequest) Approve(admin string, key crypto.Signer) (a Approval, e error) {
+	pub, ok := key.Public().(*ecdsa.PublicKey)
+	if !ok {
+		e = errors.New("admin key is not ECDSA")
+		return
+	}
+	id, e := pubKeyID(pub)
+	if e != nil {
+		return
+	}
+	digest, e := r.digest()
+	if e != nil {
+		return
+	}
+	sig, e := key.Sign(rand.Reader, digest, crypto.SHA256)
+	if e != nil {
+		return
+	}
+	a = Approval{Admin: admin, KeyID: hex.EncodeToString(id), Time: time.Now().UTC(), Signature: sig}
+	return
+}
+
+// ReadPendingIssuance reads a PendingIssuance from a JSON file.
+func ReadPendingIssuance(path string) (*PendingIssuance, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &PendingIssuance{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("invalid pending issuance: %s", err)
+	}
+	return p, nil
+}
+
+// WritePendingIssuance writes p to a JSON file.
+func WritePendingIssuance(path string, p *PendingIssuance) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// Add records an approval, replacing any earlier one by the same key.
+func (p *PendingIssuance) Add(a Approval) {
+	for i := range p.Approvals {
+		if p.Approvals[i].KeyID == a.KeyID {
+			p.Approvals[i] = a
+			return
+		}
+	}
+	p.Approvals = append(p.Approvals, a)
+}
+
+// checkApproval checks that p approves issuing role / name from ca, with
+// the key whose ID is keyID if the request pins one.
+func (ca *CA) checkApproval(p *PendingIssuance, role, name, keyID string) error {
+	if ca.Approvals == nil {
+		return errors.New("CA has no approval policy")
+	}
+	r := &p.Request
+	if r.CAFingerprint != Fingerprint(&ca.Raw.Certificate) {
+		return errors.New("approval is for a different CA")
+	}
+	if r.Role != role || r.Name != name {
+		return fmt.Errorf("approval is for %s %q, not %s %q", r.Role, r.Name, role, name)
+	}
+	if r.KeySHA256 != keyID {
+		return errors.New("approval is for a different key")
+	}
+	if err := ca.Approvals.Check(r, p.Approvals); err != nil {
+		return err
+	}
+	return ca.checkUnused(r.ID)
+}
+
+// checkUnused checks nothing has been issued under the request with ID id.
+// That's only known from the CA's issuance log, so there must be one.
+func (ca *CA) checkUnused(id string) error {
+	if ca.Log == nil {
+		return errors.New("approved issuance needs an issuance log, to record the request in")
+	}
+	if ca.Log.Issued(id) {
+		return fmt.Errorf("request %s has already been issued", id)
+	}
+	return nil
+}
+
+// CreateServerCertApproved certifies key as the server once p holds enough
+// approvals under ca.Approvals. key must be the one p was requested for.
+func (ca *CA) CreateServerCertApproved(p *PendingIssuance, key *ecdsa.PrivateKey) (c *RawCert, e error) {
+	return ca.createApproved(p, key, ca.Service, ca.serverSpec())
+}
+
+// CreateCodeSigningCertApproved is CreateCodeSigningCert for the signer
+// requested in p, once it holds enough approvals under ca.Approvals. key
+// must be the one p was requested for.
+func (ca *CA) CreateCodeSigningCertApproved(p *PendingIssuance, key *ecdsa.PrivateKey) (c *RawCert, e error) {
+	spec, e := ca.codeSigningSpec(p.Request.Name)
+	if e != nil {
+		return
+	}
+	return ca.createApproved(p, key, p.Request.Name, spec)
+}
+
+// CreateTimestampingCertApproved is CreateTimestampingCert for the TSA
+// requested in p, once it holds enough approvals under ca.Approvals. key
+// must be the one p was requested for.
+func (ca *CA) CreateTimestampingCertApproved(p *PendingIssuance, key *ecdsa.PrivateKey) (c *RawCert, e error) {
+	spec, e := ca.timestampingSpec(p.Request.Name)
+	if e != nil {
+		return
+	}
+	return ca.createApproved(p, key, p.Request.Name, spec)
+}
+
+// createApproved certifies key with spec, once p approves it for name.
+func (ca *CA) createApproved(p *PendingIssuance, key *ecdsa.PrivateKey, name string, spec certSpec) (c *RawCert, e error) {
+	keyID, e := keyIDHex(&key.PublicKey)
+	if e != nil {
+		return
+	}
+	if e = ca.checkApproval(p, spec.info.Role, name, keyID); e != nil {
+		return
+	}
+	spec.publicKey = &key.PublicKey
+	spec.request = p.Request.ID
+	if c, e = ca.createCert(spec, &ca.Raw); e != nil {
+		return
+	}
+	c.PrivateKey = key
+	return
+}
+
+// CreateIntermediateCAApproved issues the intermediate CA requested in p,
+// with key, once p holds enough approvals under ca.Approvals. key must be
+// the one p was requested for.
+func (ca *CA) CreateIntermediateCAApproved(p *PendingIssuance, key *ecdsa.PrivateKey) (sub *CA, e error) {
+	keyID, e := keyIDHex(&key.PublicKey)
+	if e != nil {
+		return
+	}
+	if e = ca.checkApproval(p, RoleIntermediate, p.Request.Name, keyID); e != nil {
+		return
+	}
+	nc, e := p.Request.Constraints()
+	if e != nil {
+		return
+	}
+	return ca.createIntermediateCA(p.Request.Name, nc, p.Request.ID, key)
+}
+
+// keyIDHex is the hex key ID of pub, as used in KeySHA256.
+func keyIDHex(pub *ecdsa.PublicKey) (string, error) {
+	id, err := pubKeyID(pub)
+	return hex.EncodeToString(id), err
+}
+
+// csrKeyID is the hex key ID of the key in csr, as used in KeySHA256.
+func csrKeyID(csr *x509.CertificateRequest) (string, error) {
+	pub, ok := csr.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return "", errors.New("CSR key is not ECDSA")
+	}
+	return keyIDHex(pub)
+}
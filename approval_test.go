@@ -0,0 +1,231 @@
+package enough
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testApprovalPolicy(t *testing.T, threshold int) (*ApprovalPolicy, []*ecdsa.PrivateKey) {
+	keys := []*ecdsa.PrivateKey{}
+	raw := map[string]interface{}{"threshold": threshold}
+	admins := []map[string]string{}
+	for _, name := range []string{"alice", "bob", "carol"} {
+		key, err := GenerateRecipientKey()
+		if err != nil {
+			t.Fatalf("failed to generate key: %s", err)
+		}
+		pub, _ := MarshalPublicKey(&key.PublicKey)
+		admins = append(admins, map[string]string{"name": name, "key": string(pub)})
+		keys = append(keys, key)
+	}
+	raw["admins"] = admins
+	data, _ := json.Marshal(raw)
+	p, err := ParseApprovalPolicy(data)
+	if err != nil {
+		t.Fatalf("failed to parse policy: %s", err)
+	}
+	return p, keys
+}
+
+func TestApprovals(t *testing.T) {
+	t.Parallel()
+	policy, admins := testApprovalPolicy(t, 2)
+	ca, err := NewCA("widget")
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	ca.Approvals = policy
+	logPath := filepath.Join(t.TempDir(), IssuanceLogFile)
+
+	if _, err := ca.CreateServerCert(); !errors.Is(err, ErrApprovalRequired) {
+		t.Errorf("issued a server without approval: %v", err)
+	}
+	if _, err := ca.CreateIntermediateCA("eu", nil); !errors.Is(err, ErrApprovalRequired) {
+		t.Errorf("issued an intermediate without approval: %v", err)
+	}
+	if _, err := ca.CreateCodeSigningCert("releases"); !errors.Is(err, ErrApprovalRequired) {
+		t.Errorf("issued a code signer without approval: %v", err)
+	}
+	if _, err := ca.CreateTimestampingCert("tsa"); !errors.Is(err, ErrApprovalRequired) {
+		t.Errorf("issued a TSA without approval: %v", err)
+	}
+	if _, err := ca.CreateClientCert(0); err != nil {
+		t.Errorf("client issuance needed approval: %s", err)
+	}
+
+	serverKey, _ := GenerateRecipientKey()
+	r, err := ca.NewIssuanceRequest(RoleServer, "widget", &serverKey.PublicKey, nil)
+	if err != nil {
+		t.Fatalf("failed to make request: %s", err)
+	}
+	p := &PendingIssuance{Request: *r}
+	a, err := r.Approve("alice", admins[0])
+	if err != nil {
+		t.Fatalf("failed to approve: %s", err)
+	}
+	p.Add(a)
+	p.Add(a) // the same admin twice is still one approval
+	if _, err := ca.CreateServerCertApproved(p, serverKey); !errors.Is(err, ErrApprovalRequired) {
+		t.Errorf("issued with one approval: %v", err)
+	}
+
+	// an approval for a different request doesn't count
+	other, _ := ca.NewIssuanceRequest(RoleServer, "widget", &serverKey.PublicKey, nil)
+	b, _ := other.Approve("bob", admins[1])
+	p.Add(b)
+	if _, err := ca.CreateServerCertApproved(p, serverKey); !errors.Is(err, ErrApprovalRequired) {
+		t.Errorf("issued with an approval for another request: %v", err)
+	}
+
+	b, _ = r.Approve("bob", admins[1])
+	p.Add(b)
+	if _, err := ca.CreateServerCertApproved(p, serverKey); err == nil {
+		t.Error("issued without an issuance log to record the request")
+	}
+	if ca.Log, err = OpenIssuanceLog(logPath); err != nil {
+		t.Fatalf("failed to open log: %s", err)
+	}
+	// the approvals are for serverKey, and only serverKey
+	otherKey, _ := GenerateRecipientKey()
+	if _, err := ca.CreateServerCertApproved(p, otherKey); err == nil {
+		t.Error("issued for a key the admins didn't approve")
+	}
+	server, err := ca.CreateServerCertApproved(p, serverKey)
+	if err != nil {
+		t.Fatalf("failed to issue with two approvals: %s", err)
+	}
+	if !server.PrivateKey.Equal(serverKey) || !serverKey.PublicKey.Equal(server.Certificate.PublicKey) {
+		t.Error("server cert is not for the approved key")
+	}
+	if _, err := ca.CreateServerCertApproved(p, serverKey); err == nil {
+		t.Error("issued twice for one request")
+	}
+	ca.Log.Close()
+	if ca.Log, err = OpenIssuanceLog(logPath); err != nil {
+		t.Fatalf("failed to reopen log: %s", err)
+	}
+	defer ca.Log.Close()
+	if _, err := ca.CreateServerCertApproved(p, serverKey); err == nil {
+		t.Error("issued twice for one request after reopening the log")
+	}
+
+	inv := NewInventory(&ca.Raw.Certificate)
+	if err := inv.AddApproved(&server.Certificate, "server_cert.pem", "", p); err != nil {
+		t.Fatalf("failed to record: %s", err)
+	}
+	if !inv.Used(r.ID) {
+		t.Error("inventory does not record the approval")
+	}
+
+	subKey, _ := GenerateRecipientKey()
+	if _, err := ca.NewIssuanceRequest(RoleIntermediate, "../eu", &subKey.PublicKey, nil); err == nil {
+		t.Error("requested an intermediate with a path for a name")
+	}
+	// even if the admins approve one
+	r, _ = ca.NewIssuanceRequest(RoleIntermediate, "eu", &subKey.PublicKey, nil)
+	r.Name = "../../etc/eu"
+	p = &PendingIssuance{Request: *r}
+	for _, k := range admins[1:] {
+		a, _ := r.Approve("", k)
+		p.Add(a)
+	}
+	if _, err := ca.CreateIntermediateCAApproved(p, subKey); err == nil || !strings.Contains(err.Error(), "invalid member name") {
+		t.Errorf("issued an intermediate with a path for a name: %v", err)
+	}
+
+	// intermediates are approved with their constraints
+	nc := &NameConstraints{DNSDomains: []string{"eu.example.com"}}
+	r, _ = ca.NewIssuanceRequest(RoleIntermediate, "eu.example.com", &subKey.PublicKey, nc)
+	p = &PendingIssuance{Request: *r}
+	for _, k := range admins[1:] {
+		a, _ := r.Approve("", k)
+		p.Add(a)
+	}
+	sub, err := ca.CreateIntermediateCAApproved(p, subKey)
+	if err != nil {
+		t.Fatalf("failed to issue intermediate: %s", err)
+	}
+	if got := sub.Raw.Certificate.PermittedDNSDomains; len(got) != 1 || got[0] != "eu.example.com" {
+		t.Errorf("intermediate has the wrong constraints: %v", got)
+	}
+	if _, err := sub.CreateServerCert(); !errors.Is(err, ErrApprovalRequired) {
+		t.Error("intermediate did not inherit the approval policy")
+	}
+
+	// so are code signers and TSAs
+	signerKey, _ := GenerateRecipientKey()
+	r, _ = ca.NewIssuanceRequest(RoleCodeSigning, "releases", &signerKey.PublicKey, nil)
+	p = &PendingIssuance{Request: *r}
+	for _, k := range admins[:2] {
+		a, _ := r.Approve("", k)
+		p.Add(a)
+	}
+	if _, err := ca.CreateTimestampingCertApproved(p, signerKey); err == nil {
+		t.Error("issued a TSA under a code signing approval")
+	}
+	signer, err := ca.CreateCodeSigningCertApproved(p, signerKey)
+	if err != nil {
+		t.Fatalf("failed to issue code signer: %s", err)
+	}
+	if signer.Certificate.Subject.CommonName != "releases" || !signer.PrivateKey.Equal(signerKey) {
+		t.Errorf("unexpected code signer %q", signer.Certificate.Subject.CommonName)
+	}
+}
+
+func TestCeremonyApprovals(t *testing.T) {
+	t.Parallel()
+	policy, admins := testApprovalPolicy(t, 1)
+	ca, err := NewCA("widget")
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	ca.Approvals = policy
+	if ca.Log, err = OpenIssuanceLog(filepath.Join(t.TempDir(), IssuanceLogFile)); err != nil {
+		t.Fatalf("failed to open log: %s", err)
+	}
+	defer ca.Log.Close()
+	pemCert, _ := ca.Raw.MarshalCertificate()
+
+	b, err := NewCeremonyBatch(pemCert)
+	if err != nil {
+		t.Fatalf("failed to start batch: %s", err)
+	}
+	if _, err := b.AddServer(); err != nil {
+		t.Fatalf("failed to add server: %s", err)
+	}
+	dir := filepath.Join(t.TempDir(), "batch")
+	if _, err := b.Write(dir); err != nil {
+		t.Fatalf("failed to write batch: %s", err)
+	}
+
+	read, sum, err := ReadCeremonyBatch(dir)
+	if err != nil {
+		t.Fatalf("failed to read batch: %s", err)
+	}
+	if _, err := ca.SignCeremonyBatch(read, sum); !errors.Is(err, ErrApprovalRequired) {
+		t.Errorf("signed an unapproved server: %v", err)
+	}
+
+	path := filepath.Join(dir, read.Requests[0].ApprovalFile())
+	p, err := ReadPendingIssuance(path)
+	if err != nil {
+		t.Fatalf("failed to read approval file: %s", err)
+	}
+	a, _ := p.Request.Approve("carol", admins[2])
+	p.Add(a)
+	if err := WritePendingIssuance(path, p); err != nil {
+		t.Fatalf("failed to write approval file: %s", err)
+	}
+
+	read, sum, err = ReadCeremonyBatch(dir)
+	if err != nil {
+		t.Fatalf("failed to read batch: %s", err)
+	}
+	if _, err := ca.SignCeremonyBatch(read, sum); err != nil {
+		t.Errorf("failed to sign an approved server: %s", err)
+	}
+}
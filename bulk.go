@@ -0,0 +1,96 @@
+package enough
+
+import (
+	"context"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// ClientResult is one cert from CreateClientCerts. Exactly one of Cert and
+// Err is set.
+type ClientResult struct {
+	Index int
+	Cert  *RawCert
+	Err   error
+}
+
+type lockedReader struct {
+	sync.Mutex
+	r io.Reader
+}
+
+func (l *lockedReader) Read(p []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+	return l.r.Read(p)
+}
+
+// CreateClientCerts issues clients start to start+count-1, like
+// CreateClientCert, across a pool of ca.Workers goroutines (GOMAXPROCS if
+// zero). Results arrive on the returned channel as they are made, in no
+// particular order. The channel is closed when every cert has been sent, or
+// soon after ctx is cancelled, in which case the remaining certs are never
+// issued; check ctx.Err() once it closes.
+//
+// With a custom ca.Rand the certs are still valid, but which index gets
+// which bytes depends on scheduling, so the output is not reproducible.
+func (ca *CA) CreateClientCerts(ctx context.Context, start, count int) <-chan ClientResult {
+	return ca.CreateClientCertsWithClaims(ctx, start, count, nil)
+}
+
+// CreateClientCertsWithClaims is CreateClientCerts for clients that all
+// carry the same claims.
+func (ca *CA) CreateClientCertsWithClaims(ctx context.Context, start, count int, claims *Claims) <-chan ClientResult {
+	workers := ca.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > count {
+		workers = count
+	}
+
+	issuer := ca
+	if ca.Rand != nil {
+		// custom readers needn't be safe for concurrent use
+		shared := *ca
+		shared.Rand = &lockedReader{r: ca.Rand}
+		issuer = &shared
+	}
+
+	jobs := make(chan int)
+	results := make(chan ClientResult, workers)
+
+	go func() {
+		defer close(jobs)
+		for i := start; i < start+count; i++ {
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				c, err := issuer.CreateNumberedClientCert(i, claims)
+				select {
+				case results <- ClientResult{Index: i, Cert: c, Err: err}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
@@ -0,0 +1,105 @@
+package enough
+
+import (
+	"context"
+	"runtime"
+	"testing"
+)
+
+func TestCreateClientCerts(t *testing.T) {
+	t.Parallel()
+	ca, err := NewCA("testing")
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	seen := make(map[int]bool)
+	serials := make(map[string]bool)
+	for r := range ca.CreateClientCerts(context.Background(), 10, 200) {
+		if r.Err != nil {
+			t.Fatalf("unable to create client cert %d: %s", r.Index, r.Err)
+		}
+		if r.Index < 10 || r.Index >= 210 || seen[r.Index] {
+			t.Errorf("unexpected or repeated index %d", r.Index)
+		}
+		seen[r.Index] = true
+		info, err := ParkInfoFromCert(&r.Cert.Certificate)
+		if err != nil || info.Index != r.Index {
+			t.Errorf("cert %d has park info %+v, %v", r.Index, info, err)
+		}
+		if serials[r.Cert.Certificate.SerialNumber.String()] {
+			t.Errorf("already seen serial %v", r.Cert.Certificate.SerialNumber)
+		}
+		serials[r.Cert.Certificate.SerialNumber.String()] = true
+	}
+	if len(seen) != 200 {
+		t.Errorf("expected 200 certs, got %d", len(seen))
+	}
+}
+
+func TestCreateClientCertsCancel(t *testing.T) {
+	t.Parallel()
+	ca, err := NewCA("testing")
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	ca.Workers = 2
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	got := 0
+	for range ca.CreateClientCerts(ctx, 0, 100000) {
+		got++
+		if got == 10 {
+			cancel()
+		}
+	}
+	if got >= 100000 {
+		t.Error("cancel did not stop issuance")
+	}
+	if ctx.Err() == nil {
+		t.Error("context not cancelled")
+	}
+}
+
+func TestCreateClientCertsSeeded(t *testing.T) {
+	t.Parallel()
+	ca, err := NewCAWithOptions("testing", &CAOptions{Rand: seededRand(3), Clock: testClock})
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	// mostly here for the race detector: the seeded reader isn't thread safe
+	for r := range ca.CreateClientCerts(context.Background(), 0, 50) {
+		if r.Err != nil {
+			t.Fatalf("unable to create client cert %d: %s", r.Index, r.Err)
+		}
+	}
+}
+
+func BenchmarkCreateClientCert(b *testing.B) {
+	ca, err := NewCA("testing")
+	if err != nil {
+		b.Fatalf("failed to create CA: %s", err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ca.CreateClientCert(i); err != nil {
+			b.Fatalf("unable to create client cert: %s", err)
+		}
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "certs/s")
+}
+
+func BenchmarkCreateClientCerts(b *testing.B) {
+	ca, err := NewCA("testing")
+	if err != nil {
+		b.Fatalf("failed to create CA: %s", err)
+	}
+	b.ResetTimer()
+	for r := range ca.CreateClientCerts(context.Background(), 0, b.N) {
+		if r.Err != nil {
+			b.Fatalf("unable to create client cert: %s", r.Err)
+		}
+	}
+	perSec := float64(b.N) / b.Elapsed().Seconds()
+	b.ReportMetric(perSec, "certs/s")
+	b.ReportMetric(perSec/float64(runtime.GOMAXPROCS(0)), "certs/s/core")
+}
@@ -0,0 +1,275 @@
+package enough
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	RoleCA           = "ca"
+	RoleServer       = "server"
+	RoleClient       = "client"
+	RoleCodeSigning  = "codesigning"
+	RoleTimestamping = "timestamping"
+)
+
+// File names used inside a member bundle archive. They are the same for
+// every member, so the receiving host can be configured once.
+const (
+	BundleKeyFile      = "key.pem"
+	BundleCertFile     = "cert.pem"
+	BundleCAFile       = "ca_cert.pem"
+	BundleCRLFile      = "crl.pem"
+	BundleManifestFile = "manifest.json"
+)
+
+const bundleVersion = 1
+
+// BundleManifest describes the identity carried by a member bundle.
+type BundleManifest struct {
+	Version     int       `json:"version"`
+	Service     string    `json:"service"`
+	Identity    string    `json:"identity"`
+	Role        string    `json:"role"`
+	Serial      string    `json:"serial"` // hex, as in the inventory
+	Fingerprint string    `json:"sha256_fingerprint"`
+	NotAfter    time.Time `json:"not_after"`
+	ServerName  string    `json:"server_name"`
+	Files       []string  `json:"files"`
+}
+
+// Bundle is everything one park member needs on its host: its own key and
+// cert, the CA cert to verify peers with, and optionally the current CRL.
+type Bundle struct {
+	Manifest BundleManifest
+	Key      []byte
+	Cert     []byte
+	CACert   []byte
+	CRL      []byte
+}
+
+// Fingerprint returns the hex SHA-256 of the DER certificate.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func memberRole(cert *x509.Certificate) string {
+	if info, err := ParkInfoFromCert(cert); err == nil {
+		return info.Role
+	}
+	if cert.IsCA {
+		return RoleCA
+	}
+	for _, u := range cert.ExtKeyUsage {
+		switch u {
+		case x509.ExtKeyUsageServerAuth:
+			return RoleServer
+		case x509.ExtKeyUsageCodeSigning:
+			return RoleCodeSigning
+		case x509.ExtKeyUsageTimeStamping:
+			return RoleTimestamping
+		}
+	}
+	return RoleClient
+}
+
+// NewBundle packages member, which must have been issued by ca, together with
+// the CA cert. crl may be nil.
+func (ca *CA) NewBundle(member *RawCert, crl []byte) (b *Bundle, e error) {
+	if member.PrivateKey == nil {
+		e = errors.New("member has no private key")
+		return
+	}
+	if e = member.Certificate.CheckSignatureFrom(&ca.Raw.Certificate); e != nil {
+		e = fmt.Errorf("member not issued by this CA: %s", e)
+		return
+	}
+
+	b = &Bundle{CRL: crl}
+	if b.Key, e = member.MarshalPrivateKey(); e != nil {
+		return
+	}
+	if b.Cert, e = member.MarshalCertificate(); e != nil {
+		return
+	}
+	if b.CACert, e = ca.Raw.MarshalCertificate(); e != nil {
+		return
+	}
+
+	cert := &member.Certificate
+	b.Manifest = BundleManifest{
+		Version:     bundleVersion,
+		Service:     ca.Service,
+		Identity:    cert.Subject.CommonName,
+		Role:        memberRole(cert),
+		Serial:      cert.SerialNumber.Text(16),
+		Fingerprint: Fingerprint(cert),
+		NotAfter:    cert.NotAfter.UTC(),
+		ServerName:  ca.Service,
+		Files:       []string{BundleKeyFile, BundleCertFile, BundleCAFile},
+	}
+	if len(crl) > 0 {
+		b.Manifest.Files = append(b.Manifest.Files, BundleCRLFile)
+	}
+	return
+}
+
+// WriteArchive writes the bundle to w as a gzipped tarball. The key entry is
+// mode 0600, everything else 0644.
+func (b *Bundle) WriteArchive(w io.Writer) error {
+	manifest, err := json.MarshalIndent(&b.Manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	manifest = append(manifest, '\n')
+
+	type entry struct {
+		name string
+		mode int64
+		data []byte
+	}
+	entries := []entry{
+		{BundleManifestFile, 0644, manifest},
+		{BundleKeyFile, 0600, b.Key},
+		{BundleCertFile, 0644, b.Cert},
+		{BundleCAFile, 0644, b.CACert},
+	}
+	if len(b.CRL) > 0 {
+		entries = append(entries, entry{BundleCRLFile, 0644, b.CRL})
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, ent := range entries {
+		hdr := &tar.Header{
+			Name:    ent.name,
+			Mode:    ent.mode,
+			Size:    int64(len(ent.data)),
+			ModTime: time.Now().UTC().Truncate(time.Second),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(ent.data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// maxBundleEntry caps each file read from a bundle. The biggest thing in
+// one is a CRL, and a park's CRL has a long way to go to reach this.
+const maxBundleEntry = 1 << 20
+
+// ReadBundle parses an archive written by WriteArchive and checks that the
+// key, cert and CA cert inside belong together.
+func ReadBundle(r io.Reader) (b *Bundle, e error) {
+	gz, e := gzip.NewReader(r)
+	if e != nil {
+		return
+	}
+	defer gz.Close()
+
+	b = &Bundle{}
+	seen := make(map[string]bool)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if seen[hdr.Name] {
+			return nil, fmt.Errorf("%q is in the bundle twice", hdr.Name)
+		}
+		seen[hdr.Name] = true
+		if hdr.Size > maxBundleEntry {
+			return nil, fmt.Errorf("%s is too big (%d bytes)", hdr.Name, hdr.Size)
+		}
+		data, err := io.ReadAll(io.LimitReader(tr, maxBundleEntry))
+		if err != nil {
+			return nil, err
+		}
+		switch hdr.Name {
+		case BundleManifestFile:
+			if err := json.Unmarshal(data, &b.Manifest); err != nil {
+				return nil, fmt.Errorf("bad manifest: %s", err)
+			}
+		case BundleKeyFile:
+			if hdr.Mode&0077 != 0 {
+				return nil, fmt.Errorf("%s has unsafe mode %o", hdr.Name, hdr.Mode)
+			}
+			b.Key = data
+		case BundleCertFile:
+			b.Cert = data
+		case BundleCAFile:
+			b.CACert = data
+		case BundleCRLFile:
+			b.CRL = data
+		default:
+			return nil, fmt.Errorf("unexpected file %q in bundle", hdr.Name)
+		}
+	}
+	if b.Manifest.Version != bundleVersion {
+		return nil, fmt.Errorf("unsupported bundle version %d", b.Manifest.Version)
+	}
+	if len(b.Key) == 0 || len(b.Cert) == 0 || len(b.CACert) == 0 {
+		return nil, errors.New("bundle is incomplete")
+	}
+
+	member, err := b.Member()
+	if err != nil {
+		return nil, err
+	}
+	caCert, err := parseCertPEM(b.CACert)
+	if err != nil {
+		return nil, err
+	}
+	if err := member.Certificate.CheckSignatureFrom(caCert); err != nil {
+		return nil, fmt.Errorf("member cert not issued by bundled CA: %s", err)
+	}
+	if Fingerprint(&member.Certificate) != b.Manifest.Fingerprint {
+		return nil, errors.New("manifest fingerprint does not match cert")
+	}
+	return
+}
+
+// Member returns the parsed key and cert held in the bundle.
+func (b *Bundle) Member() (*RawCert, error) {
+	cert, err := parseCertPEM(b.Cert)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParsePrivateKeyPEM(b.Key)
+	if err != nil {
+		return nil, err
+	}
+	if !key.PublicKey.Equal(cert.PublicKey) {
+		return nil, errors.New("key does not match cert")
+	}
+	return &RawCert{PrivateKey: key, Certificate: *cert}, nil
+}
+
+func parseCertPEM(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(bytes.TrimSpace(data))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("invalid certificate PEM")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -0,0 +1,150 @@
+package enough
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+)
+
+func TestBundleRoundtrip(t *testing.T) {
+	t.Parallel()
+	ca, err := NewCA("testing")
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	client, err := ca.CreateClientCert(3)
+	if err != nil {
+		t.Fatalf("unable to create client cert: %s", err)
+	}
+
+	crl := []byte("-----BEGIN X509 CRL-----\n-----END X509 CRL-----\n")
+	b, err := ca.NewBundle(client, crl)
+	if err != nil {
+		t.Fatalf("failed to create bundle: %s", err)
+	}
+	buf := &bytes.Buffer{}
+	if err := b.WriteArchive(buf); err != nil {
+		t.Fatalf("failed to write bundle: %s", err)
+	}
+
+	// check the key is the only entry with restricted permissions
+	gz, err := gzip.NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("bad gzip: %s", err)
+	}
+	tr := tar.NewReader(gz)
+	entries := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("bad tar: %s", err)
+		}
+		entries++
+		if hdr.Name == BundleKeyFile && hdr.Mode != 0600 {
+			t.Errorf("key mode is %o, want 600", hdr.Mode)
+		}
+	}
+	if entries != 5 {
+		t.Errorf("expected 5 entries, got %d", entries)
+	}
+
+	read, err := ReadBundle(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to read bundle: %s", err)
+	}
+	if got := read.Manifest.Identity; got != "Client3" {
+		t.Errorf("expected identity Client3, got %s", got)
+	}
+	if got := read.Manifest.Role; got != RoleClient {
+		t.Errorf("expected role %s, got %s", RoleClient, got)
+	}
+	if got := read.Manifest.ServerName; got != "testing" {
+		t.Errorf("expected server name testing, got %s", got)
+	}
+	if got, want := read.Manifest.Serial, client.Certificate.SerialNumber.Text(16); got != want {
+		t.Errorf("expected hex serial %s, got %s", want, got)
+	}
+	if !bytes.Equal(read.CRL, crl) {
+		t.Error("CRL not preserved")
+	}
+	member, err := read.Member()
+	if err != nil {
+		t.Fatalf("failed to load member: %s", err)
+	}
+	if !member.Certificate.Equal(&client.Certificate) {
+		t.Error("member cert changed in roundtrip")
+	}
+}
+
+func TestBundleWrongCA(t *testing.T) {
+	t.Parallel()
+	ca, err := NewCA("testing")
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	other, err := NewCA("other")
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	client, err := other.CreateClientCert(0)
+	if err != nil {
+		t.Fatalf("unable to create client cert: %s", err)
+	}
+	if _, err := ca.NewBundle(client, nil); err == nil {
+		t.Error("bundled a member from a different CA")
+	}
+}
+
+func TestReadBundleHostile(t *testing.T) {
+	t.Parallel()
+	ca, err := NewCA("testing")
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	client, _ := ca.CreateClientCert(0)
+	b, err := ca.NewBundle(client, nil)
+	if err != nil {
+		t.Fatalf("failed to create bundle: %s", err)
+	}
+
+	// rebuild the bundle with an extra entry on the end
+	archive := func(name string, data []byte) []byte {
+		buf := &bytes.Buffer{}
+		if err := b.WriteArchive(buf); err != nil {
+			t.Fatalf("failed to write bundle: %s", err)
+		}
+		gz, _ := gzip.NewReader(buf)
+		tr := tar.NewReader(gz)
+		out := &bytes.Buffer{}
+		gw := gzip.NewWriter(out)
+		tw := tar.NewWriter(gw)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			tw.WriteHeader(hdr)
+			io.Copy(tw, tr)
+		}
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))})
+		tw.Write(data)
+		tw.Close()
+		gw.Close()
+		return out.Bytes()
+	}
+	// even a copy: which one a reader picks shouldn't be up to the reader
+	if _, err := ReadBundle(bytes.NewReader(archive(BundleCertFile, b.Cert))); err == nil {
+		t.Error("read a bundle with the cert in it twice")
+	}
+	if _, err := ReadBundle(bytes.NewReader(archive(BundleCRLFile, make([]byte, maxBundleEntry+1)))); err == nil {
+		t.Error("read a bundle with an oversized CRL")
+	}
+	if _, err := ReadBundle(bytes.NewReader(archive(BundleCRLFile, []byte("crl")))); err != nil {
+		t.Errorf("failed to read a bundle with a CRL: %s", err)
+	}
+}
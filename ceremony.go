@@ -0,0 +1,488 @@
+package enough
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// An offline ceremony keeps the CA key on a machine that never touches a
+// network. The online side makes member keys and a batch of CSRs in a
+// directory; the directory goes to the offline side, which checks and signs
+// it; then it comes back and the online side imports the certs. Every file
+// is listed with its SHA-256 in batch.json or results.json, and the batch's
+// own SHA-256 is printed on both sides so operators can compare them.
+const (
+	CeremonyBatchFile  = "batch.json"
+	CeremonyResultFile = "results.json"
+)
+
+const ceremonyVersion = 1
+
+// CeremonyRequest is one cert the online side wants issued.
+type CeremonyRequest struct {
+	Role      string  `json:"role"`
+	Name      string  `json:"name"`
+	Index     int     `json:"index"`
+	Claims    *Claims `json:"claims,omitempty"`
+	CSRFile   string  `json:"csr_file"`
+	CSRSHA256 string  `json:"csr_sha256"`
+	KeySHA256 string  `json:"key_sha256"` // SHA-256 of the PKIX public key
+
+	// Approval is read from <stub>_approval.json, which is outside the
+	// checksums so admins can sign it after the batch is written.
+	Approval *PendingIssuance `json:"-"`
+
+	csr *x509.CertificateRequest
+	pem []byte
+}
+
+// CeremonyBatch is the set of requests taken to the offline CA.
+type CeremonyBatch struct {
+	Version       int               `json:"version"`
+	ID            string            `json:"id"`
+	Service       string            `json:"service"`
+	ParkID        string            `json:"park_id,omitempty"`
+	CAFingerprint string            `json:"ca_sha256"`
+	Created       time.Time         `json:"created"`
+	Requests      []CeremonyRequest `json:"requests"`
+
+	ca *CA // public half only, for names and validation
+}
+
+// CeremonyCert is one signed cert in a CeremonyResult.
+type CeremonyCert struct {
+	Request     int    `json:"request"` // index into the batch's Requests
+	CertFile    string `json:"cert_file"`
+	Fingerprint string `json:"sha256_fingerprint"`
+
+	Cert *x509.Certificate `json:"-"`
+}
+
+// CeremonyResult is what the offline CA sends back.
+type CeremonyResult struct {
+	Version     int            `json:"version"`
+	BatchID     string         `json:"batch_id"`
+	BatchSHA256 string         `json:"batch_sha256"`
+	Signed      time.Time      `json:"signed"`
+	Certs       []CeremonyCert `json:"certs"`
+}
+
+// Stub is the file stub tlspark uses for the member: server, clientN or
+// the client name.
+func (r *CeremonyRequest) Stub() string {
+	if r.Role == RoleServer {
+		return "server"
+	}
+	if r.Index >= 0 {
+		return fmt.Sprintf("client%d", r.Index)
+	}
+	return r.Name
+}
+
+// NewCeremonyBatch starts an empty batch for the park whose CA cert is
+// certPemData. The CA key is not needed.
+func NewCeremonyBatch(certPemData []byte) (b *CeremonyBatch, e error) {
+	cert, e := parseCertPEM(certPemData)
+	if e != nil {
+		return
+	}
+	ca := &CA{Raw: RawCert{Certificate: *cert}}
+	if e = ca.loadParkInfo(); e != nil {
+		return
+	}
+	id := make([]byte, 8)
+	if _, e = rand.Read(id); e != nil {
+		return
+	}
+	b = &CeremonyBatch{
+		Version:       ceremonyVersion,
+		ID:            hex.EncodeToString(id),
+		Service:       ca.Service,
+		ParkID:        ca.ParkID,
+		CAFingerprint: Fingerprint(cert),
+		Created:       time.Now().UTC(),
+		Requests:      []CeremonyRequest{},
+		ca:            ca,
+	}
+	return
+}
+
+// AddServer adds a request for the park's server cert, and returns the new
+// server key, which stays on the online side. The request comes with a
+// PendingIssuance, for parks whose CA needs approval to issue servers.
+func (b *CeremonyBatch) AddServer() (*ecdsa.PrivateKey, error) {
+	key, err := b.add(CeremonyRequest{Role: RoleServer, Name: b.Service, Index: -1})
+	if err != nil {
+		return nil, err
+	}
+	req := &b.Requests[len(b.Requests)-1]
+	ir, err := b.ca.NewIssuanceRequest(RoleServer, req.Name, &key.PublicKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Approval = &PendingIssuance{Request: *ir, Approvals: []Approval{}}
+	return key, nil
+}
+
+// ApprovalFile is the name of the file holding the request's
+// PendingIssuance, if it has one.
+func (r *CeremonyRequest) ApprovalFile() string {
+	return r.Stub() + "_approval.json"
+}
+
+// AddNumberedClient adds a request for client number n.
+func (b *CeremonyBatch) AddNumberedClient(n int, claims *Claims) (*ecdsa.PrivateKey, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("invalid client number %d", n)
+	}
+	return b.add(CeremonyRequest{Role: RoleClient, Name: fmt.Sprintf("Client%d", n), Index: n, Claims: claims})
+}
+
+// AddClient adds a request for a named client.
+func (b *CeremonyBatch) AddClient(name string, claims *Claims) (*ecdsa.PrivateKey, error) {
+	return b.add(CeremonyRequest{Role: RoleClient, Name: name, Index: -1, Claims: claims})
+}
+
+func (b *CeremonyBatch) add(req CeremonyRequest) (*ecdsa.PrivateKey, error) {
+	// catch bad names and claims now, not in the ceremony
+	if _, err := b.ca.requestSpec(&req); err != nil {
+		return nil, err
+	}
+	for _, r := range b.Requests {
+		if strings.EqualFold(r.Stub(), req.Stub()) {
+			return nil, fmt.Errorf("%s is requested more than once", req.Name)
+		}
+	}
+
+	key, err := GenerateRecipientKey()
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{Organization: []string{"Just Enough"}, CommonName: req.Name},
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	if req.csr, err = x509.ParseCertificateRequest(der); err != nil {
+		return nil, err
+	}
+	req.pem = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+	req.CSRFile = req.Stub() + "_csr.pem"
+	req.CSRSHA256 = sha256Hex(req.pem)
+	kid, err := pubKeyID(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	req.KeySHA256 = hex.EncodeToString(kid)
+	b.Requests = append(b.Requests, req)
+	return key, nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Write creates dir, which must not exist, and writes the batch into it.
+// It returns the SHA-256 of batch.json.
+func (b *CeremonyBatch) Write(dir string) (sum string, e error) {
+	if len(b.Requests) == 0 {
+		e = errors.New("batch has no requests")
+		return
+	}
+	if e = os.Mkdir(dir, 0755); e != nil {
+		return
+	}
+	for _, r := range b.Requests {
+		if e = os.WriteFile(filepath.Join(dir, r.CSRFile), r.pem, 0644); e != nil {
+			return
+		}
+		if r.Approval != nil {
+			if e = WritePendingIssuance(filepath.Join(dir, r.ApprovalFile()), r.Approval); e != nil {
+				return
+			}
+		}
+	}
+	data, e := json.MarshalIndent(b, "", "  ")
+	if e != nil {
+		return
+	}
+	data = append(data, '\n')
+	if e = os.WriteFile(filepath.Join(dir, CeremonyBatchFile), data, 0644); e != nil {
+		return
+	}
+	sum = sha256Hex(data)
+	return
+}
+
+// readCeremonyFile reads name from dir, refusing anything but a plain file
+// name so a batch can't point outside its directory.
+func readCeremonyFile(dir, name string) ([]byte, error) {
+	if name != filepath.Base(name) || name == "." || name == ".." {
+		return nil, fmt.Errorf("bad file name %q", name)
+	}
+	return os.ReadFile(filepath.Join(dir, name))
+}
+
+// ReadCeremonyBatch reads the batch in dir and checks every CSR against its
+// checksum and its own signature. It returns the SHA-256 of batch.json.
+func ReadCeremonyBatch(dir string) (b *CeremonyBatch, sum string, e error) {
+	data, e := readCeremonyFile(dir, CeremonyBatchFile)
+	if e != nil {
+		return
+	}
+	b = &CeremonyBatch{}
+	if e = json.Unmarshal(data, b); e != nil {
+		e = fmt.Errorf("invalid %s: %s", CeremonyBatchFile, e)
+		return
+	}
+	if b.Version != ceremonyVersion {
+		e = fmt.Errorf("unsupported batch version %d", b.Version)
+		return
+	}
+	if len(b.Requests) == 0 {
+		e = errors.New("batch has no requests")
+		return
+	}
+	stubs := make(map[string]bool)
+	for i := range b.Requests {
+		r := &b.Requests[i]
+		if stubs[strings.ToLower(r.Stub())] {
+			e = fmt.Errorf("%s is requested more than once", r.Name)
+			return
+		}
+		stubs[strings.ToLower(r.Stub())] = true
+		if r.pem, e = readCeremonyFile(dir, r.CSRFile); e != nil {
+			return
+		}
+		if sha256Hex(r.pem) != r.CSRSHA256 {
+			e = fmt.Errorf("%s does not match its checksum", r.CSRFile)
+			return
+		}
+		block, _ := pem.Decode(r.pem)
+		if block == nil || block.Type != "CERTIFICATE REQUEST" {
+			e = fmt.Errorf("%s: invalid PEM data", r.CSRFile)
+			return
+		}
+		if r.csr, e = x509.ParseCertificateRequest(block.Bytes); e != nil {
+			return
+		}
+		if e = r.csr.CheckSignature(); e != nil {
+			e = fmt.Errorf("%s: %s", r.CSRFile, e)
+			return
+		}
+		pub, ok := r.csr.PublicKey.(*ecdsa.PublicKey)
+		if !ok {
+			e = fmt.Errorf("%s: key is not ECDSA", r.CSRFile)
+			return
+		}
+		kid, err := pubKeyID(pub)
+		if err != nil || hex.EncodeToString(kid) != r.KeySHA256 {
+			e = fmt.Errorf("%s does not hold the listed key", r.CSRFile)
+			return
+		}
+		r.Approval, e = ReadPendingIssuance(filepath.Join(dir, r.ApprovalFile()))
+		if errors.Is(e, os.ErrNotExist) {
+			r.Approval, e = nil, nil
+		} else if e != nil {
+			return
+		}
+	}
+	sum = sha256Hex(data)
+	return
+}
+
+// requestSpec is the spec the CA would use for req, exactly as if it were
+// issuing the cert directly.
+func (ca *CA) requestSpec(req *CeremonyRequest) (spec certSpec, e error) {
+	switch req.Role {
+	case RoleServer:
+		if req.Name != ca.Service {
+			e = fmt.Errorf("server must be named %q, not %q", ca.Service, req.Name)
+			return
+		}
+		spec = ca.serverSpec()
+	case RoleClient:
+		if req.Index >= 0 && req.Name != fmt.Sprintf("Client%d", req.Index) {
+			e = fmt.Errorf("client %d must be named Client%d, not %q", req.Index, req.Index, req.Name)
+			return
+		}
+		spec, e = ca.clientSpec(req.Name, req.Index, req.Claims)
+	default:
+		e = fmt.Errorf("can't issue role %q in a ceremony", req.Role)
+	}
+	return
+}
+
+// SignCSR issues a cert for the key in csr, which must be correctly self
+// signed. The role, name, index and claims of req decide everything else in
+// the cert, as they would for the Create methods; the rest of the CSR is
+// ignored. If ca.Approvals covers the role, req.Approval must approve this
+// request and this key.
+func (ca *CA) SignCSR(csr *x509.CertificateRequest, req *CeremonyRequest) (*x509.Certificate, error) {
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("bad CSR signature: %s", err)
+	}
+	pub, ok := csr.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("CSR key is not ECDSA")
+	}
+	if csr.Subject.CommonName != req.Name {
+		return nil, fmt.Errorf("CSR is for %q, not %q", csr.Subject.CommonName, req.Name)
+	}
+	spec, err := ca.requestSpec(req)
+	if err != nil {
+		return nil, err
+	}
+	spec.publicKey = pub
+	if req.Approval != nil && ca.Approvals != nil {
+		keyID, err := csrKeyID(csr)
+		if err != nil {
+			return nil, err
+		}
+		if err := ca.checkApproval(req.Approval, req.Role, req.Name, keyID); err != nil {
+			return nil, err
+		}
+		spec.request = req.Approval.Request.ID
+	}
+	c, err := ca.createCert(spec, &ca.Raw)
+	if err != nil {
+		return nil, err
+	}
+	return &c.Certificate, nil
+}
+
+// SignCeremonyBatch signs every request in b, which must be for this CA.
+// sum is the batch checksum from ReadCeremonyBatch, recorded in the result
+// so the online side can tell which batch it answers.
+func (ca *CA) SignCeremonyBatch(b *CeremonyBatch, sum string) (res *CeremonyResult, e error) {
+	if b.CAFingerprint != Fingerprint(&ca.Raw.Certificate) || b.ParkID != ca.ParkID {
+		e = errors.New("batch is for a different CA")
+		return
+	}
+	res = &CeremonyResult{
+		Version:     ceremonyVersion,
+		BatchID:     b.ID,
+		BatchSHA256: sum,
+		Signed:      ca.now().UTC(),
+		Certs:       []CeremonyCert{},
+	}
+	for i := range b.Requests {
+		r := &b.Requests[i]
+		if r.csr == nil {
+			return nil, fmt.Errorf("%s has no CSR loaded", r.Name)
+		}
+		cert, err := ca.SignCSR(r.csr, r)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", r.Name, err)
+		}
+		res.Certs = append(res.Certs, CeremonyCert{
+			Request:     i,
+			CertFile:    r.Stub() + "_cert.pem",
+			Fingerprint: Fingerprint(cert),
+			Cert:        cert,
+		})
+	}
+	return
+}
+
+// Write adds the signed certs and results.json to the batch directory.
+func (res *CeremonyResult) Write(dir string) error {
+	for _, c := range res.Certs {
+		data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Cert.Raw})
+		if err := os.WriteFile(filepath.Join(dir, c.CertFile), data, 0644); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, CeremonyResultFile), append(data, '\n'), 0644)
+}
+
+// ReadCeremonyResult reads a signed batch directory back on the online side.
+// Every cert must match its checksum, be signed by caCert, certify the key
+// from its CSR and answer exactly one request of this batch.
+func ReadCeremonyResult(dir string, caCert *x509.Certificate) (b *CeremonyBatch, res *CeremonyResult, e error) {
+	b, sum, e := ReadCeremonyBatch(dir)
+	if e != nil {
+		return
+	}
+	if b.CAFingerprint != Fingerprint(caCert) {
+		e = errors.New("batch is for a different CA")
+		return
+	}
+	data, e := readCeremonyFile(dir, CeremonyResultFile)
+	if e != nil {
+		return
+	}
+	res = &CeremonyResult{}
+	if e = json.Unmarshal(data, res); e != nil {
+		e = fmt.Errorf("invalid %s: %s", CeremonyResultFile, e)
+		return
+	}
+	if res.Version != ceremonyVersion {
+		e = fmt.Errorf("unsupported result version %d", res.Version)
+		return
+	}
+	if res.BatchID != b.ID || res.BatchSHA256 != sum {
+		e = errors.New("results are for a different batch, or the batch changed after signing")
+		return
+	}
+	if len(res.Certs) != len(b.Requests) {
+		e = fmt.Errorf("%d requests but %d certs", len(b.Requests), len(res.Certs))
+		return
+	}
+
+	answered := make(map[int]bool)
+	for i := range res.Certs {
+		c := &res.Certs[i]
+		if c.Request < 0 || c.Request >= len(b.Requests) || answered[c.Request] {
+			e = fmt.Errorf("%s answers no request, or one already answered", c.CertFile)
+			return
+		}
+		answered[c.Request] = true
+		req := &b.Requests[c.Request]
+
+		var pemCert []byte
+		if pemCert, e = readCeremonyFile(dir, c.CertFile); e != nil {
+			return
+		}
+		if c.Cert, e = parseCertPEM(pemCert); e != nil {
+			e = fmt.Errorf("%s: %s", c.CertFile, e)
+			return
+		}
+		if Fingerprint(c.Cert) != c.Fingerprint {
+			e = fmt.Errorf("%s does not match its checksum", c.CertFile)
+			return
+		}
+		if e = c.Cert.CheckSignatureFrom(caCert); e != nil {
+			e = fmt.Errorf("%s not signed by this CA: %s", c.CertFile, e)
+			return
+		}
+		pub, ok := req.csr.PublicKey.(*ecdsa.PublicKey)
+		if !ok || !pub.Equal(c.Cert.PublicKey) {
+			e = fmt.Errorf("%s does not certify the key requested for %s", c.CertFile, req.Name)
+			return
+		}
+		if c.Cert.Subject.CommonName != req.Name || memberRole(c.Cert) != req.Role {
+			e = fmt.Errorf("%s is not the %s %s that was requested", c.CertFile, req.Role, req.Name)
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,98 @@
+package enough
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCeremony(t *testing.T) {
+	t.Parallel()
+	ca, err := NewCA("widget")
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	pemCert, _ := ca.Raw.MarshalCertificate()
+
+	// online: only the CA cert
+	b, err := NewCeremonyBatch(pemCert)
+	if err != nil {
+		t.Fatalf("failed to start batch: %s", err)
+	}
+	serverKey, err := b.AddServer()
+	if err != nil {
+		t.Fatalf("failed to add server: %s", err)
+	}
+	if _, err := b.AddNumberedClient(7, nil); err != nil {
+		t.Fatalf("failed to add client: %s", err)
+	}
+	if _, err := b.AddClient("alice@ops", &Claims{Roles: []string{"admin"}}); err != nil {
+		t.Fatalf("failed to add client: %s", err)
+	}
+	if _, err := b.AddClient("ALICE@ops", nil); err == nil {
+		t.Error("added the same client twice")
+	}
+	if _, err := b.AddClient("../etc", nil); err == nil {
+		t.Error("added a bad client name")
+	}
+	dir := filepath.Join(t.TempDir(), "batch")
+	sum, err := b.Write(dir)
+	if err != nil {
+		t.Fatalf("failed to write batch: %s", err)
+	}
+
+	// offline
+	read, readSum, err := ReadCeremonyBatch(dir)
+	if err != nil {
+		t.Fatalf("failed to read batch: %s", err)
+	}
+	if readSum != sum || len(read.Requests) != 3 {
+		t.Fatalf("read back a different batch")
+	}
+	res, err := ca.SignCeremonyBatch(read, readSum)
+	if err != nil {
+		t.Fatalf("failed to sign batch: %s", err)
+	}
+	if err := res.Write(dir); err != nil {
+		t.Fatalf("failed to write results: %s", err)
+	}
+
+	// online again
+	_, got, err := ReadCeremonyResult(dir, &ca.Raw.Certificate)
+	if err != nil {
+		t.Fatalf("failed to read results: %s", err)
+	}
+	server := got.Certs[0].Cert
+	if !serverKey.PublicKey.Equal(server.PublicKey) || server.DNSNames[0] != "widget" {
+		t.Error("server cert does not match the request")
+	}
+	claims, err := ClaimsFromCert(got.Certs[2].Cert)
+	if err != nil || !claims.HasRole("admin") {
+		t.Errorf("client claims were lost: %v", err)
+	}
+
+	// a batch changed after signing is refused
+	batch := filepath.Join(dir, CeremonyBatchFile)
+	data, _ := os.ReadFile(batch)
+	os.WriteFile(batch, append(data, ' '), 0644)
+	if _, _, err := ReadCeremonyResult(dir, &ca.Raw.Certificate); err == nil {
+		t.Error("imported results for a modified batch")
+	}
+	os.WriteFile(batch, data, 0644)
+
+	// and so is a CSR swapped for another
+	csr := filepath.Join(dir, read.Requests[1].CSRFile)
+	other, _ := os.ReadFile(filepath.Join(dir, read.Requests[0].CSRFile))
+	os.WriteFile(csr, other, 0644)
+	if _, _, err := ReadCeremonyBatch(dir); err == nil {
+		t.Error("read a batch with a swapped CSR")
+	}
+
+	other2, err := NewCA("widget")
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	if _, err := other2.SignCeremonyBatch(read, readSum); err == nil {
+		t.Error("signed a batch for a different CA")
+	}
+}
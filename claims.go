@@ -0,0 +1,115 @@
+package enough
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// Private extensions live under 1.3.6.1.4.1.59567.1. The arc is not
+// registered anywhere; nothing but enough is expected to read them.
+var oidClaims = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 59567, 1, 1}
+
+var claimRE = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:-]{0,63}$`)
+
+// Claims are the roles and attributes a member cert carries for
+// authorization, eg roles ["ingest"] and attributes {"site": "syd"}.
+type Claims struct {
+	Roles      []string          `json:"roles,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+type claimAttribute struct {
+	Key   string `asn1:"utf8"`
+	Value string `asn1:"utf8"`
+}
+
+type claimsExtension struct {
+	Roles      []string
+	Attributes []claimAttribute
+}
+
+// Validate checks that roles and attribute keys are 1-64 characters from
+// [A-Za-z0-9._:-] and that no role is repeated. Attribute values are free
+// text.
+func (c *Claims) Validate() error {
+	seen := make(map[string]bool)
+	for _, r := range c.Roles {
+		if !claimRE.MatchString(r) {
+			return fmt.Errorf("invalid role %q", r)
+		}
+		if seen[r] {
+			return fmt.Errorf("duplicate role %q", r)
+		}
+		seen[r] = true
+	}
+	for k := range c.Attributes {
+		if !claimRE.MatchString(k) {
+			return fmt.Errorf("invalid attribute name %q", k)
+		}
+	}
+	return nil
+}
+
+// HasRole reports whether role is one of the claimed roles.
+func (c *Claims) HasRole(role string) bool {
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Claims) extension() (ext pkix.Extension, e error) {
+	if e = c.Validate(); e != nil {
+		return
+	}
+	raw := claimsExtension{Roles: c.Roles, Attributes: []claimAttribute{}}
+	if raw.Roles == nil {
+		raw.Roles = []string{}
+	}
+	// sorted, so the same claims always encode the same way
+	keys := make([]string, 0, len(c.Attributes))
+	for k := range c.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		raw.Attributes = append(raw.Attributes, claimAttribute{Key: k, Value: c.Attributes[k]})
+	}
+
+	value, e := asn1.Marshal(raw)
+	if e != nil {
+		return
+	}
+	ext = pkix.Extension{Id: oidClaims, Value: value}
+	return
+}
+
+// ClaimsFromCert returns the claims embedded in cert. A cert issued without
+// claims has empty Claims, not an error.
+func ClaimsFromCert(cert *x509.Certificate) (*Claims, error) {
+	claims := &Claims{Attributes: make(map[string]string)}
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidClaims) {
+			continue
+		}
+		var raw claimsExtension
+		if rest, err := asn1.Unmarshal(ext.Value, &raw); err != nil || len(rest) != 0 {
+			return nil, errors.New("malformed claims extension")
+		}
+		claims.Roles = raw.Roles
+		for _, a := range raw.Attributes {
+			claims.Attributes[a.Key] = a.Value
+		}
+		if err := claims.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return claims, nil
+}
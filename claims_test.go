@@ -0,0 +1,33 @@
+package enough
+
+import "testing"
+
+func TestClaimsRoundtrip(t *testing.T) {
+	t.Parallel()
+	ca, err := NewCA("testing")
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	want := &Claims{
+		Roles:      []string{"ingest", "reader"},
+		Attributes: map[string]string{"site": "syd", "tier": "gold"},
+	}
+	c, err := ca.CreateClientCertWithClaims("worker", want)
+	if err != nil {
+		t.Fatalf("unable to create client cert: %s", err)
+	}
+	got, err := ClaimsFromCert(&c.Certificate)
+	if err != nil {
+		t.Fatalf("failed to read claims: %s", err)
+	}
+	if len(got.Roles) != 2 || !got.HasRole("ingest") || !got.HasRole("reader") {
+		t.Errorf("roles changed: %v", got.Roles)
+	}
+	if got.Attributes["site"] != "syd" || got.Attributes["tier"] != "gold" {
+		t.Errorf("attributes changed: %v", got.Attributes)
+	}
+
+	if _, err := ca.CreateClientCertWithClaims("worker", &Claims{Roles: []string{"bad role"}}); err == nil {
+		t.Error("accepted invalid role")
+	}
+}
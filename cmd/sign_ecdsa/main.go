@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"github.com/bnagy/enough"
+	"github.com/bnagy/enough/sign"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	cert     = flag.String("cert", "", "Certificate file ( in PEM format ) for the signing key, optionally followed by intermediates")
+	key      = flag.String("key", "", "Private key file ( in PEM format ) to sign with")
+	file     = flag.String("file", "", "File to sign")
+	out      = flag.String("out", "", "Signature file to write, default <file>.sig")
+	hashName = flag.String("hash", "sha256", "Digest to sign with: sha256, sha384 or sha512")
+	dir      = flag.String("dir", "", "Release directory to write a signed "+enough.ReleaseManifestFile+" for, instead of -file")
+	legacy   = flag.Bool("legacy", false, "Write a bare ( raw DER ) (R,S) signature, hashed as the cert's signature algorithm, instead of an ENOUGH SIGNATURE")
+	tsa      = flag.String("tsa", "", "RFC 3161 timestamp authority URL ( eg tlspark tsa ) to timestamp the signature with, written next to it as .tsr")
+)
+
+func readPEM(path, what string) *pem.Block {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("failed to read %s from %s: %s", what, path, err)
+	}
+	block, rest := pem.Decode(raw)
+	if len(rest) != 0 || block == nil {
+		log.Fatalf("%s: invalid PEM data", path)
+	}
+	return block
+}
+
+func readCerts(path string) (certs []*x509.Certificate) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("failed to read cert from %s: %s", path, err)
+	}
+	for {
+		var block *pem.Block
+		block, raw = pem.Decode(raw)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			log.Fatalf("%s: unexpected %s PEM block", path, block.Type)
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			log.Fatalf("failed to parse certificate: %s\n", err)
+		}
+		certs = append(certs, c)
+	}
+	if len(raw) != 0 || len(certs) == 0 {
+		log.Fatalf("%s: invalid PEM data", path)
+	}
+	return
+}
+
+// legacyHash is how verify_ecdsa picks the digest for a bare signature: from
+// the cert's SignatureAlgorithm, since the signature itself doesn't say.
+func legacyHash(c *x509.Certificate) crypto.Hash {
+	var hashType crypto.Hash
+
+	switch c.SignatureAlgorithm {
+	case x509.ECDSAWithSHA1:
+		hashType = crypto.SHA1
+	case x509.ECDSAWithSHA256:
+		hashType = crypto.SHA256
+	case x509.ECDSAWithSHA384:
+		hashType = crypto.SHA384
+	case x509.ECDSAWithSHA512:
+		hashType = crypto.SHA512
+	default:
+		log.Fatalf("unsupported hash algorithm")
+	}
+	if !hashType.Available() {
+		log.Fatalf("unsupported hash algorithm")
+	}
+	return hashType
+}
+
+// timestamp gets sig timestamped by -tsa, if given, and writes the reply to
+// path.
+func timestamp(sig []byte, path string) {
+	if len(*tsa) == 0 {
+		return
+	}
+	ts, der, err := enough.RequestTimestamp(*tsa, sig)
+	if err != nil {
+		log.Fatalf("failed to timestamp signature: %s\n", err)
+	}
+	if err := ioutil.WriteFile(path, der, 0644); err != nil {
+		log.Fatalf("failed to write %s: %s\n", path, err)
+	}
+	fmt.Printf("Timestamped by %s at %s, in %s\n", ts.Signer.Subject.CommonName, ts.Time.Format(time.RFC3339), path)
+}
+
+// signRelease writes a manifest of every file in -dir, signed once.
+func signRelease(signer *sign.Signer) {
+	m, err := enough.NewReleaseManifest(*dir)
+	if err != nil {
+		log.Fatalf("failed to list %s: %s\n", *dir, err)
+	}
+	if err := m.Sign(signer.Key, signer.Chain); err != nil {
+		log.Fatalf("failed to sign manifest: %s\n", err)
+	}
+	path := filepath.Join(*dir, enough.ReleaseManifestFile)
+	if err := m.Write(path); err != nil {
+		log.Fatalf("failed to write %s: %s\n", path, err)
+	}
+	fmt.Printf("Signed %d files in %s, manifest in %s\n", len(m.Files), *dir, path)
+	timestamp([]byte(m.Signature), filepath.Join(*dir, enough.ReleaseTimestampFile))
+}
+
+func main() {
+
+	flag.Parse()
+	if len(*cert) == 0 || len(*key) == 0 || (len(*file) == 0) == (len(*dir) == 0) {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if len(*out) == 0 {
+		*out = *file + ".sig"
+	}
+
+	chain := readCerts(*cert)
+	signerCert := chain[0]
+	priv, err := x509.ParseECPrivateKey(readPEM(*key, "key").Bytes)
+	if err != nil {
+		log.Fatalf("failed to parse private key: %s\n", err)
+	}
+	// verify_ecdsa won't accept anything but a code signing cert, so don't
+	// make signatures it will reject.
+	signer, err := sign.NewSigner(priv, chain)
+	if err != nil {
+		log.Fatalf("%s: %s, issue a code signing cert with tlspark -signers", *cert, err)
+	}
+
+	if len(*dir) != 0 {
+		signRelease(signer)
+		return
+	}
+
+	fr, err := os.Open(*file)
+	if err != nil {
+		log.Fatalf("failed to open %s: %s\n", *file, err)
+	}
+	defer fr.Close()
+
+	var sig []byte
+	var hashType crypto.Hash
+	if *legacy {
+		hashType = legacyHash(signerCert)
+		h := hashType.New()
+		if _, err := io.Copy(h, fr); err != nil {
+			log.Fatalf("failed to read %s: %s\n", *file, err)
+		}
+		// SignASN1 gives us R and S as an ASN.1 SEQUENCE, which is exactly
+		// what verify_ecdsa unmarshals.
+		if sig, err = ecdsa.SignASN1(rand.Reader, priv, h.Sum(nil)); err != nil {
+			log.Fatalf("failed to sign: %s\n", err)
+		}
+	} else {
+		if hashType, err = enough.ParseHash(*hashName); err != nil {
+			log.Fatalf("%s", err)
+		}
+		signer.Hash = hashType
+		if sig, err = sign.Sign(fr, signer); err != nil {
+			log.Fatalf("failed to sign %s: %s\n", *file, err)
+		}
+	}
+
+	if err := ioutil.WriteFile(*out, sig, 0644); err != nil {
+		log.Fatalf("failed to write %s: %s\n", *out, err)
+	}
+
+	fmt.Printf("Signed %s with %s, signature in %s\n", *file, hashType, *out)
+	timestamp(sig, *out+".tsr")
+
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/bnagy/enough"
+	"log"
+	"os"
+)
+
+/**
+ * tlspark request: make the key for a server, intermediate CA, code signing
+ * or timestamping cert, and write a pending request to certify it, for
+ * admins to approve with tlspark approve. Only the CA cert is needed.
+ */
+func requestCmd(args []string) {
+	fs := flag.NewFlagSet("request", flag.ExitOnError)
+	certPath := fs.String("ca-cert", "ca_cert.pem", "Path to the CA cert pem file")
+	role := fs.String("role", enough.RoleServer, "What to request: server, intermediate, codesigning or timestamping")
+	name := fs.String("name", "", "Service name of the intermediate, or name of the signer or TSA (the server is always the park service)")
+	dns := fs.String("permit-dns", "", "Comma separated DNS domains the intermediate may issue for")
+	ips := fs.String("permit-ip", "", "Comma separated IP ranges the intermediate may issue for")
+	uris := fs.String("permit-uri", "", "Comma separated URI domains the intermediate may issue for")
+	out := fs.String("out", "", "Pending request file to write (required)")
+	keyOut := fs.String("key-out", "", "Where to write the new key (default server_key.pem, <name>_ca_key.pem or <name>_key.pem)")
+	fs.Parse(args)
+	if !present(*out) {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	ca := &enough.CA{Raw: enough.RawCert{Certificate: *readCert(*certPath)}}
+	info, err := enough.ParkInfoFromCert(&ca.Raw.Certificate)
+	if err != nil {
+		log.Fatalf("failed to read park info: %s", err)
+	}
+	ca.Service = info.Service
+	if *role == enough.RoleServer {
+		*name = ca.Service
+	}
+	if !present(*name) {
+		fs.Usage()
+		os.Exit(1)
+	}
+	nc, err := enough.ParseNameConstraints(*dns, *ips, *uris)
+	if err != nil {
+		log.Fatalf("bad name constraints: %s", err)
+	}
+
+	key, err := enough.GenerateRecipientKey()
+	if err != nil {
+		log.Fatalf("failed to generate key: %s", err)
+	}
+	r, err := ca.NewIssuanceRequest(*role, *name, &key.PublicKey, nc)
+	if err != nil {
+		log.Fatalf("failed to make request: %s", err)
+	}
+	if !present(*keyOut) {
+		*keyOut = requestStub(r) + "_key.pem"
+	}
+	if _, err := os.Stat(*keyOut); err == nil {
+		log.Fatalf("%s already exists", *keyOut)
+	}
+	keyPem, err := (&enough.RawCert{PrivateKey: key}).MarshalPrivateKey()
+	if err != nil {
+		log.Fatalf("failed to marshal key: %s", err)
+	}
+	writeFile(*keyOut, keyPem, 0600)
+
+	p := &enough.PendingIssuance{Request: *r, Approvals: []enough.Approval{}}
+	if err := enough.WritePendingIssuance(*out, p); err != nil {
+		log.Fatalf("failed to write %s: %s", *out, err)
+	}
+	log.Printf("wrote request %s to %s", r.ID, *out)
+}
+
+/**
+ * Returns the stub tlspark names r's files with: server, <name>_ca for an
+ * intermediate, or the signer or TSA name. The name must already be
+ * validated.
+ */
+func requestStub(r *enough.IssuanceRequest) string {
+	switch r.Role {
+	case enough.RoleServer:
+		return "server"
+	case enough.RoleIntermediate:
+		return r.Name + "_ca"
+	}
+	return r.Name
+}
+
+/**
+ * tlspark approve: show a pending request and add this admin's approval.
+ */
+func approveCmd(args []string) {
+	fs := flag.NewFlagSet("approve", flag.ExitOnError)
+	in := fs.String("request", "", "Pending request file, from tlspark request or ceremony-export (required)")
+	keyPath := fs.String("key", "", "This admin's private key pem, from tlspark keygen (required)")
+	admin := fs.String("admin", "", "This admin's name, for the record")
+	fs.Parse(args)
+	if !present(*in, *keyPath) {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	p, err := enough.ReadPendingIssuance(*in)
+	if err != nil {
+		log.Fatalf("failed to read %s: %s", *in, err)
+	}
+	key, err := enough.ParsePrivateKeyPEM(readFile(*keyPath))
+	if err != nil {
+		log.Fatalf("failed to parse %s: %s", *keyPath, err)
+	}
+
+	r := &p.Request
+	fmt.Printf("request:  %s, created %s\n", r.ID, r.Created)
+	fmt.Printf("ca:       %s\n", r.CAFingerprint)
+	fmt.Printf("issue:    %s %s\n", r.Role, r.Name)
+	if present(r.KeySHA256) {
+		fmt.Printf("key:      %s\n", r.KeySHA256)
+	}
+	for _, d := range r.PermitDNS {
+		fmt.Printf("permit:   dns %s\n", d)
+	}
+	for _, ip := range r.PermitIP {
+		fmt.Printf("permit:   ip %s\n", ip)
+	}
+	for _, u := range r.PermitURI {
+		fmt.Printf("permit:   uri %s\n", u)
+	}
+
+	a, err := r.Approve(*admin, key)
+	if err != nil {
+		log.Fatalf("failed to approve: %s", err)
+	}
+	p.Add(a)
+	if err := enough.WritePendingIssuance(*in, p); err != nil {
+		log.Fatalf("failed to write %s: %s", *in, err)
+	}
+	log.Printf("approved; %s now has %d approvals", *in, len(p.Approvals))
+}
+
+/**
+ * tlspark issue: issue an approved request from tlspark request, and
+ * record it and its approvals in the park inventory. The issuance log
+ * records the request too, so it can't be issued again.
+ */
+func issueCmd(args []string) {
+	fs := flag.NewFlagSet("issue", flag.ExitOnError)
+	in := fs.String("request", "", "Approved request file (required)")
+	certPath := fs.String("ca-cert", "ca_cert.pem", "Path to the CA cert pem file")
+	keyPath := fs.String("ca-key", "ca_key.pem", "Path to the CA private key pem file")
+	signerPath := fs.String("ca-signer", "", "Unix socket of a 'tlspark signer' holding the CA key, instead of -ca-key")
+	inventoryPath := fs.String("inventory", enough.InventoryFile, "Park inventory to record the cert in")
+	reqKeyPath := fs.String("key", "", "The requested key, from tlspark request (default server_key.pem, <name>_ca_key.pem or <name>_key.pem)")
+	fs.Parse(args)
+	if !present(*in) {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	ca, err := loadCA(*certPath, *keyPath, *signerPath)
+	if err != nil {
+		log.Fatalf("failed to load CA: %s", err)
+	}
+	if ca.Approvals == nil {
+		log.Fatalf("this park has no %s", enough.ApprovalPolicyFile)
+	}
+	checkParkManifest(ca, ".")
+	p, err := enough.ReadPendingIssuance(*in)
+	if err != nil {
+		log.Fatalf("failed to read %s: %s", *in, err)
+	}
+	inv, err := enough.LoadInventory(*inventoryPath, &ca.Raw.Certificate)
+	if err != nil {
+		log.Fatalf("failed to load %s: %s", *inventoryPath, err)
+	}
+	if inv.Used(p.Request.ID) {
+		log.Fatalf("request %s has already been issued", p.Request.ID)
+	}
+
+	switch p.Request.Role {
+	case enough.RoleServer:
+	case enough.RoleIntermediate, enough.RoleCodeSigning, enough.RoleTimestamping:
+		// the request file isn't trusted until the CA checks the approvals,
+		// so don't build paths from it before then
+		if err := enough.ValidateMemberName(p.Request.Name); err != nil {
+			log.Fatalf("bad request: %s", err)
+		}
+	default:
+		log.Fatalf("can't issue role %q", p.Request.Role)
+	}
+	stub := requestStub(&p.Request)
+	if _, err := os.Stat(stub + "_cert.pem"); err == nil {
+		log.Fatalf("%s_cert.pem already exists", stub)
+	}
+	// issuing uses the request up, so catch what the inventory would refuse
+	cn := p.Request.Name
+	switch p.Request.Role {
+	case enough.RoleServer:
+		cn = ca.Service
+	case enough.RoleIntermediate:
+		cn = p.Request.Name + " CA"
+	}
+	if inv.Find(cn) != nil {
+		log.Fatalf("%s is already issued in this park", cn)
+	}
+	if !present(*reqKeyPath) {
+		*reqKeyPath = stub + "_key.pem"
+	}
+	key, err := enough.ParsePrivateKeyPEM(readFile(*reqKeyPath))
+	if err != nil {
+		log.Fatalf("failed to parse %s: %s", *reqKeyPath, err)
+	}
+
+	attachLog(ca, ".", false)
+	var c *enough.RawCert
+	switch p.Request.Role {
+	case enough.RoleServer:
+		c, err = ca.CreateServerCertApproved(p, key)
+	case enough.RoleIntermediate:
+		var sub *enough.CA
+		if sub, err = ca.CreateIntermediateCAApproved(p, key); err == nil {
+			c = &sub.Raw
+		}
+	case enough.RoleCodeSigning:
+		c, err = ca.CreateCodeSigningCertApproved(p, key)
+	case enough.RoleTimestamping:
+		c, err = ca.CreateTimestampingCertApproved(p, key)
+	}
+	if err != nil {
+		log.Fatalf("failed to issue: %s", err)
+	}
+	if err := inv.AddApproved(&c.Certificate, stub+"_cert.pem", "", p); err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	output(c, stub)
+	if p.Request.Role != enough.RoleIntermediate {
+		outputBundle(ca, c, stub)
+	}
+	finishLog(ca, ".")
+	if err := inv.Save(*inventoryPath); err != nil {
+		log.Fatalf("failed to save %s: %s", *inventoryPath, err)
+	}
+	signParkManifest(ca, ".")
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/bnagy/enough"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/**
+ * tlspark ceremony-export: run on the online side. Makes keys for the server
+ * and / or clients next to the park, and a batch directory of CSRs for the
+ * offline CA to sign. Only the CA cert is needed.
+ */
+func ceremonyExportCmd(args []string) {
+	fs := flag.NewFlagSet("ceremony-export", flag.ExitOnError)
+	certPath := fs.String("ca-cert", "ca_cert.pem", "Path to the CA cert pem file")
+	dir := fs.String("batch", "", "Batch directory to create (required)")
+	server := fs.Bool("server", false, "Request the server cert")
+	clients := fs.Int("clients", 0, "Number of numbered clients to request")
+	clientOffset := fs.Int("client-offset", 0, "Index to start numbering clients from")
+	namesPath := fs.String("names", "", "File of client names, one per line, to request")
+	roleList := fs.String("roles", "", "Comma separated roles to embed in the client certs")
+	attrList := fs.String("attrs", "", "Comma separated key=value attributes to embed in the client certs")
+	fs.Parse(args)
+	if !present(*dir) {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	b, err := enough.NewCeremonyBatch(readFile(*certPath))
+	if err != nil {
+		log.Fatalf("failed to start batch: %s", err)
+	}
+	claims, err := parseClaims(*roleList, *attrList)
+	if err != nil {
+		log.Fatalf("bad claims: %s", err)
+	}
+
+	keys := make(map[string]*enough.RawCert)
+	if *server {
+		key, err := b.AddServer()
+		if err != nil {
+			log.Fatalf("failed to request server: %s", err)
+		}
+		keys["server"] = &enough.RawCert{PrivateKey: key}
+	}
+	if present(*namesPath) {
+		names, err := readNamesFile(*namesPath)
+		if err != nil {
+			log.Fatalf("bad names file: %s", err)
+		}
+		for _, n := range names {
+			key, err := b.AddClient(n, claims)
+			if err != nil {
+				log.Fatalf("failed to request %s: %s", n, err)
+			}
+			keys[n] = &enough.RawCert{PrivateKey: key}
+		}
+	}
+	for i := *clientOffset; i < *clientOffset+*clients; i++ {
+		key, err := b.AddNumberedClient(i, claims)
+		if err != nil {
+			log.Fatalf("failed to request client %d: %s", i, err)
+		}
+		keys[fmt.Sprintf("client%d", i)] = &enough.RawCert{PrivateKey: key}
+	}
+	if len(b.Requests) == 0 {
+		log.Fatalf("nothing to request: use -server, -clients or -names")
+	}
+
+	// nothing may already be issued, or have a key waiting for a cert
+	ca := &enough.CA{Raw: enough.RawCert{Certificate: *readCert(*certPath)}}
+	existing, err := existingNames(".", ca)
+	if err != nil {
+		log.Fatalf("unable to list existing certs: %s", err)
+	}
+	for _, r := range b.Requests {
+		if path, ok := existing[strings.ToLower(r.Stub())]; ok {
+			log.Fatalf("%s is already issued in this park (%s)", r.Name, path)
+		}
+		if _, err := os.Stat(r.Stub() + "_key.pem"); err == nil {
+			log.Fatalf("%s_key.pem already exists", r.Stub())
+		}
+	}
+
+	sum, err := b.Write(*dir)
+	if err != nil {
+		log.Fatalf("failed to write batch: %s", err)
+	}
+	for _, r := range b.Requests {
+		pem, err := keys[r.Stub()].MarshalPrivateKey()
+		if err != nil {
+			log.Fatalf("failed to marshal key: %s", err)
+		}
+		writeFile(r.Stub()+"_key.pem", pem, 0600)
+	}
+	log.Printf("wrote batch %s to %s with %d requests", b.ID, *dir, len(b.Requests))
+	log.Printf("batch sha256 %s - check it matches at the ceremony", sum)
+}
+
+/**
+ * tlspark ceremony-sign: run on the offline side. Checks the batch, lists
+ * every request and, once the operator agrees, signs them into the batch
+ * directory.
+ */
+func ceremonySignCmd(args []string) {
+	fs := flag.NewFlagSet("ceremony-sign", flag.ExitOnError)
+	certPath := fs.String("ca-cert", "ca_cert.pem", "Path to the CA cert pem file")
+	keyPath := fs.String("ca-key", "ca_key.pem", "Path to the CA private key pem file")
+	dir := fs.String("batch", "", "Batch directory from ceremony-export (required)")
+	yes := fs.Bool("yes", false, "Sign without asking for confirmation")
+	fs.Parse(args)
+	if !present(*dir) {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	ca, err := loadCA(*certPath, *keyPath, "")
+	if err != nil {
+		log.Fatalf("failed to load CA: %s", err)
+	}
+	parkDir := filepath.Dir(*certPath)
+	checkParkManifest(ca, parkDir)
+	b, sum, err := enough.ReadCeremonyBatch(*dir)
+	if err != nil {
+		log.Fatalf("bad batch: %s", err)
+	}
+
+	fmt.Printf("batch:    %s, created %s\n", b.ID, b.Created)
+	fmt.Printf("sha256:   %s\n", sum)
+	fmt.Printf("park:     %s (%s)\n", b.ParkID, b.Service)
+	fmt.Printf("ca:       %s\n", b.CAFingerprint)
+	fmt.Printf("requests:\n")
+	for i, r := range b.Requests {
+		fmt.Printf("  %3d  %-6s  %-24s  key %s\n", i, r.Role, r.Name, r.KeySHA256[:16])
+		if r.Claims != nil && len(r.Claims.Roles) > 0 {
+			fmt.Printf("       roles %s\n", strings.Join(r.Claims.Roles, ","))
+		}
+		if r.Claims != nil {
+			for k, v := range r.Claims.Attributes {
+				fmt.Printf("       attribute %s=%s\n", k, v)
+			}
+		}
+	}
+
+	if !*yes {
+		fmt.Printf("sign these %d requests? [y/N] ", len(b.Requests))
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+			log.Fatalf("not signed")
+		}
+	}
+
+	// the offline side holds the authoritative issuance log, since only it
+	// can sign tree heads; a copy goes back with the certs
+	attachLog(ca, parkDir, false)
+	res, err := ca.SignCeremonyBatch(b, sum)
+	if err != nil {
+		log.Fatalf("failed to sign batch: %s", err)
+	}
+	finishLog(ca, parkDir)
+	signParkManifest(ca, parkDir)
+	if err := res.Write(*dir); err != nil {
+		log.Fatalf("failed to write results: %s", err)
+	}
+	for _, f := range []string{enough.IssuanceLogFile, enough.TreeHeadFile} {
+		writeFile(filepath.Join(*dir, f), readFile(filepath.Join(parkDir, f)), 0644)
+	}
+	log.Printf("signed %d certs into %s", len(res.Certs), *dir)
+}
+
+/**
+ * tlspark ceremony-import: run on the online side with the signed batch.
+ * Checks every cert against the batch and the CA, puts it next to its key
+ * and records it in the park inventory.
+ */
+func ceremonyImportCmd(args []string) {
+	fs := flag.NewFlagSet("ceremony-import", flag.ExitOnError)
+	certPath := fs.String("ca-cert", "ca_cert.pem", "Path to the CA cert pem file")
+	dir := fs.String("batch", "", "Signed batch directory from ceremony-sign (required)")
+	inventoryPath := fs.String("inventory", enough.InventoryFile, "Park inventory to record the certs in")
+	fs.Parse(args)
+	if !present(*dir) {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	caCert := readCert(*certPath)
+	b, res, err := enough.ReadCeremonyResult(*dir, caCert)
+	if err != nil {
+		log.Fatalf("bad signed batch: %s", err)
+	}
+	inv, err := enough.LoadInventory(*inventoryPath, caCert)
+	if err != nil {
+		log.Fatalf("failed to load %s: %s", *inventoryPath, err)
+	}
+	policy, err := loadApprovals(filepath.Dir(*certPath), caCert)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	// The log copy must be signed by the CA, contain every new cert and
+	// extend the log we already have.
+	batchLog, err := enough.LoadIssuanceLog(filepath.Join(*dir, enough.IssuanceLogFile))
+	if err != nil {
+		log.Fatalf("failed to load the batch's issuance log: %s", err)
+	}
+	var sth enough.SignedTreeHead
+	readJSON(filepath.Join(*dir, enough.TreeHeadFile), &sth)
+	if err := sth.Verify(caCert); err != nil {
+		log.Fatalf("bad tree head in batch: %s", err)
+	}
+	if err := batchLog.CheckTreeHead(&sth); err != nil {
+		log.Fatalf("bad issuance log in batch: %s", err)
+	}
+	localLog, err := enough.LoadIssuanceLog(enough.IssuanceLogFile)
+	if err != nil {
+		log.Fatalf("failed to load issuance log: %s", err)
+	}
+	if err := batchLog.Extends(localLog); err != nil {
+		log.Fatalf("bad issuance log in batch: %s", err)
+	}
+
+	// check everything before writing anything
+	for _, c := range res.Certs {
+		if i, ok := batchLog.Index(c.Cert); !ok || i >= sth.TreeSize {
+			log.Fatalf("%s is not in the signed issuance log", c.CertFile)
+		}
+		req := &b.Requests[c.Request]
+		stub := req.Stub()
+		key, err := enough.ParsePrivateKeyPEM(readFile(stub + "_key.pem"))
+		if err != nil {
+			log.Fatalf("failed to parse %s_key.pem: %s", stub, err)
+		}
+		if !key.PublicKey.Equal(c.Cert.PublicKey) {
+			log.Fatalf("%s does not match %s_key.pem", c.CertFile, stub)
+		}
+		if _, err := os.Stat(stub + "_cert.pem"); err == nil {
+			log.Fatalf("%s_cert.pem already exists", stub)
+		}
+		var approval *enough.PendingIssuance
+		if req.Approval != nil && len(req.Approval.Approvals) > 0 {
+			approval = req.Approval
+		}
+		// the offline side checked this too, but a park with a policy
+		// doesn't take an unapproved cert on anyone's word
+		if policy != nil && policy.Requires(req.Role) {
+			if approval == nil {
+				log.Fatalf("%s: %s", c.CertFile, enough.ErrApprovalRequired)
+			}
+			r := &approval.Request
+			if r.Role != req.Role || r.Name != req.Name || r.KeySHA256 != req.KeySHA256 {
+				log.Fatalf("%s: approval is for %s %q with another key", c.CertFile, r.Role, r.Name)
+			}
+			if err := policy.Check(r, approval.Approvals); err != nil {
+				log.Fatalf("%s: %s", c.CertFile, err)
+			}
+		}
+		if err := inv.AddApproved(c.Cert, stub+"_cert.pem", b.ID, approval); err != nil {
+			log.Fatalf("%s", err)
+		}
+	}
+
+	for _, c := range res.Certs {
+		stub := b.Requests[c.Request].Stub()
+		pem, _ := (&enough.RawCert{Certificate: *c.Cert}).MarshalCertificate()
+		writeFile(stub+"_cert.pem", pem, 0644)
+	}
+	if err := inv.Save(*inventoryPath); err != nil {
+		log.Fatalf("failed to save %s: %s", *inventoryPath, err)
+	}
+	for _, f := range []string{enough.IssuanceLogFile, enough.TreeHeadFile} {
+		writeFile(f, readFile(filepath.Join(*dir, f)), 0644)
+	}
+	log.Printf("imported %d certs from batch %s into %s", len(res.Certs), b.ID, *inventoryPath)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+func readFile(path string) []byte {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("failed to read %s: %s", path, err)
+	}
+	return data
+}
+
+func readCert(path string) *x509.Certificate {
+	cert, err := loadCert(path)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	return cert
+}
+
+func readCRL(path string) *x509.RevocationList {
+	raw := readFile(path)
+	if block, _ := pem.Decode(raw); block != nil {
+		if block.Type != "X509 CRL" {
+			log.Fatalf("%s: unexpected %s PEM block", path, block.Type)
+		}
+		raw = block.Bytes
+	}
+	list, err := x509.ParseRevocationList(raw)
+	if err != nil {
+		log.Fatalf("failed to parse %s: %s", path, err)
+	}
+	return list
+}
+
+// loadCert is readCert for callers that can carry on without the cert.
+func loadCert(path string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", path, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s: invalid PEM data", path)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", path, err)
+	}
+	return cert, nil
+}
+
+func writeFile(path string, data []byte, mode os.FileMode) {
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		log.Fatalf("failed to open %s for writing: %s", path, err)
+	}
+	if _, err := out.Write(data); err != nil {
+		log.Fatalf("failed to write %s: %s", path, err)
+	}
+	if err := out.Close(); err != nil {
+		log.Fatalf("failed to write %s: %s", path, err)
+	}
+	log.Printf("wrote %s\n", path)
+}
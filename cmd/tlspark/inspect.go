@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/bnagy/enough"
+	"os"
+	"strings"
+)
+
+/**
+ * tlspark inspect: print what enough knows about some certs, from the park
+ * metadata extension rather than the subject.
+ */
+func inspectCmd(args []string) {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s inspect <cert.pem>...\n", os.Args[0])
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	for _, path := range fs.Args() {
+		cert := readCert(path)
+		fmt.Printf("%s:\n", path)
+		fmt.Printf("  subject:     %s\n", cert.Subject)
+		fmt.Printf("  issuer:      %s\n", cert.Issuer)
+		fmt.Printf("  serial:      %x\n", cert.SerialNumber)
+		fmt.Printf("  valid:       %s to %s\n", cert.NotBefore.UTC(), cert.NotAfter.UTC())
+		fmt.Printf("  sha256:      %s\n", enough.Fingerprint(cert))
+		if len(cert.DNSNames) > 0 {
+			fmt.Printf("  dns:         %s\n", strings.Join(cert.DNSNames, ", "))
+		}
+		for _, u := range cert.URIs {
+			fmt.Printf("  uri:         %s\n", u)
+		}
+
+		info, err := enough.ParkInfoFromCert(cert)
+		if err == enough.ErrNoParkInfo {
+			fmt.Printf("  park:        none (issued before park metadata)\n")
+		} else if err != nil {
+			fmt.Printf("  park:        invalid: %s\n", err)
+		} else {
+			fmt.Printf("  park:        %s (%s)\n", info.ParkID, info.Service)
+			fmt.Printf("  role:        %s\n", info.Role)
+			if info.Index >= 0 {
+				fmt.Printf("  index:       %d\n", info.Index)
+			}
+		}
+
+		claims, err := enough.ClaimsFromCert(cert)
+		if err != nil {
+			fmt.Printf("  claims:      invalid: %s\n", err)
+		} else {
+			if len(claims.Roles) > 0 {
+				fmt.Printf("  roles:       %s\n", strings.Join(claims.Roles, ", "))
+			}
+			for k, v := range claims.Attributes {
+				fmt.Printf("  attribute:   %s=%s\n", k, v)
+			}
+		}
+
+		if len(cert.PermittedDNSDomains) > 0 {
+			fmt.Printf("  permit dns:  %s\n", strings.Join(cert.PermittedDNSDomains, ", "))
+		}
+		for _, n := range cert.PermittedIPRanges {
+			fmt.Printf("  permit ip:   %s\n", n)
+		}
+		if len(cert.PermittedURIDomains) > 0 {
+			fmt.Printf("  permit uri:  %s\n", strings.Join(cert.PermittedURIDomains, ", "))
+		}
+	}
+}
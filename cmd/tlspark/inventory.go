@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/bnagy/enough"
+	"log"
+	"sync"
+)
+
+var (
+	inventoryMu sync.Mutex
+	inventory   *enough.Inventory
+)
+
+/**
+ * Records a newly issued member in the park inventory. Called from the
+ * writer goroutines, so it locks; saveInventory writes the file once the
+ * run is done.
+ */
+func recordIssued(ca *enough.CA, c *enough.RawCert, stub string) {
+	inventoryMu.Lock()
+	defer inventoryMu.Unlock()
+	if inventory == nil {
+		inv, err := enough.LoadInventory(enough.InventoryFile, &ca.Raw.Certificate)
+		if err != nil {
+			log.Fatalf("failed to load %s: %s", enough.InventoryFile, err)
+		}
+		inventory = inv
+	}
+	if err := inventory.Add(&c.Certificate, stub+"_cert.pem", ""); err != nil {
+		log.Fatalf("failed to record %s: %s", stub, err)
+	}
+}
+
+func saveInventory() {
+	inventoryMu.Lock()
+	defer inventoryMu.Unlock()
+	if inventory == nil {
+		return
+	}
+	if err := inventory.Save(enough.InventoryFile); err != nil {
+		log.Fatalf("failed to save %s: %s", enough.InventoryFile, err)
+	}
+	log.Printf("recorded %d members in %s\n", len(inventory.Members), enough.InventoryFile)
+}
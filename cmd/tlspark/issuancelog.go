@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/bnagy/enough"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+/**
+ * Opens the park's issuance log in dir and attaches it to ca, so everything
+ * ca issues is logged. A new park starts a new log, refusing to run where
+ * there is one already, and logs its own CA cert first.
+ */
+func attachLog(ca *enough.CA, dir string, newPark bool) {
+	path := filepath.Join(dir, enough.IssuanceLogFile)
+	open := enough.OpenIssuanceLog
+	if newPark {
+		open = enough.CreateIssuanceLog
+	}
+	l, err := open(path)
+	if errors.Is(err, os.ErrExist) {
+		log.Fatalf("%s already exists: is there a park here already?", path)
+	}
+	if err != nil {
+		log.Fatalf("failed to open issuance log: %s", err)
+	}
+	if newPark {
+		if _, err := l.Append(&ca.Raw.Certificate); err != nil {
+			log.Fatalf("failed to log CA cert: %s", err)
+		}
+	}
+	ca.Log = l
+}
+
+/**
+ * Signs a new tree head for the log attached to ca, and closes the log.
+ */
+func finishLog(ca *enough.CA, dir string) {
+	if ca.Log == nil {
+		return
+	}
+	sth, err := ca.SignTreeHead(ca.Log)
+	if err != nil {
+		log.Fatalf("failed to sign tree head: %s", err)
+	}
+	if err := ca.Log.Close(); err != nil {
+		log.Fatalf("failed to close issuance log: %s", err)
+	}
+	ca.Log = nil
+	writeJSON(filepath.Join(dir, enough.TreeHeadFile), sth)
+}
+
+func writeJSON(path string, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Fatalf("failed to marshal %s: %s", path, err)
+	}
+	writeFile(path, append(data, '\n'), 0644)
+}
+
+func readJSON(path string, v interface{}) {
+	if err := json.Unmarshal(readFile(path), v); err != nil {
+		log.Fatalf("failed to parse %s: %s", path, err)
+	}
+}
+
+/**
+ * tlspark log-sth: sign a fresh tree head for the issuance log.
+ */
+func logSTHCmd(args []string) {
+	fs := flag.NewFlagSet("log-sth", flag.ExitOnError)
+	certPath := fs.String("ca-cert", "ca_cert.pem", "Path to the CA cert pem file")
+	keyPath := fs.String("ca-key", "ca_key.pem", "Path to the CA private key pem file")
+	signerPath := fs.String("ca-signer", "", "Unix socket of a 'tlspark signer' holding the CA key, instead of -ca-key")
+	fs.Parse(args)
+
+	ca, err := loadCA(*certPath, *keyPath, *signerPath)
+	if err != nil {
+		log.Fatalf("failed to load CA: %s", err)
+	}
+	checkParkManifest(ca, ".")
+	attachLog(ca, ".", false)
+	log.Printf("issuance log has %d entries", ca.Log.Size())
+	finishLog(ca, ".")
+	signParkManifest(ca, ".")
+}
+
+/**
+ * tlspark log-prove: prove a cert is in the log, or that the log has only
+ * been appended to since an older tree head, at the current tree head.
+ */
+func logProveCmd(args []string) {
+	fs := flag.NewFlagSet("log-prove", flag.ExitOnError)
+	certPath := fs.String("cert", "", "Cert to prove is in the log")
+	oldPath := fs.String("old", "", "Older tree head to prove the current one extends")
+	out := fs.String("out", "", "Proof file to write (required)")
+	fs.Parse(args)
+	if present(*certPath) == present(*oldPath) || !present(*out) {
+		fmt.Fprintf(os.Stderr, "one of -cert or -old is required, and -out\n")
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	l, err := enough.LoadIssuanceLog(enough.IssuanceLogFile)
+	if err != nil {
+		log.Fatalf("failed to load issuance log: %s", err)
+	}
+	var sth enough.SignedTreeHead
+	readJSON(enough.TreeHeadFile, &sth)
+
+	if present(*certPath) {
+		p, err := l.ProveInclusion(readCert(*certPath), &sth)
+		if err != nil {
+			log.Fatalf("failed to prove inclusion: %s", err)
+		}
+		writeJSON(*out, p)
+		return
+	}
+	var old enough.SignedTreeHead
+	readJSON(*oldPath, &old)
+	p, err := l.ProveConsistency(&old, &sth)
+	if err != nil {
+		log.Fatalf("failed to prove consistency: %s", err)
+	}
+	writeJSON(*out, p)
+}
+
+/**
+ * tlspark log-verify: check a proof from log-prove. Only the CA cert is
+ * needed, so any member can run it.
+ */
+func logVerifyCmd(args []string) {
+	fs := flag.NewFlagSet("log-verify", flag.ExitOnError)
+	caPath := fs.String("ca-cert", "ca_cert.pem", "Path to the CA cert pem file")
+	proofPath := fs.String("proof", "", "Proof file from log-prove (required)")
+	certPath := fs.String("cert", "", "The cert an inclusion proof is for; omit for a consistency proof")
+	fs.Parse(args)
+	if !present(*proofPath) {
+		fs.Usage()
+		os.Exit(1)
+	}
+	caCert := readCert(*caPath)
+
+	if present(*certPath) {
+		var p enough.InclusionProof
+		readJSON(*proofPath, &p)
+		if err := p.VerifyInclusion(readCert(*certPath), caCert); err != nil {
+			log.Fatalf("FAILED: %s", err)
+		}
+		fmt.Printf("OK: %s is entry %d of %d in the issuance log (tree head of %s)\n",
+			*certPath, p.LeafIndex, p.TreeHead.TreeSize, p.TreeHead.Timestamp)
+		return
+	}
+	var p enough.ConsistencyProof
+	readJSON(*proofPath, &p)
+	if err := p.Verify(caCert); err != nil {
+		log.Fatalf("FAILED: %s", err)
+	}
+	fmt.Printf("OK: the log at %d entries (%s) extends the log at %d entries (%s)\n",
+		p.New.TreeSize, p.New.Timestamp, p.Old.TreeSize, p.Old.Timestamp)
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
@@ -8,14 +10,30 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 )
 
 var (
 	name         = flag.String("name", "", "A short, shared service name eg 'WidgetCluser' (required)")
 	clients      = flag.Int("clients", 1, "Number of client cert / keys to generate")
+	namesPath    = flag.String("names", "", "File of client names, one per line, to issue instead of numbered clients")
 	clientOffset = flag.Int("client-offset", 0, "Index to start minting new client certs from")
 	caCertPath   = flag.String("ca-cert", "", "Path to the CA cert pem file")
 	caKeyPath    = flag.String("ca-key", "", "Path to the CA private key pem file")
+	caSigner     = flag.String("ca-signer", "", "Unix socket of a 'tlspark signer' holding the CA key, instead of -ca-key")
+	roles        = flag.String("roles", "", "Comma separated roles to embed in the client certs, eg 'ingest,reader'")
+	attrs        = flag.String("attrs", "", "Comma separated key=value attributes to embed in the client certs")
+	permitDNS    = flag.String("permit-dns", "", "Comma separated DNS domains a new CA may issue for, eg 'example.com'")
+	permitIP     = flag.String("permit-ip", "", "Comma separated IP ranges a new CA may issue for, eg '10.0.0.0/8'")
+	permitURI    = flag.String("permit-uri", "", "Comma separated URI domains a new CA may issue for")
+	bundle       = flag.Bool("bundle", false, "Also write a <member>_bundle.tar.gz for each server / client")
+	crlPath      = flag.String("crl", "", "Path to a CRL pem file to include in bundles")
+	signers      = flag.String("signers", "", "Comma separated names to issue code signing certs for, eg 'releases'")
+	stampers     = flag.String("timestampers", "", "Comma separated names to issue timestamping certs for, eg 'tsa'")
 )
 
 func output(c *enough.RawCert, stub string) {
@@ -57,6 +75,41 @@ func output(c *enough.RawCert, stub string) {
 	log.Printf("wrote %s, %s\n", certName, keyName)
 }
 
+/**
+ * Writes a self-contained tar.gz for one member, if -bundle was given. The
+ * archive holds the member's private key, so it gets the same mode as the key.
+ */
+func outputBundle(ca *enough.CA, c *enough.RawCert, stub string) {
+	if !*bundle {
+		return
+	}
+
+	var crl []byte
+	if present(*crlPath) {
+		var err error
+		crl, err = ioutil.ReadFile(*crlPath)
+		if err != nil {
+			log.Fatalf("failed to read crl: %s", err)
+		}
+	}
+
+	b, err := ca.NewBundle(c, crl)
+	if err != nil {
+		log.Fatalf("failed to bundle %s: %s", stub, err)
+	}
+
+	bundleName := stub + "_bundle.tar.gz"
+	out, err := os.OpenFile(bundleName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		log.Fatalf("failed to open %s for writing: %s", bundleName, err)
+	}
+	if err := b.WriteArchive(out); err != nil {
+		log.Fatalf("failed to write %s: %s", bundleName, err)
+	}
+	out.Close()
+	log.Printf("wrote %s\n", bundleName)
+}
+
 /**
  * Helper method which ensures all values are set and returns true if they are.
  */
@@ -69,6 +122,73 @@ func present(values ...string) bool {
 	return true
 }
 
+/**
+ * Reads a CA cert from a pem file, and either its key from a pem file or a
+ * connection to the signing daemon at signerPath, if that is set. If there
+ * is an approval policy next to the CA cert, the CA is bound by it.
+ */
+func loadCA(certPath, keyPath, signerPath string) (ca *enough.CA, e error) {
+	ca, e = loadCAKey(certPath, keyPath, signerPath)
+	if e != nil {
+		return
+	}
+	if ca.Approvals, e = loadApprovals(filepath.Dir(certPath), &ca.Raw.Certificate); e != nil {
+		ca = nil
+	}
+	return
+}
+
+/**
+ * Loads the approval policy of the park in dir, or nil if it has none. Once
+ * a park has had a policy its signed manifest says so, and from then on the
+ * policy has to be there: deleting the file doesn't turn approvals off.
+ */
+func loadApprovals(dir string, caCert *x509.Certificate) (*enough.ApprovalPolicy, error) {
+	policyPath := filepath.Join(dir, enough.ApprovalPolicyFile)
+	p, err := enough.LoadApprovalPolicy(policyPath)
+	if err == nil {
+		return p, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("Failed to load %s: %s", policyPath, err)
+	}
+	m, err := enough.LoadParkManifest(dir, caCert)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to check %s for an approval policy: %s", enough.ParkManifestFile, err)
+	}
+	if m.Approvals {
+		return nil, fmt.Errorf("%w: %s is missing, but %s says this park has one", enough.ErrApprovalRequired, policyPath, enough.ParkManifestFile)
+	}
+	return nil, nil
+}
+
+func loadCAKey(certPath, keyPath, signerPath string) (ca *enough.CA, e error) {
+	pemCert, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		e = fmt.Errorf("Failed to read ca-cert: %s", err)
+		return
+	}
+	if present(signerPath) {
+		signer, err := enough.DialSigner(signerPath)
+		if err != nil {
+			e = fmt.Errorf("Failed to reach ca-signer: %s", err)
+			return
+		}
+		ca, e = enough.NewCAFromCertAndSigner(pemCert, signer)
+		return
+	}
+	pemKey, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		e = fmt.Errorf("Failed to read ca-key: %s", err)
+		return
+	}
+	ca, e = enough.NewCAFromCertAndKey(pemCert, pemKey)
+	return
+}
+
 /**
  * Helper method to ensure the proper combination of flags was provided and attempt to create a CA
  * either by requesting a new one from enough or using provided PEM data to instantiate one.
@@ -77,41 +197,48 @@ func validateFlagsAndReturnCA() (ca *enough.CA, e error) {
 
 	var err error
 
-	if (!present(*name) && !present(*caCertPath) && !present(*caKeyPath)) || present(*name, *caCertPath, *caKeyPath) {
+	// the CA key can come from a file or a signing daemon, but not both
+	caKey := present(*caKeyPath) || present(*caSigner)
+	if present(*caKeyPath, *caSigner) {
+		flag.Usage()
+		e = errors.New("ca-key and ca-signer are mutually exclusive")
+	} else if (!present(*name) && !present(*caCertPath) && !caKey) || (present(*name, *caCertPath) && caKey) {
 		flag.Usage()
 		e = errors.New("name OR ca-cert and ca-key flag required!")
 	} else if present(*name) && len(*name) > 140 {
 		flag.Usage()
 		e = errors.New("Provided name is too long! Must be less than 140 characters.")
-	} else if present(*caCertPath, *caKeyPath) {
+	} else if present(*caCertPath) && caKey {
 		// Attempt to read cert and key files and create a CA struct from them
-		pemCert, err := ioutil.ReadFile(*caCertPath)
-		if err != nil {
-			e = fmt.Errorf("Failed to read ca-cert: %s", err)
-			return
+		ca, e = loadCA(*caCertPath, *caKeyPath, *caSigner)
+		if e == nil {
+			checkParkManifest(ca, ".")
+			attachLog(ca, ".", false)
 		}
-		pemKey, err := ioutil.ReadFile(*caKeyPath)
+
+	} else if present(*name) && !present(*caCertPath) && !caKey {
+		// Create a new CA struct based on a service name
+		var nc *enough.NameConstraints
+		nc, err = enough.ParseNameConstraints(*permitDNS, *permitIP, *permitURI)
 		if err != nil {
-			e = fmt.Errorf("Failed to read ca-key: %s", err)
+			e = fmt.Errorf("Bad name constraints: %s", err)
 			return
 		}
-		ca, e = enough.NewCAFromCertAndKey(pemCert, pemKey)
-
-	} else if present(*name) && !present(*caCertPath) && !present(*caKeyPath) {
-		// Create a new CA struct based on a service name
-		ca, err = enough.NewCA(*name)
+		ca, err = enough.NewCAWithOptions(*name, &enough.CAOptions{Constraints: nc})
 		if err != nil {
 			e = fmt.Errorf("Failed to create CA cert: %s", err)
 			return
 		}
-		output(&ca.Raw, "ca")
-
+		attachLog(ca, ".", true)
 		server, err := ca.CreateServerCert()
 		if err != nil {
 			e = fmt.Errorf("Failed to create cert: %s", err)
 			return
 		}
+		output(&ca.Raw, "ca")
 		output(server, "server")
+		outputBundle(ca, server, "server")
+		recordIssued(ca, server, "server")
 
 	} else {
 		flag.Usage()
@@ -120,22 +247,212 @@ func validateFlagsAndReturnCA() (ca *enough.CA, e error) {
 	return
 }
 
+/**
+ * Subcommands, each with their own flags. With no subcommand, tlspark mints
+ * certs as it always has.
+ */
+var commands = map[string]func(args []string){
+	"approve":         approveCmd,
+	"ceremony-export": ceremonyExportCmd,
+	"ceremony-import": ceremonyImportCmd,
+	"ceremony-sign":   ceremonySignCmd,
+	"inspect":         inspectCmd,
+	"issue":           issueCmd,
+	"keygen":          keygenCmd,
+	"log-prove":       logProveCmd,
+	"log-sth":         logSTHCmd,
+	"log-verify":      logVerifyCmd,
+	"seal":            sealCmd,
+	"seal-file":       sealFileCmd,
+	"sign-park":       signParkCmd,
+	"signer":          signerCmd,
+	"open":            openCmd,
+	"open-file":       openFileCmd,
+	"recover-key":     recoverKeyCmd,
+	"request":         requestCmd,
+	"spiffe-bundle":   spiffeBundleCmd,
+	"split-key":       splitKeyCmd,
+	"tsa":             tsaCmd,
+	"verify-park":     verifyParkCmd,
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nSubcommands (see %s <command> -h):\n", os.Args[0])
+	for _, name := range commandNames() {
+		fmt.Fprintf(os.Stderr, "  %s\n", name)
+	}
+}
+
+func commandNames() []string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/**
+ * Builds the claims for -roles and -attrs, or nil if neither was given.
+ */
+func parseClaims(roleList, attrList string) (*enough.Claims, error) {
+	if !present(roleList) && !present(attrList) {
+		return nil, nil
+	}
+	claims := &enough.Claims{Attributes: make(map[string]string)}
+	for _, r := range strings.Split(roleList, ",") {
+		if r = strings.TrimSpace(r); len(r) > 0 {
+			claims.Roles = append(claims.Roles, r)
+		}
+	}
+	for _, kv := range strings.Split(attrList, ",") {
+		if kv = strings.TrimSpace(kv); len(kv) == 0 {
+			continue
+		}
+		i := strings.Index(kv, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("attribute %q is not key=value", kv)
+		}
+		claims.Attributes[kv[:i]] = kv[i+1:]
+	}
+	return claims, claims.Validate()
+}
+
+func flagSet(name string) (set bool) {
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return
+}
+
 func main() {
 	var ca *enough.CA
+
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			cmd(os.Args[2:])
+			return
+		}
+	}
+
+	flag.Usage = usage
 	flag.Parse()
 
-	ca, err := validateFlagsAndReturnCA()
+	// Numbered clients are named ClientN but written as clientN, as they
+	// always have been. Named clients, code signers and timestampers use
+	// their name for both.
+	type job struct {
+		name, stub string
+		index      int
+		role       string
+	}
+	jobs := []job{}
+
+	if present(*namesPath) {
+		names, err := readNamesFile(*namesPath)
+		if err != nil {
+			log.Fatalf("bad names file: %s", err)
+		}
+		for _, n := range names {
+			jobs = append(jobs, job{n, n, -1, enough.RoleClient})
+		}
+	}
+	for _, f := range []struct{ flag, role string }{{"signers", enough.RoleCodeSigning}, {"timestampers", enough.RoleTimestamping}} {
+		for _, n := range strings.Split(flag.Lookup(f.flag).Value.String(), ",") {
+			if n = strings.TrimSpace(n); len(n) == 0 {
+				continue
+			}
+			if err := enough.ValidateMemberName(n); err != nil {
+				log.Fatalf("bad -%s: %s", f.flag, err)
+			}
+			jobs = append(jobs, job{n, n, -1, f.role})
+		}
+	}
+	if (!present(*namesPath) && !present(*signers) && !present(*stampers)) || flagSet("clients") {
+		for i := *clientOffset; i < (*clientOffset + *clients); i++ {
+			jobs = append(jobs, job{fmt.Sprintf("Client%d", i), fmt.Sprintf("client%d", i), i, enough.RoleClient})
+		}
+	}
+	inRun := make(map[string]bool)
+	for _, j := range jobs {
+		if inRun[strings.ToLower(j.stub)] {
+			log.Fatalf("%s is requested more than once", j.name)
+		}
+		inRun[strings.ToLower(j.stub)] = true
+	}
+
+	claims, err := parseClaims(*roles, *attrs)
+	if err != nil {
+		log.Fatalf("\nBad configuration flags: %s", err)
+	}
+
+	ca, err = validateFlagsAndReturnCA()
 	if err != nil {
 		log.Fatalf("\nBad configuration flags: %s", err)
 		return
 	}
 
-	for i := *clientOffset; i < (*clientOffset + *clients); i++ {
-		c, err := ca.CreateClientCert(i)
+	existing, err := existingNames(".", ca)
+	if err != nil {
+		log.Fatalf("unable to list existing certs: %s", err)
+	}
+	for _, j := range jobs {
+		if path, ok := existing[strings.ToLower(j.stub)]; ok {
+			log.Fatalf("%s is already issued in this park (%s)", j.name, path)
+		}
+	}
+
+	numbered := 0
+	for _, j := range jobs {
+		if j.index >= 0 {
+			numbered++
+			continue
+		}
+		var c *enough.RawCert
+		switch j.role {
+		case enough.RoleCodeSigning:
+			c, err = ca.CreateCodeSigningCert(j.name)
+		case enough.RoleTimestamping:
+			c, err = ca.CreateTimestampingCert(j.name)
+		default:
+			c, err = ca.CreateClientCertWithClaims(j.name, claims)
+		}
 		if err != nil {
-			log.Fatalf("unable to create cilent cert %d: %s", i, err)
+			log.Fatalf("unable to create %s cert %s: %s", j.role, j.name, err)
+		}
+		output(c, j.stub)
+		outputBundle(ca, c, j.stub)
+		recordIssued(ca, c, j.stub)
+	}
+
+	// Numbered clients can run to the tens of thousands, so they're issued
+	// by a worker pool and written out by another.
+	if numbered > 0 {
+		results := ca.CreateClientCertsWithClaims(context.Background(), *clientOffset, *clients, claims)
+		var wg sync.WaitGroup
+		for w := 0; w < runtime.GOMAXPROCS(0); w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for r := range results {
+					if r.Err != nil {
+						log.Fatalf("unable to create client cert %d: %s", r.Index, r.Err)
+					}
+					stub := fmt.Sprintf("client%d", r.Index)
+					output(r.Cert, stub)
+					outputBundle(ca, r.Cert, stub)
+					recordIssued(ca, r.Cert, stub)
+				}
+			}()
 		}
-		output(c, fmt.Sprintf("client%d", i))
+		wg.Wait()
 	}
 
+	finishLog(ca, ".")
+	saveInventory()
+	signParkManifest(ca, ".")
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/bnagy/enough"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+/**
+ * Reads client names, one per line. Blank lines and # comments are ignored.
+ * Every name is validated, and duplicates within the file are an error.
+ */
+func readNamesFile(path string) (names []string, e error) {
+	seen := make(map[string]int)
+	scanner := bufio.NewScanner(bytes.NewReader(readFile(path)))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		name := strings.TrimSpace(line)
+		if len(name) == 0 {
+			continue
+		}
+		if e = enough.ValidateMemberName(name); e != nil {
+			e = fmt.Errorf("%s:%d: %s", path, lineNo, e)
+			return
+		}
+		if prev, ok := seen[strings.ToLower(name)]; ok {
+			e = fmt.Errorf("%s:%d: %q duplicates line %d", path, lineNo, name, prev)
+			return
+		}
+		seen[strings.ToLower(name)] = lineNo
+		names = append(names, name)
+	}
+	e = scanner.Err()
+	return
+}
+
+/**
+ * Returns the identities already issued by ca in the park directory, keyed
+ * by lowercased name, from the CNs and file stubs of every *_cert.pem.
+ * Comparisons are case insensitive because so are some filesystems. A file
+ * that can't be read as a cert is reported, and still claims its stub, so
+ * nothing is issued over it.
+ */
+func existingNames(dir string, ca *enough.CA) (map[string]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*_cert.pem"))
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]string)
+	for _, path := range paths {
+		stub := strings.TrimSuffix(filepath.Base(path), "_cert.pem")
+		cert, err := loadCert(path)
+		if err != nil {
+			log.Printf("skipping %s", err)
+			names[strings.ToLower(stub)] = path
+			continue
+		}
+		if cert.IsCA || cert.CheckSignatureFrom(&ca.Raw.Certificate) != nil {
+			continue
+		}
+		names[strings.ToLower(stub)] = path
+		names[strings.ToLower(cert.Subject.CommonName)] = path
+	}
+	return names, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/bnagy/enough"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/**
+ * Checks the park in dir still matches the manifest the CA last signed.
+ * Every run that changes the park calls this before it starts, since the
+ * manifest is re-signed at the end and would otherwise take in whatever had
+ * been changed behind the CA's back. A park with no manifest yet passes.
+ */
+func checkParkManifest(ca *enough.CA, dir string) {
+	r, err := enough.VerifyPark(dir, &ca.Raw.Certificate)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("%s doesn't verify: %s; check it, then accept the park as it is with sign-park", enough.ParkManifestFile, err)
+	}
+	if !r.OK() {
+		printParkReport(r)
+		log.Fatalf("%s has changed since its manifest was signed; check the changes, then accept them with sign-park", dir)
+	}
+}
+
+/**
+ * Re-signs the manifest of public artifacts in dir. Called at the end of
+ * every run that changes the park, which must have called checkParkManifest
+ * before changing anything.
+ */
+func signParkManifest(ca *enough.CA, dir string) {
+	m, err := ca.NewParkManifest(dir)
+	if err != nil {
+		log.Fatalf("failed to make park manifest: %s", err)
+	}
+	writeJSON(filepath.Join(dir, enough.ParkManifestFile), m)
+}
+
+func printParkReport(r *enough.ParkReport) {
+	report := func(what string, names []string) {
+		for _, n := range names {
+			fmt.Printf("%-9s %s\n", what, n)
+		}
+	}
+	report("missing", r.Missing)
+	report("modified", r.Modified)
+	report("extra", r.Extra)
+	report("foreign", r.Foreign)
+}
+
+/**
+ * tlspark sign-park: sign a fresh park manifest, eg after adding a CRL.
+ * Lists what has changed since the last one and asks before taking it in.
+ */
+func signParkCmd(args []string) {
+	fs := flag.NewFlagSet("sign-park", flag.ExitOnError)
+	dir := fs.String("dir", ".", "Park directory")
+	certPath := fs.String("ca-cert", "ca_cert.pem", "Path to the CA cert pem file")
+	keyPath := fs.String("ca-key", "ca_key.pem", "Path to the CA private key pem file")
+	signerPath := fs.String("ca-signer", "", "Unix socket of a 'tlspark signer' holding the CA key, instead of -ca-key")
+	yes := fs.Bool("yes", false, "Sign without asking for confirmation")
+	fs.Parse(args)
+
+	ca, err := loadCA(*certPath, *keyPath, *signerPath)
+	if err != nil {
+		log.Fatalf("failed to load CA: %s", err)
+	}
+	r, err := enough.VerifyPark(*dir, &ca.Raw.Certificate)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		fmt.Printf("%s has no manifest yet\n", *dir)
+	case err != nil:
+		fmt.Printf("the current %s doesn't verify: %s\n", enough.ParkManifestFile, err)
+	case r.OK():
+		fmt.Printf("no changes since the last manifest\n")
+	default:
+		printParkReport(r)
+	}
+	if !*yes && (err != nil || !r.OK()) {
+		fmt.Printf("sign the park as it is now? [y/N] ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+			log.Fatalf("not signed")
+		}
+	}
+	signParkManifest(ca, *dir)
+}
+
+/**
+ * tlspark verify-park: check a park directory against its signed manifest.
+ * Exits 1 if anything is missing, modified, extra or foreign.
+ */
+func verifyParkCmd(args []string) {
+	fs := flag.NewFlagSet("verify-park", flag.ExitOnError)
+	dir := fs.String("dir", ".", "Park directory")
+	certPath := fs.String("ca-cert", "", "CA cert to verify against (default the park's own ca_cert.pem)")
+	pin := fs.String("ca-fingerprint", "", "Expected SHA-256 fingerprint of the CA cert")
+	fs.Parse(args)
+	if !present(*certPath) {
+		*certPath = filepath.Join(*dir, "ca_cert.pem")
+	}
+
+	caCert := readCert(*certPath)
+	fp := enough.Fingerprint(caCert)
+	if present(*pin) && !strings.EqualFold(strings.ReplaceAll(*pin, ":", ""), fp) {
+		log.Fatalf("FAILED: %s has fingerprint %s, not %s", *certPath, fp, *pin)
+	}
+	r, err := enough.VerifyPark(*dir, caCert)
+	if err != nil {
+		log.Fatalf("FAILED: %s", err)
+	}
+
+	printParkReport(r)
+	if !r.OK() {
+		os.Exit(1)
+	}
+	fmt.Printf("OK: %s matches its manifest, signed by CA %s\n", *dir, fp)
+}
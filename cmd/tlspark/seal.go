@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/x509"
+	"flag"
+	"github.com/bnagy/enough"
+	"log"
+	"os"
+	"strings"
+)
+
+/**
+ * tlspark keygen: run on the receiving host. Makes a recipient key pair; the
+ * public half is sent to whoever runs the park, the private half never leaves
+ * the host.
+ */
+func keygenCmd(args []string) {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	out := fs.String("out", "recipient", "Stub for the <out>_key.pem and <out>_pub.pem files")
+	fs.Parse(args)
+
+	key, err := enough.GenerateRecipientKey()
+	if err != nil {
+		log.Fatalf("failed to generate key: %s", err)
+	}
+
+	keyPem, err := (&enough.RawCert{PrivateKey: key}).MarshalPrivateKey()
+	if err != nil {
+		log.Fatalf("failed to marshal key: %s", err)
+	}
+	pubPem, err := enough.MarshalPublicKey(&key.PublicKey)
+	if err != nil {
+		log.Fatalf("failed to marshal public key: %s", err)
+	}
+
+	writeFile(*out+"_key.pem", keyPem, 0600)
+	writeFile(*out+"_pub.pem", pubPem, 0644)
+}
+
+/**
+ * tlspark seal: encrypt a member bundle to a recipient public key, signed by
+ * the CA key.
+ */
+func sealCmd(args []string) {
+	fs := flag.NewFlagSet("seal", flag.ExitOnError)
+	in := fs.String("bundle", "", "Bundle archive to seal, from tlspark -bundle (required)")
+	to := fs.String("to", "", "Recipient public key pem, from tlspark keygen (required)")
+	certPath := fs.String("ca-cert", "ca_cert.pem", "Path to the CA cert pem file")
+	keyPath := fs.String("ca-key", "ca_key.pem", "Path to the CA private key pem file")
+	signerPath := fs.String("ca-signer", "", "Unix socket of a 'tlspark signer' holding the CA key, instead of -ca-key")
+	out := fs.String("out", "", "Output file (default <bundle>.sealed)")
+	fs.Parse(args)
+	if !present(*in, *to) {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	ca, err := loadCA(*certPath, *keyPath, *signerPath)
+	if err != nil {
+		log.Fatalf("failed to load CA: %s", err)
+	}
+	archive := readFile(*in)
+	pub, err := enough.ParsePublicKeyPEM(readFile(*to))
+	if err != nil {
+		log.Fatalf("failed to parse %s: %s", *to, err)
+	}
+
+	sealed, err := ca.SealBundle(archive, pub)
+	if err != nil {
+		log.Fatalf("failed to seal %s: %s", *in, err)
+	}
+	if !present(*out) {
+		*out = strings.TrimSuffix(*in, ".tar.gz") + ".sealed"
+	}
+	writeFile(*out, sealed, 0644)
+}
+
+/**
+ * tlspark open: run on the receiving host to check and decrypt a sealed
+ * bundle.
+ */
+func openCmd(args []string) {
+	fs := flag.NewFlagSet("open", flag.ExitOnError)
+	in := fs.String("in", "", "Sealed bundle (required)")
+	keyPath := fs.String("key", "recipient_key.pem", "Recipient private key pem file")
+	certPath := fs.String("ca-cert", "", "The park CA cert, obtained out of band (required)")
+	out := fs.String("out", "", "Output bundle archive (default <in>.tar.gz)")
+	fs.Parse(args)
+	if !present(*in, *certPath) {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	key, err := enough.ParsePrivateKeyPEM(readFile(*keyPath))
+	if err != nil {
+		log.Fatalf("failed to parse %s: %s", *keyPath, err)
+	}
+	caCert := readCert(*certPath)
+
+	archive, err := enough.OpenSealedBundle(readFile(*in), key, caCert)
+	if err != nil {
+		log.Fatalf("failed to open %s: %s", *in, err)
+	}
+	log.Printf("bundle signed by %s (sha256 %s)", caCert.Subject.CommonName, enough.Fingerprint(caCert))
+
+	if !present(*out) {
+		*out = strings.TrimSuffix(*in, ".sealed") + ".tar.gz"
+	}
+	writeFile(*out, archive, 0600)
+}
+
+/**
+ * tlspark seal-file: encrypt any file to a park member's cert, optionally
+ * signed by the sender's own member key so the member can tell who sent it.
+ */
+func sealFileCmd(args []string) {
+	fs := flag.NewFlagSet("seal-file", flag.ExitOnError)
+	in := fs.String("in", "", "File to seal (required)")
+	to := fs.String("to", "", "Recipient member cert pem, eg client0_cert.pem (required)")
+	from := fs.String("from", "", "Sender member cert pem, to sign the sealed file")
+	fromKey := fs.String("from-key", "", "Sender private key pem file, required with -from")
+	out := fs.String("out", "", "Output file (default <in>.sealed)")
+	fs.Parse(args)
+	if !present(*in, *to) || present(*from) != present(*fromKey) {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	var sender *enough.RawCert
+	if present(*from) {
+		key, err := enough.ParsePrivateKeyPEM(readFile(*fromKey))
+		if err != nil {
+			log.Fatalf("failed to parse %s: %s", *fromKey, err)
+		}
+		sender = &enough.RawCert{PrivateKey: key, Certificate: *readCert(*from)}
+	}
+	sealed, err := enough.SealFile(readFile(*in), readCert(*to), sender)
+	if err != nil {
+		log.Fatalf("failed to seal %s: %s", *in, err)
+	}
+	if !present(*out) {
+		*out = *in + ".sealed"
+	}
+	writeFile(*out, sealed, 0644)
+}
+
+/**
+ * tlspark open-file: run on the member to decrypt a sealed file with its
+ * own key. A signed file's sender is checked against the park CA.
+ */
+func openFileCmd(args []string) {
+	fs := flag.NewFlagSet("open-file", flag.ExitOnError)
+	in := fs.String("in", "", "Sealed file (required)")
+	keyPath := fs.String("key", "", "Recipient member private key pem, eg client0_key.pem (required)")
+	certPath := fs.String("ca-cert", "", "The park CA cert, to check who signed the file")
+	crlPath := fs.String("crl", "", "CRL (PEM or DER) from the park CA, to check the sender isn't revoked, requires -ca-cert")
+	from := fs.String("from", "", "Only accept a file signed by this member, by cert common name, eg Client1")
+	out := fs.String("out", "", "Output file (default <in> without .sealed)")
+	fs.Parse(args)
+	if !present(*in, *keyPath) || ((present(*from) || present(*crlPath)) && !present(*certPath)) {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	key, err := enough.ParsePrivateKeyPEM(readFile(*keyPath))
+	if err != nil {
+		log.Fatalf("failed to parse %s: %s", *keyPath, err)
+	}
+	var caCert *x509.Certificate
+	if present(*certPath) {
+		caCert = readCert(*certPath)
+	}
+
+	var crl *x509.RevocationList
+	if present(*crlPath) {
+		crl = readCRL(*crlPath)
+	}
+
+	data, sender, err := enough.OpenSealedFile(readFile(*in), key, caCert, crl)
+	if err != nil {
+		log.Fatalf("failed to open %s: %s", *in, err)
+	}
+	switch {
+	case sender != nil && present(*from) && sender.Subject.CommonName != *from:
+		log.Fatalf("%s was sent by %s, not %s", *in, sender.Subject.CommonName, *from)
+	case sender != nil:
+		log.Printf("file sent by %s (sha256 %s)", sender.Subject.CommonName, enough.Fingerprint(sender))
+	case present(*from):
+		log.Fatalf("%s is not signed, can't tell who sent it", *in)
+	default:
+		log.Printf("WARNING: %s is not signed, anyone could have sent it", *in)
+	}
+
+	if !present(*out) {
+		if !strings.HasSuffix(*in, ".sealed") {
+			log.Fatalf("can't guess an output name for %s, give -out", *in)
+		}
+		*out = strings.TrimSuffix(*in, ".sealed")
+	}
+	writeFile(*out, data, 0600)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/bnagy/enough"
+	"log"
+	"os"
+)
+
+/**
+ * tlspark split-key: split the CA key into shares, any threshold of which
+ * can rebuild it. Hand each share to a different person, then delete the key.
+ */
+func splitKeyCmd(args []string) {
+	fs := flag.NewFlagSet("split-key", flag.ExitOnError)
+	certPath := fs.String("ca-cert", "ca_cert.pem", "Path to the CA cert pem file")
+	keyPath := fs.String("ca-key", "ca_key.pem", "Path to the CA private key pem file")
+	shares := fs.Int("shares", 5, "Number of shares to write")
+	threshold := fs.Int("threshold", 3, "Number of shares needed to recover the key")
+	out := fs.String("out", "ca_key_share", "Stub for the <out>_N.pem share files")
+	fs.Parse(args)
+
+	ca, err := loadCA(*certPath, *keyPath, "")
+	if err != nil {
+		log.Fatalf("failed to load CA: %s", err)
+	}
+	parts, err := ca.SplitKey(*shares, *threshold)
+	if err != nil {
+		log.Fatalf("failed to split key: %s", err)
+	}
+	for _, ks := range parts {
+		writeFile(fmt.Sprintf("%s_%d.pem", *out, ks.Index()), ks.Marshal(), 0600)
+	}
+	log.Printf("any %d of these %d shares recover %s; it is safe to delete it once they are distributed", *threshold, *shares, *keyPath)
+}
+
+/**
+ * tlspark recover-key: rebuild the CA key from shares, and check it against
+ * the CA cert before writing it.
+ */
+func recoverKeyCmd(args []string) {
+	fs := flag.NewFlagSet("recover-key", flag.ExitOnError)
+	certPath := fs.String("ca-cert", "ca_cert.pem", "Path to the CA cert pem file")
+	out := fs.String("out", "ca_key.pem", "Where to write the recovered key")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s recover-key [flags] share.pem...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	shares := []*enough.KeyShare{}
+	for _, path := range fs.Args() {
+		ks, err := enough.ParseKeyShare(readFile(path))
+		if err != nil {
+			log.Fatalf("failed to parse %s: %s", path, err)
+		}
+		shares = append(shares, ks)
+	}
+
+	ca, err := enough.RecoverCA(readFile(*certPath), shares)
+	if err != nil {
+		log.Fatalf("failed to recover CA key: %s", err)
+	}
+	if _, err := os.Stat(*out); err == nil {
+		log.Fatalf("%s already exists, not overwriting it", *out)
+	}
+	pem, err := ca.Raw.MarshalPrivateKey()
+	if err != nil {
+		log.Fatalf("failed to marshal key: %s", err)
+	}
+	writeFile(*out, pem, 0600)
+	log.Printf("recovered the key for %s (park %s)", ca.Raw.Certificate.Subject.CommonName, ca.ParkID)
+}
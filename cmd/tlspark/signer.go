@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"github.com/bnagy/enough"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+/**
+ * tlspark signer: hold the CA key in this process only, and sign for other
+ * tlspark runs (-ca-signer) over a Unix socket. Run it as its own user, so
+ * only that user needs to be able to read ca_key.pem, sharing a group (-group)
+ * with whoever runs tlspark. The socket goes in a directory owned by the
+ * signer user and mode 0750 (eg /run/park, owned by signer:park), which is
+ * checked, so nobody outside the group can reach the socket even for the
+ * moment before it's restricted, and nobody but the signer can swap it out.
+ * The socket is then made mode 0660 and given to the group.
+ *
+ * Anything that can connect to the socket can get any digest signed with the
+ * CA key, ie issue any cert it likes. The signer logs every signature, but
+ * that's all: the group is as trusted as the key.
+ */
+func signerCmd(args []string) {
+	fs := flag.NewFlagSet("signer", flag.ExitOnError)
+	keyPath := fs.String("ca-key", "ca_key.pem", "Path to the CA private key pem file")
+	socket := fs.String("socket", "", "Path of the Unix socket to listen on (required), in a directory no one else can write to or other users can enter")
+	group := fs.String("group", "", "Group allowed to connect to the socket (default the signer's own group)")
+	fs.Parse(args)
+	if !present(*socket) {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	key, err := enough.ParsePrivateKeyPEM(readFile(*keyPath))
+	if err != nil {
+		log.Fatalf("failed to parse %s: %s", *keyPath, err)
+	}
+
+	gid := -1
+	if present(*group) {
+		g, err := user.LookupGroup(*group)
+		if err != nil {
+			log.Fatalf("unknown group %s: %s", *group, err)
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			log.Fatalf("bad gid for %s: %s", *group, err)
+		}
+	}
+
+	// The socket is created with whatever the umask allows, so it's the
+	// directory that keeps other users out until it's restricted.
+	dir := filepath.Dir(*socket)
+	fi, err := os.Stat(dir)
+	if err != nil {
+		log.Fatalf("failed to check %s: %s", dir, err)
+	}
+	if fi.Mode().Perm()&0027 != 0 {
+		log.Fatalf("%s is mode %o: it must not be writable by the group or open to other users, eg 0750", dir, fi.Mode().Perm())
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() {
+		log.Fatalf("%s must be owned by the user running the signer", dir)
+	}
+
+	l, err := net.Listen("unix", *socket)
+	if err != nil {
+		log.Fatalf("failed to listen on %s: %s", *socket, err)
+	}
+	if err := os.Chown(*socket, -1, gid); err != nil {
+		l.Close()
+		log.Fatalf("failed to give %s to group %s: %s", *socket, *group, err)
+	}
+	if err := os.Chmod(*socket, 0660); err != nil {
+		l.Close()
+		log.Fatalf("failed to restrict %s: %s", *socket, err)
+	}
+
+	// clean up the socket on the way out
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		l.Close()
+	}()
+
+	log.Printf("signing for %s on %s", *keyPath, *socket)
+	if err := enough.ServeSigner(l, key, log.Default()); err != nil {
+		log.Printf("signer stopped: %s", err)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"flag"
+	"github.com/bnagy/enough"
+	"log"
+)
+
+/**
+ * tlspark spiffe-bundle: export the park CA as a SPIFFE trust bundle (JWKS)
+ * for SPIFFE-aware proxies and tools.
+ */
+func spiffeBundleCmd(args []string) {
+	fs := flag.NewFlagSet("spiffe-bundle", flag.ExitOnError)
+	certPath := fs.String("ca-cert", "ca_cert.pem", "Path to the CA cert pem file")
+	out := fs.String("out", "spiffe_bundle.json", "Output file")
+	fs.Parse(args)
+
+	bundle, err := enough.SPIFFEBundle(readCert(*certPath))
+	if err != nil {
+		log.Fatalf("failed to create bundle: %s", err)
+	}
+	writeFile(*out, append(bundle, '\n'), 0644)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"github.com/bnagy/enough"
+	"log"
+	"net/http"
+	"time"
+)
+
+/**
+ * tlspark tsa: run an RFC 3161 timestamp authority over HTTP, signing with a
+ * timestamping cert issued by -timestampers. sign_ecdsa -tsa asks it to
+ * timestamp signatures, so they can still be checked after the signer's
+ * cert expires or is revoked. It has no access control of its own, so
+ * listen somewhere only your build hosts can reach.
+ */
+func tsaCmd(args []string) {
+	fs := flag.NewFlagSet("tsa", flag.ExitOnError)
+	certPath := fs.String("cert", "tsa_cert.pem", "Path to the timestamping cert")
+	keyPath := fs.String("key", "tsa_key.pem", "Path to the timestamping key")
+	listen := fs.String("listen", "127.0.0.1:3161", "Address to serve timestamp requests on")
+	fs.Parse(args)
+
+	key, err := enough.ParsePrivateKeyPEM(readFile(*keyPath))
+	if err != nil {
+		log.Fatalf("failed to parse %s: %s", *keyPath, err)
+	}
+	tsa, err := enough.NewTimestampAuthority(readCert(*certPath), key)
+	if err != nil {
+		log.Fatalf("can't timestamp with %s: %s", *certPath, err)
+	}
+
+	srv := &http.Server{
+		Addr:         *listen,
+		Handler:      tsa,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	log.Printf("timestamping as %s on http://%s/", tsa.Cert.Subject.CommonName, *listen)
+	log.Fatal(srv.ListenAndServe())
+}
@@ -1,107 +1,279 @@
 package main
 
 import (
-	"crypto"
 	"crypto/ecdsa"
 	"crypto/x509"
-	"encoding/asn1"
 	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
+	"github.com/bnagy/enough"
+	"github.com/bnagy/enough/sign"
 	"io/ioutil"
 	"log"
-	"math/big"
 	"os"
+	"path/filepath"
+	"time"
 )
 
 var (
-	cert = flag.String("cert", "", "Certificate file ( in PEM format ) containing the public key")
-	sig  = flag.String("sig", "", "Signature file ( in raw DER ) to check")
-	file = flag.String("file", "", "File being verified")
+	cert     = flag.String("cert", "", "Certificate file ( in PEM format ) containing the public key, optionally followed by intermediates, or a bare PUBLIC KEY PEM. Needed for bare signatures, optional for an ENOUGH SIGNATURE, which must then match it")
+	sig      = flag.String("sig", "", "Signature file ( ENOUGH SIGNATURE PEM, or a bare signature ) to check")
+	file     = flag.String("file", "", "File being verified, - for stdin")
+	ca       = flag.String("ca", "", "Park CA cert ( in PEM format ) the signer must chain to")
+	crl      = flag.String("crl", "", "CRL ( PEM or DER ) from the signer's issuer, requires -ca")
+	format   = flag.String("format", enough.SigFormatAuto, "Bare signature encoding: auto, der, p1363, base64 or hex")
+	hashName = flag.String("hash", "", "Digest of a bare signature: sha256, sha384 or sha512. Default is guessed from the cert, or sha256 for a bare public key")
+	dir      = flag.String("dir", "", "Release directory to check against its signed "+enough.ReleaseManifestFile+", instead of -sig and -file")
+	stamp    = flag.String("timestamp", "", "RFC 3161 timestamp reply over the signature ( eg from sign_ecdsa -tsa ). The signer is then checked as of the stamped time, not now. Requires -ca")
+	bareKey  = flag.Bool("trust-bare-key", false, "Accept a bare signature from a bare PUBLIC KEY in -cert, which can't be checked against -ca or for code signing")
 )
 
-type ecdsaSig struct {
-	R *big.Int
-	S *big.Int
+// Exit codes, one per way verification can fail, so scripts can tell a bad
+// signature from a bad signer.
+const (
+	exitUsage     = 1 // bad arguments or unreadable input
+	exitSignature = 2 // signature doesn't match the file and key
+	exitUntrusted = 3 // signer doesn't chain to -ca
+	exitExpired   = 4 // signer (or its chain) outside its validity window
+	exitPurpose   = 5 // signer isn't allowed to sign code
+	exitRevoked   = 6 // signer is on the CRL
+	exitCRL       = 7 // CRL can't be trusted or is out of date
+	exitTimestamp = 8 // timestamp doesn't cover the signature, or its TSA isn't trusted
+)
+
+func fail(code int, format string, v ...interface{}) {
+	log.Printf("[!!] "+format, v...)
+	os.Exit(code)
 }
 
-func main() {
+func readCerts(path string) (certs []*x509.Certificate) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("failed to read cert from %s: %s", path, err)
+	}
+	for {
+		var block *pem.Block
+		block, raw = pem.Decode(raw)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			log.Fatalf("%s: unexpected %s PEM block", path, block.Type)
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			log.Fatalf("failed to parse certificate: %s\n", err)
+		}
+		certs = append(certs, c)
+	}
+	if len(raw) != 0 || len(certs) == 0 {
+		log.Fatalf("%s: invalid PEM data", path)
+	}
+	return
+}
 
-	flag.Parse()
-	if len(*sig) == 0 || len(*cert) == 0 || len(*file) == 0 {
-		flag.Usage()
-		os.Exit(1)
+// readSigner reads -cert, which is either certs, signer first, or a bare
+// public key, in which case certs is nil.
+func readSigner(path string) (certs []*x509.Certificate, pub *ecdsa.PublicKey) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("failed to read cert from %s: %s", path, err)
+	}
+	if block, _ := pem.Decode(raw); block != nil && block.Type == "PUBLIC KEY" {
+		if pub, err = enough.ParsePublicKeyPEM(raw); err != nil {
+			log.Fatalf("failed to parse public key: %s\n", err)
+		}
+		return nil, pub
+	}
+	certs = readCerts(path)
+	pub, ok := certs[0].PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		log.Fatalf("certificate key is not ECDSA")
 	}
+	return certs, pub
+}
 
-	raw, err := ioutil.ReadFile(*cert)
+func readCRL(path string) *x509.RevocationList {
+	raw, err := ioutil.ReadFile(path)
 	if err != nil {
-		log.Fatalf("failed to read cert from %s: %s", *cert, err)
+		log.Fatalf("failed to read CRL from %s: %s", path, err)
 	}
-	certPEM, rest := pem.Decode(raw)
-	if len(rest) != 0 || certPEM == nil {
-		log.Fatalf("%s: invalid PEM data", *cert)
+	if block, _ := pem.Decode(raw); block != nil {
+		if block.Type != "X509 CRL" {
+			log.Fatalf("%s: unexpected %s PEM block", path, block.Type)
+		}
+		raw = block.Bytes
 	}
-	cert, err := x509.ParseCertificate(certPEM.Bytes)
+	list, err := x509.ParseRevocationList(raw)
 	if err != nil {
-		log.Fatalf("failed to parse certificate: %s\n", err)
+		log.Fatalf("failed to parse CRL: %s\n", err)
+	}
+	return list
+}
+
+// readCA reads the -ca cert.
+func readCA() *x509.Certificate {
+	roots := readCerts(*ca)
+	if len(roots) != 1 || !roots[0].IsCA {
+		log.Fatalf("%s: expected exactly one CA cert", *ca)
+	}
+	return roots[0]
+}
+
+// exitCode maps a sign error to the exit code scripts check for.
+func exitCode(err error) int {
+	for _, c := range []struct {
+		err  error
+		code int
+	}{
+		{sign.ErrSignature, exitSignature},
+		{sign.ErrUntrusted, exitUntrusted},
+		{sign.ErrExpired, exitExpired},
+		{sign.ErrPurpose, exitPurpose},
+		{sign.ErrRevoked, exitRevoked},
+		{sign.ErrCRL, exitCRL},
+		{sign.ErrTimestamp, exitTimestamp},
+	} {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+	return exitUsage
+}
+
+// options reads the files named by -cert, -ca, -crl and -timestamp.
+// signerCert is nil if -cert wasn't given, or is a bare public key.
+func options() (signerCert *x509.Certificate, opts *sign.VerifyOptions) {
+	opts = &sign.VerifyOptions{Format: *format, TrustBareKey: *bareKey}
+	if len(*hashName) != 0 {
+		h, err := enough.ParseHash(*hashName)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		opts.Hash = h
+	}
+	if len(*cert) != 0 {
+		certs, pub := readSigner(*cert)
+		if certs == nil {
+			opts.PublicKey = pub
+		} else {
+			signerCert, opts.Intermediates = certs[0], certs[1:]
+		}
+	}
+	if len(*ca) != 0 {
+		opts.Root = readCA()
+	}
+	if len(*crl) != 0 {
+		opts.CRL = readCRL(*crl)
 	}
+	if len(*stamp) != 0 {
+		raw, err := ioutil.ReadFile(*stamp)
+		if err != nil {
+			log.Fatalf("failed to read timestamp from %s: %s", *stamp, err)
+		}
+		opts.Timestamp = raw
+	}
+	return
+}
 
-	raw, err = ioutil.ReadFile(*sig)
+// warn says what was taken on trust, and when the timestamp was.
+func warn(res *sign.Result, keySource string) {
+	switch {
+	case res.Signer == nil:
+		log.Printf("WARNING: trusting the bare public key in %s, for any purpose", keySource)
+	case len(*ca) == 0:
+		log.Printf("WARNING: no -ca given, trusting whatever key is in %s", keySource)
+	}
+	if ts := res.Timestamp; ts != nil {
+		log.Printf("timestamped by %s at %s", ts.Signer.Subject.CommonName, ts.Time.Format(time.RFC3339))
+	}
+}
+
+/**
+ * Checks a whole release directory against its signed manifest: the
+ * manifest's signer, then every file, hashed in parallel.
+ */
+func verifyRelease(signerCert *x509.Certificate, opts *sign.VerifyOptions) {
+	path := filepath.Join(*dir, enough.ReleaseManifestFile)
+	m, err := enough.ReadReleaseManifest(path)
 	if err != nil {
-		log.Fatalf("failed to read sig from %s: %s", *sig, err)
+		log.Fatalf("failed to read %s: %s", path, err)
+	}
+	res, r, err := sign.VerifyRelease(*dir, m, signerCert, opts, 0)
+	if r != nil {
+		for _, f := range r.Missing {
+			log.Printf("missing %s", f)
+		}
+		for _, f := range r.Modified {
+			log.Printf("modified %s", f)
+		}
+		for _, f := range r.Unexpected {
+			log.Printf("unexpected %s", f)
+		}
 	}
-	sig := &ecdsaSig{}
-	extra, err := asn1.Unmarshal(raw, sig)
-	if err != nil || len(extra) != 0 {
-		log.Fatalf("invalid signature data")
-	}
-
-	// Apparently there's no standard way to know what digest was used for an
-	// ECDSA signature, it's literally just R and S blatted as an ASN.1
-	// SEQUENCE. I've chosen to encode the public key we're verifying from in
-	// a cert and use the SignatureAlgorithm x509 field from that, but who
-	// knows if that's sensible.
-
-	// we're doing it by hand this way so that we don't have to read all of
-	// *file into a []byte. This is mostly copied from
-	// /src/pkg/crypto/x509/x509.go?s=20823:20922#L606
-	var hashType crypto.Hash
-
-	switch cert.SignatureAlgorithm {
-	case x509.ECDSAWithSHA1:
-		hashType = crypto.SHA1
-	case x509.ECDSAWithSHA256:
-		hashType = crypto.SHA256
-	case x509.ECDSAWithSHA384:
-		hashType = crypto.SHA384
-	case x509.ECDSAWithSHA512:
-		hashType = crypto.SHA512
-	default:
-		log.Fatalf("unsupported hash algorithm")
-	}
-	if !hashType.Available() {
-		log.Fatalf("unsupported hash algorithm")
-	}
-	h := hashType.New()
-
-	fr, err := os.Open(*file)
 	if err != nil {
-		log.Fatalf("failed to open %s: %s\n", *file, err)
+		fail(exitCode(err), "%s", err)
 	}
-	defer fr.Close()
-	io.Copy(h, fr)
+	warn(res, path)
+	fmt.Printf("Verify OK: %d files signed by %s at %s\n", len(m.Files), res.Signer.Subject.CommonName, res.SigningTime.Format(time.RFC3339))
+}
 
-	digest := h.Sum(nil)
+func main() {
 
-	if sig.R.Sign() <= 0 || sig.S.Sign() <= 0 {
-		log.Fatalf("signature contained zero or negative values")
+	flag.Parse()
+	if !(len(*sig) != 0 && len(*file) != 0) && len(*dir) == 0 {
+		flag.Usage()
+		os.Exit(1)
 	}
-	pub := cert.PublicKey.(*ecdsa.PublicKey)
-	if !ecdsa.Verify(pub, digest, sig.R, sig.S) {
-		log.Fatalf("[!!] verification failed")
+
+	if len(*crl) != 0 && len(*ca) == 0 {
+		log.Fatalf("-crl needs -ca")
+	}
+	if len(*stamp) != 0 && len(*ca) == 0 {
+		log.Fatalf("-timestamp needs -ca")
+	}
+
+	signerCert, opts := options()
+	if len(*dir) != 0 {
+		if len(*sig) != 0 || len(*file) != 0 {
+			log.Fatalf("-dir checks a release manifest, don't give -sig or -file")
+		}
+		verifyRelease(signerCert, opts)
+		return
+	}
+
+	raw, err := ioutil.ReadFile(*sig)
+	if err != nil {
+		log.Fatalf("failed to read sig from %s: %s", *sig, err)
 	}
 
+	in := os.Stdin
+	if *file != "-" {
+		fr, err := os.Open(*file)
+		if err != nil {
+			log.Fatalf("failed to open %s: %s\n", *file, err)
+		}
+		defer fr.Close()
+		in = fr
+	}
+
+	// An ENOUGH SIGNATURE carries the signer's chain and says how it was
+	// made. Anything else is a bare signature and needs -cert.
+	res, err := sign.Verify(in, raw, signerCert, opts)
+	if err != nil {
+		if opts.PublicKey != nil && !opts.TrustBareKey && errors.Is(err, sign.ErrUntrusted) {
+			log.Printf("%s is a bare public key, pass -trust-bare-key to accept it anyway", *cert)
+		}
+		fail(exitCode(err), "%s", err)
+	}
+
+	if res.Detached {
+		warn(res, *sig)
+		fmt.Printf("Verify OK: signed by %s at %s with %s\n", res.Signer.Subject.CommonName, res.SigningTime.Format(time.RFC3339), res.Hash)
+		return
+	}
+	warn(res, *cert)
 	fmt.Printf("Verify OK\n")
 
 }
@@ -12,15 +12,15 @@ func sendAck(conn net.Conn) {
 	conn.Write([]byte("ACK\n"))
 }
 
-func serverListen(sem chan struct{}, t *testing.T) {
+func serverListen(sem chan struct{}, t *testing.T, park *testPark) {
 
-	cert, err := tls.X509KeyPair(serverTestCert, serverTestKey)
+	cert, err := tls.X509KeyPair(park.serverCert, park.serverKey)
 	if err != nil {
 		t.Errorf("server: failed to load keys: %s", err)
 	}
 
 	certPool := x509.NewCertPool()
-	if !certPool.AppendCertsFromPEM(caTestCert) {
+	if !certPool.AppendCertsFromPEM(park.caCert) {
 		t.Errorf("server: failed to load cert pool")
 	}
 
@@ -31,6 +31,7 @@ func serverListen(sem chan struct{}, t *testing.T) {
 		MinVersion:             tls.VersionTLS12,
 		SessionTicketsDisabled: true,
 		CipherSuites:           []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		Time:                   testClock, // the test park is issued at a fixed time
 	}
 	listener, err := tls.Listen("tcp", "[::1]:8000", config)
 	if err != nil {
@@ -52,16 +53,17 @@ func serverListen(sem chan struct{}, t *testing.T) {
 
 func TestComms(t *testing.T) {
 	t.Parallel()
+	park := newTestPark(t, 1)
 	sem := make(chan struct{})
-	go serverListen(sem, t)
+	go serverListen(sem, t, park)
 	<-sem
 
 	certPool := x509.NewCertPool()
-	if !certPool.AppendCertsFromPEM(caTestCert) {
+	if !certPool.AppendCertsFromPEM(park.caCert) {
 		t.Fatalf("client: failed to load cert pool")
 	}
 
-	cert, err := tls.X509KeyPair(clientTestCert, clientTestKey)
+	cert, err := tls.X509KeyPair(park.clientCert, park.clientKey)
 	if err != nil {
 		t.Fatalf("client: failed to load keys: %s", err)
 	}
@@ -73,6 +75,7 @@ func TestComms(t *testing.T) {
 		SessionTicketsDisabled: true,
 		ServerName:             "TestCerts",
 		CipherSuites:           []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		Time:                   testClock,
 	}
 
 	conn, err := tls.Dial("tcp", "[::1]:8000", config)
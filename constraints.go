@@ -0,0 +1,228 @@
+package enough
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// NameConstraints limit the names a CA may issue certs for, via the X.509
+// name constraints extension. Each list is only enforced if it is non-empty.
+// Domains follow the RFC 5280 / crypto/x509 rules: "example.com" permits
+// example.com and any subdomain, ".example.com" permits only subdomains.
+// URIDomains constrain the host part of URI SANs, which for park members is
+// the SPIFFE trust domain.
+//
+// Remember that the server cert's DNS SAN is the service name, so a CA
+// constrained to example.com needs a service name like widget.example.com.
+type NameConstraints struct {
+	DNSDomains []string
+	IPRanges   []*net.IPNet
+	URIDomains []string
+}
+
+func (nc *NameConstraints) apply(template *x509.Certificate) {
+	if nc == nil {
+		return
+	}
+	template.PermittedDNSDomainsCritical = true
+	template.PermittedDNSDomains = nc.DNSDomains
+	template.PermittedIPRanges = nc.IPRanges
+	template.PermittedURIDomains = nc.URIDomains
+}
+
+func constraintsOf(cert *x509.Certificate) *NameConstraints {
+	return &NameConstraints{
+		DNSDomains: cert.PermittedDNSDomains,
+		IPRanges:   cert.PermittedIPRanges,
+		URIDomains: cert.PermittedURIDomains,
+	}
+}
+
+func (nc *NameConstraints) empty() bool {
+	return nc == nil || len(nc.DNSDomains) == 0 && len(nc.IPRanges) == 0 && len(nc.URIDomains) == 0
+}
+
+func domainPermitted(name string, permitted []string) bool {
+	if len(permitted) == 0 {
+		return true
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, c := range permitted {
+		c = strings.ToLower(c)
+		if strings.HasPrefix(c, ".") {
+			if strings.HasSuffix(name, c) {
+				return true
+			}
+			continue
+		}
+		if name == c || strings.HasSuffix(name, "."+c) {
+			return true
+		}
+	}
+	return false
+}
+
+func ipPermitted(ip net.IP, permitted []*net.IPNet) bool {
+	if len(permitted) == 0 {
+		return true
+	}
+	for _, n := range permitted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// netWithin reports whether inner is entirely inside outer.
+func netWithin(inner, outer *net.IPNet) bool {
+	innerOnes, innerBits := inner.Mask.Size()
+	outerOnes, outerBits := outer.Mask.Size()
+	return innerBits == outerBits && innerOnes >= outerOnes && outer.Contains(inner.IP)
+}
+
+// checkConstraints refuses to issue spec under issuer if any of its names
+// fall outside issuer's name constraints, so that nothing is signed which
+// verifiers would reject anyway. CA certs must have constraints no wider
+// than their issuer's.
+func checkConstraints(issuer *x509.Certificate, spec *certSpec) error {
+	nc := constraintsOf(issuer)
+	if nc.empty() {
+		return nil
+	}
+	for _, d := range spec.dnsNames {
+		if !domainPermitted(d, nc.DNSDomains) {
+			return fmt.Errorf("DNS name %q is outside the CA's name constraints %v", d, nc.DNSDomains)
+		}
+	}
+	for _, u := range spec.uris {
+		if !domainPermitted(u.Hostname(), nc.URIDomains) {
+			return fmt.Errorf("URI %s is outside the CA's name constraints %v", u, nc.URIDomains)
+		}
+	}
+
+	if !spec.isCA {
+		return nil
+	}
+	child := spec.constraints
+	if child.empty() {
+		// An unconstrained intermediate under a constrained root would
+		// only mint certs that fail verification. Inherit instead.
+		spec.constraints = nc
+		return nil
+	}
+	for _, d := range child.DNSDomains {
+		if !domainPermitted(strings.TrimPrefix(d, "."), nc.DNSDomains) {
+			return fmt.Errorf("DNS constraint %q is wider than the CA's %v", d, nc.DNSDomains)
+		}
+	}
+	for _, d := range child.URIDomains {
+		if !domainPermitted(strings.TrimPrefix(d, "."), nc.URIDomains) {
+			return fmt.Errorf("URI constraint %q is wider than the CA's %v", d, nc.URIDomains)
+		}
+	}
+	for _, n := range child.IPRanges {
+		ok := len(nc.IPRanges) == 0
+		for _, outer := range nc.IPRanges {
+			if netWithin(n, outer) {
+				ok = true
+			}
+		}
+		if !ok {
+			return fmt.Errorf("IP constraint %s is wider than the CA's", n)
+		}
+	}
+	// Lists the child leaves empty would be unconstrained; carry the
+	// issuer's over.
+	merged := *child
+	if len(merged.DNSDomains) == 0 {
+		merged.DNSDomains = nc.DNSDomains
+	}
+	if len(merged.IPRanges) == 0 {
+		merged.IPRanges = nc.IPRanges
+	}
+	if len(merged.URIDomains) == 0 {
+		merged.URIDomains = nc.URIDomains
+	}
+	spec.constraints = &merged
+	return nil
+}
+
+// CreateIntermediateCA issues a CA cert for service, signed by ca, which can
+// issue leaf certs but not further CAs. nc may be nil, in which case the
+// intermediate inherits ca's constraints; otherwise nc must be within them.
+func (ca *CA) CreateIntermediateCA(service string, nc *NameConstraints) (sub *CA, e error) {
+	return ca.createIntermediateCA(service, nc, "", nil)
+}
+
+// createIntermediateCA issues the intermediate with key, or a new key if
+// key is nil.
+func (ca *CA) createIntermediateCA(service string, nc *NameConstraints, request string, key *ecdsa.PrivateKey) (sub *CA, e error) {
+	// tlspark names the intermediate's files after it
+	if e = ValidateMemberName(service); e != nil {
+		return
+	}
+	name := pkix.Name{
+		Organization: []string{"Just Enough"},
+		CommonName:   service + " CA",
+	}
+	spec := certSpec{
+		name:        name,
+		info:        &ParkInfo{Version: parkInfoVersion, ParkID: ca.ParkID, Service: service, Role: RoleIntermediate, Index: -1},
+		usage:       x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		isCA:        true,
+		constraints: nc,
+		request:     request,
+	}
+	if key != nil {
+		spec.publicKey = &key.PublicKey
+	}
+
+	cert, e := ca.createCert(spec, &ca.Raw)
+	if e != nil {
+		return
+	}
+	if key != nil {
+		cert.PrivateKey = key
+	}
+	sub = &CA{
+		Raw:       *cert,
+		Service:   service,
+		ParkID:    ca.ParkID,
+		Rand:      ca.Rand,
+		Clock:     ca.Clock,
+		Approvals: ca.Approvals,
+		Log:       ca.Log,
+	}
+	return
+}
+
+// ParseNameConstraints builds NameConstraints from comma separated lists,
+// eg ("example.com,.corp", "10.0.0.0/8", "widget.example.com"). It returns
+// nil if all three are empty.
+func ParseNameConstraints(dns, ips, uris string) (*NameConstraints, error) {
+	split := func(s string) (out []string) {
+		for _, f := range strings.Split(s, ",") {
+			if f = strings.TrimSpace(f); len(f) > 0 {
+				out = append(out, f)
+			}
+		}
+		return
+	}
+	nc := &NameConstraints{DNSDomains: split(dns), URIDomains: split(uris)}
+	for _, cidr := range split(ips) {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nc.IPRanges = append(nc.IPRanges, n)
+	}
+	if nc.empty() {
+		return nil, nil
+	}
+	return nc, nil
+}
@@ -0,0 +1,78 @@
+package enough
+
+import (
+	"crypto/x509"
+	"testing"
+)
+
+func TestNameConstraints(t *testing.T) {
+	t.Parallel()
+	nc, err := ParseNameConstraints("example.com", "10.0.0.0/8", "widget.example.com")
+	if err != nil {
+		t.Fatalf("failed to parse constraints: %s", err)
+	}
+	ca, err := NewCAWithOptions("widget.example.com", &CAOptions{Constraints: nc})
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	if got := ca.Raw.Certificate.PermittedDNSDomains; len(got) != 1 || got[0] != "example.com" {
+		t.Errorf("CA cert has DNS constraints %v", got)
+	}
+
+	server, err := ca.CreateServerCert()
+	if err != nil {
+		t.Fatalf("unable to create server cert: %s", err)
+	}
+	client, err := ca.CreateNamedClientCert("worker")
+	if err != nil {
+		t.Fatalf("unable to create client cert: %s", err)
+	}
+
+	// the stdlib verifier should agree that what we issued is permitted
+	roots := x509.NewCertPool()
+	roots.AddCert(&ca.Raw.Certificate)
+	for _, c := range []*RawCert{server, client} {
+		opts := x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}
+		if _, err := c.Certificate.Verify(opts); err != nil {
+			t.Errorf("%s failed to verify: %s", c.Certificate.Subject.CommonName, err)
+		}
+	}
+}
+
+func TestNameConstraintsRefuse(t *testing.T) {
+	t.Parallel()
+	nc, err := ParseNameConstraints("example.com", "", "")
+	if err != nil {
+		t.Fatalf("failed to parse constraints: %s", err)
+	}
+	ca, err := NewCAWithOptions("Widget", &CAOptions{Constraints: nc})
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	if _, err := ca.CreateServerCert(); err == nil {
+		t.Error("issued a server cert for a name outside the constraints")
+	}
+
+	if _, err := ca.CreateIntermediateCA("wide", &NameConstraints{DNSDomains: []string{"com"}}); err == nil {
+		t.Error("issued an intermediate with wider constraints")
+	}
+
+	sub, err := ca.CreateIntermediateCA("sub.example.com", nil)
+	if err != nil {
+		t.Fatalf("failed to create intermediate: %s", err)
+	}
+	if got := sub.Raw.Certificate.PermittedDNSDomains; len(got) != 1 || got[0] != "example.com" {
+		t.Errorf("intermediate did not inherit constraints, has %v", got)
+	}
+	if !sub.Raw.Certificate.MaxPathLenZero {
+		t.Error("intermediate can issue further CAs")
+	}
+
+	narrow, err := ca.CreateIntermediateCA("db.example.com", &NameConstraints{DNSDomains: []string{"db.example.com"}})
+	if err != nil {
+		t.Fatalf("failed to create intermediate: %s", err)
+	}
+	if _, err := narrow.CreateServerCert(); err != nil {
+		t.Errorf("unable to create server cert under narrowed intermediate: %s", err)
+	}
+}
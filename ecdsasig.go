@@ -0,0 +1,105 @@
+package enough
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Bare ECDSA signatures turn up in several encodings: ASN.1 DER from
+// openssl and Go, fixed width r||s (IEEE P1363) from HSMs, WebCrypto and
+// JOSE, and either of those as base64 or hex text.
+const (
+	SigFormatAuto   = "auto"
+	SigFormatDER    = "der"
+	SigFormatP1363  = "p1363"
+	SigFormatBase64 = "base64"
+	SigFormatHex    = "hex"
+)
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// DecodeECDSASignature decodes a bare ECDSA signature for pub in the given
+// format, returning R and S. SigFormatAuto tries DER, then P1363, then hex,
+// then base64 (standard or URL alphabet, padded or not). Text formats hold
+// either DER or P1363, which is detected.
+func DecodeECDSASignature(data []byte, format string, pub *ecdsa.PublicKey) (r, s *big.Int, e error) {
+	size := (pub.Curve.Params().BitSize + 7) / 8
+	switch format {
+	case SigFormatDER:
+		r, s, e = decodeDER(data)
+	case SigFormatP1363:
+		r, s, e = decodeP1363(data, size)
+	case SigFormatHex, SigFormatBase64:
+		var raw []byte
+		if raw, e = decodeSigText(data, format); e != nil {
+			return
+		}
+		r, s, e = decodeBinarySig(raw, size)
+	case SigFormatAuto, "":
+		r, s, e = decodeAutoSig(data, size)
+	default:
+		e = fmt.Errorf("unknown signature format %q", format)
+	}
+	if e == nil && (r.Sign() <= 0 || s.Sign() <= 0) {
+		e = errors.New("signature contained zero or negative values")
+	}
+	return
+}
+
+func decodeAutoSig(data []byte, size int) (*big.Int, *big.Int, error) {
+	if r, s, err := decodeBinarySig(data, size); err == nil {
+		return r, s, nil
+	}
+	for _, f := range []string{SigFormatHex, SigFormatBase64} {
+		if raw, err := decodeSigText(data, f); err == nil {
+			if r, s, err := decodeBinarySig(raw, size); err == nil {
+				return r, s, nil
+			}
+		}
+	}
+	return nil, nil, errors.New("signature is not DER, P1363, hex or base64")
+}
+
+func decodeBinarySig(data []byte, size int) (*big.Int, *big.Int, error) {
+	if r, s, err := decodeDER(data); err == nil {
+		return r, s, nil
+	}
+	return decodeP1363(data, size)
+}
+
+func decodeDER(data []byte) (*big.Int, *big.Int, error) {
+	sig := ecdsaSignature{}
+	rest, err := asn1.Unmarshal(data, &sig)
+	if err != nil || len(rest) != 0 {
+		return nil, nil, errors.New("invalid DER signature")
+	}
+	return sig.R, sig.S, nil
+}
+
+func decodeP1363(data []byte, size int) (*big.Int, *big.Int, error) {
+	if len(data) != 2*size {
+		return nil, nil, fmt.Errorf("P1363 signature is %d bytes, expected %d", len(data), 2*size)
+	}
+	return new(big.Int).SetBytes(data[:size]), new(big.Int).SetBytes(data[size:]), nil
+}
+
+func decodeSigText(data []byte, format string) ([]byte, error) {
+	text := strings.Join(strings.Fields(string(data)), "")
+	if format == SigFormatHex {
+		return hex.DecodeString(text)
+	}
+	text = strings.TrimRight(text, "=")
+	if bytes.ContainsAny([]byte(text), "-_") {
+		return base64.RawURLEncoding.DecodeString(text)
+	}
+	return base64.RawStdEncoding.DecodeString(text)
+}
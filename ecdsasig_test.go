@@ -0,0 +1,68 @@
+package enough
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+)
+
+func TestDecodeECDSASignature(t *testing.T) {
+	t.Parallel()
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatalf("failed to generate key: %s", err)
+		}
+		digest := sha256.Sum256([]byte("release"))
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatalf("failed to sign: %s", err)
+		}
+		der, _ := asn1.Marshal(ecdsaSignature{r, s})
+		size := (curve.Params().BitSize + 7) / 8
+		p1363 := make([]byte, 2*size)
+		r.FillBytes(p1363[:size])
+		s.FillBytes(p1363[size:])
+
+		cases := []struct {
+			format string
+			data   []byte
+		}{
+			{SigFormatDER, der},
+			{SigFormatP1363, p1363},
+			{SigFormatHex, []byte(hex.EncodeToString(der) + "\n")},
+			{SigFormatHex, []byte(hex.EncodeToString(p1363))},
+			{SigFormatBase64, []byte(base64.StdEncoding.EncodeToString(der))},
+			{SigFormatBase64, []byte(base64.RawURLEncoding.EncodeToString(p1363))},
+		}
+		for _, c := range cases {
+			for _, format := range []string{c.format, SigFormatAuto} {
+				gotR, gotS, err := DecodeECDSASignature(c.data, format, &key.PublicKey)
+				if err != nil {
+					t.Errorf("%s %s as %s: %s", curve.Params().Name, c.format, format, err)
+					continue
+				}
+				if !ecdsa.Verify(&key.PublicKey, digest[:], gotR, gotS) {
+					t.Errorf("%s %s as %s: decoded signature doesn't verify", curve.Params().Name, c.format, format)
+				}
+			}
+		}
+
+		if _, _, err := DecodeECDSASignature(p1363[1:], SigFormatP1363, &key.PublicKey); err == nil {
+			t.Errorf("%s: accepted a short P1363 signature", curve.Params().Name)
+		}
+		for _, format := range []string{SigFormatP1363, SigFormatAuto} {
+			if _, _, err := DecodeECDSASignature(make([]byte, 2*size), format, &key.PublicKey); err == nil {
+				t.Errorf("%s: accepted a zero signature as %s", curve.Params().Name, format)
+			}
+		}
+		if _, _, err := DecodeECDSASignature([]byte("not a signature!"), SigFormatAuto, &key.PublicKey); err == nil {
+			t.Errorf("%s: accepted garbage", curve.Params().Name)
+		}
+	}
+}
@@ -1,14 +1,20 @@
 package enough
 
 import (
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"math/big"
+	"net/url"
+	"regexp"
+	"strings"
 	"time"
 )
 
@@ -35,6 +41,29 @@ func (c *RawCert) MarshalCertificate() ([]byte, error) {
 type CA struct {
 	Raw     RawCert
 	Service string
+	ParkID  string // hex; empty for parks made before park metadata existed
+
+	// Rand and Clock replace crypto/rand and time.Now for everything the CA
+	// issues. They are for reproducible tests; leave them nil otherwise.
+	// See CAOptions.
+	Rand  io.Reader
+	Clock func() time.Time
+
+	// Workers bounds the concurrency of CreateClientCerts. Zero means
+	// GOMAXPROCS.
+	Workers int
+
+	// Signer, if set, signs everything the CA issues instead of
+	// Raw.PrivateKey, which can then be nil. Use it to keep the CA key out
+	// of this process, eg with a RemoteSigner.
+	Signer crypto.Signer
+
+	// Approvals, if set, stops the CA issuing the roles it covers except
+	// through the Approved methods. See ApprovalPolicy.
+	Approvals *ApprovalPolicy
+
+	// Log, if set, gets every cert the CA issues appended to it.
+	Log *IssuanceLog
 }
 
 /**
@@ -43,113 +72,440 @@ type CA struct {
  * MarshalPrivateKey methods and read in from files.
  */
 func NewCAFromCertAndKey(certPemData, keyPemData []byte) (ca *CA, e error) {
-	certPemBlock, _ := pem.Decode(certPemData)
-	keyPemBlock, _ := pem.Decode(keyPemData)
-
-	cert, e := x509.ParseCertificate(certPemBlock.Bytes)
+	cert, e := parseCertPEM(certPemData)
 	if e != nil {
 		return
 	}
 
-	key, e := x509.ParseECPrivateKey(keyPemBlock.Bytes)
+	key, e := ParsePrivateKeyPEM(keyPemData)
 	if e != nil {
 		return
 	}
-
-	// The certificate's subject common name is the service name with " CA" appended.
-	serviceName := cert.Subject.CommonName[0 : len(cert.Subject.CommonName)-3]
-	ca = &CA{
-		Raw:     RawCert{Certificate: *cert, PrivateKey: key},
-		Service: serviceName,
+	if !key.PublicKey.Equal(cert.PublicKey) {
+		e = errors.New("CA key does not match CA cert")
+		return
 	}
 
+	ca = &CA{Raw: RawCert{Certificate: *cert, PrivateKey: key}}
+	e = ca.loadParkInfo()
+	if e != nil {
+		ca = nil
+	}
 	return
 }
 
+// loadParkInfo fills in Service and ParkID from the CA cert.
+func (ca *CA) loadParkInfo() error {
+	cert := &ca.Raw.Certificate
+	if !cert.IsCA {
+		return errors.New("certificate is not a CA")
+	}
+	info, err := ParkInfoFromCert(cert)
+	if err == ErrNoParkInfo {
+		// Older parks: the subject common name is the service name with
+		// " CA" appended.
+		if !strings.HasSuffix(cert.Subject.CommonName, " CA") {
+			return fmt.Errorf("can't find the service name in CA cert %q", cert.Subject.CommonName)
+		}
+		ca.Service = strings.TrimSuffix(cert.Subject.CommonName, " CA")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Role != RoleCA && info.Role != RoleIntermediate {
+		return fmt.Errorf("certificate has park role %q, not a CA", info.Role)
+	}
+	ca.Service = info.Service
+	ca.ParkID = info.ParkID
+	return nil
+}
+
 func NewCA(service string) (ca *CA, e error) {
+	return NewCAWithOptions(service, nil)
+}
+
+// CAOptions are the optional settings for a new park CA. A nil *CAOptions
+// is the same as the zero value.
+type CAOptions struct {
+	// Constraints, if set, limits the names this CA (and anything below it)
+	// may issue certs for.
+	Constraints *NameConstraints
+
+	// Rand, if set, is the only source of randomness for keys, serials and
+	// the park ID, and signatures become deterministic (RFC 6979), so the
+	// same Rand and Clock produce byte-identical parks. NEVER use a
+	// predictable Rand for a real park.
+	Rand io.Reader
+
+	// Clock, if set, replaces time.Now when setting validity periods.
+	Clock func() time.Time
+}
+
+func NewCAWithOptions(service string, opts *CAOptions) (ca *CA, e error) {
+	if opts == nil {
+		opts = &CAOptions{}
+	}
+
+	// not usable until the cert exists, but parkInfo only needs the names
+	ca = &CA{Service: service, Rand: opts.Rand, Clock: opts.Clock}
+	if ca.ParkID, e = newParkID(ca.random()); e != nil {
+		ca = nil
+		return
+	}
 
 	name := pkix.Name{
 		Organization: []string{"Just Enough"},
 		CommonName:   service + " CA",
 	}
-	usage := x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign
-	extUsage := []x509.ExtKeyUsage{}
+	spec := certSpec{
+		name:        name,
+		info:        ca.parkInfo(RoleCA, -1),
+		usage:       x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		constraints: opts.Constraints,
+	}
 
-	if cert, e := createCert(name, usage, extUsage, nil); e == nil {
-		ca = &CA{
-			Raw:     *cert,
-			Service: service,
-		}
+	cert, e := ca.createCert(spec, nil)
+	if e != nil {
+		ca = nil
+		return
 	}
+	ca.Raw = *cert
 	return
 }
 
 func (ca *CA) CreateServerCert() (c *RawCert, e error) {
+	c, e = ca.createCert(ca.serverSpec(), &ca.Raw)
+
+	return
+}
+
+func (ca *CA) serverSpec() certSpec {
 	name := pkix.Name{
 		Organization: []string{"Just Enough"},
 		CommonName:   ca.Service,
 	}
-	usage := x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature
-	extUsage := []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	return certSpec{
+		name: name,
+		// Modern TLS stacks ignore the CN, so the service name is also the
+		// SAN clients should use as their ServerName.
+		dnsNames: []string{ca.Service},
+		uris:     []*url.URL{ca.spiffeID("server")},
+		info:     ca.parkInfo(RoleServer, -1),
+		usage:    x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		extUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+}
+
+func (ca *CA) CreateClientCert(n int) (c *RawCert, e error) {
+	return ca.CreateNumberedClientCert(n, nil)
+}
+
+// CreateNumberedClientCert issues client number n, named ClientN, with the
+// given claims, which may be nil. The number is recorded in the park
+// metadata.
+func (ca *CA) CreateNumberedClientCert(n int, claims *Claims) (c *RawCert, e error) {
+	if n < 0 {
+		e = fmt.Errorf("invalid client number %d", n)
+		return
+	}
+	return ca.createClientCert(fmt.Sprintf("Client%d", n), n, claims)
+}
+
+// Member names end up in CNs, SPIFFE IDs, log lines and filenames, so keep
+// them boring. The reserved names would collide with tlspark's ca_* and
+// server_* files.
+var (
+	memberNameRE        = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*(@[A-Za-z0-9][A-Za-z0-9._-]*)?$`)
+	reservedMemberNames = map[string]bool{"ca": true, "server": true}
+)
+
+// ValidateMemberName checks that name is usable as a client identity: 1-64
+// characters from [A-Za-z0-9._-], starting with a letter or digit, with an
+// optional @domain part following the same rules, eg "alice@ops".
+func ValidateMemberName(name string) error {
+	if len(name) > 64 || !memberNameRE.MatchString(name) {
+		return fmt.Errorf("invalid member name %q: use 1-64 of A-Z a-z 0-9 . _ - and at most one @, each part starting with a letter or digit", name)
+	}
+	if reservedMemberNames[strings.ToLower(name)] {
+		return fmt.Errorf("member name %q is reserved", name)
+	}
+	return nil
+}
+
+// CreateNamedClientCert issues a client cert whose CN is name, eg
+// "billing-worker" or "alice@ops". With ca.Log set, a name that's already
+// in the log (any case) is refused; without one, keeping names unique is up
+// to the caller, eg with Inventory.Find.
+func (ca *CA) CreateNamedClientCert(clientName string) (c *RawCert, e error) {
+	return ca.CreateClientCertWithClaims(clientName, nil)
+}
+
+// CreateClientCertWithClaims issues a named client cert carrying the given
+// roles and attributes, which a Policy can authorize against. claims may be
+// nil.
+func (ca *CA) CreateClientCertWithClaims(clientName string, claims *Claims) (c *RawCert, e error) {
+	return ca.createClientCert(clientName, -1, claims)
+}
+
+func (ca *CA) createClientCert(clientName string, index int, claims *Claims) (c *RawCert, e error) {
+	spec, e := ca.clientSpec(clientName, index, claims)
+	if e != nil {
+		return
+	}
 
-	c, e = createCert(name, usage, extUsage, &ca.Raw)
+	c, e = ca.createCert(spec, &ca.Raw)
 
 	return
+
 }
 
-func (ca *CA) CreateClientCert(n int) (c *RawCert, e error) {
+func (ca *CA) clientSpec(clientName string, index int, claims *Claims) (spec certSpec, e error) {
+	if e = ValidateMemberName(clientName); e != nil {
+		return
+	}
 	name := pkix.Name{
 		Organization: []string{"Just Enough"},
-		CommonName:   fmt.Sprintf("Client%d", n),
+		CommonName:   clientName,
 	}
-	usage := x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature
-	extUsage := []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	spec = certSpec{
+		name:       name,
+		uris:       []*url.URL{ca.spiffeID(clientSPIFFEPath(clientName))},
+		info:       ca.parkInfo(RoleClient, index),
+		usage:      x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		extUsage:   []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		uniqueName: true,
+	}
+	if claims != nil {
+		ext, err := claims.extension()
+		if err != nil {
+			e = err
+			return
+		}
+		spec.extensions = append(spec.extensions, ext)
+	}
+	return
+}
 
-	c, e = createCert(name, usage, extUsage, &ca.Raw)
+// CreateCodeSigningCert issues a cert for signing artifacts, eg releases,
+// whose CN is name. It is good for code signing and nothing else, so it
+// can't act as a TLS server or client, and a leaked TLS key can't pass for
+// it. Signer names share the namespace of named clients.
+func (ca *CA) CreateCodeSigningCert(signerName string) (c *RawCert, e error) {
+	spec, e := ca.codeSigningSpec(signerName)
+	if e != nil {
+		return
+	}
+	c, e = ca.createCert(spec, &ca.Raw)
+	return
+}
 
+func (ca *CA) codeSigningSpec(signerName string) (spec certSpec, e error) {
+	if e = ValidateMemberName(signerName); e != nil {
+		return
+	}
+	name := pkix.Name{
+		Organization: []string{"Just Enough"},
+		CommonName:   signerName,
+	}
+	spec = certSpec{
+		name:       name,
+		info:       ca.parkInfo(RoleCodeSigning, -1),
+		usage:      x509.KeyUsageDigitalSignature,
+		extUsage:   []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		uniqueName: true,
+	}
 	return
+}
+
+// certSpec is everything that differs between the kinds of cert we issue.
+type certSpec struct {
+	name       pkix.Name
+	dnsNames   []string
+	uris       []*url.URL
+	info       *ParkInfo
+	usage      x509.KeyUsage
+	extUsage   []x509.ExtKeyUsage
+	extensions []pkix.Extension
+
+	// publicKey, if set, is certified instead of a freshly generated key,
+	// eg the key from a CSR. The RawCert then has no PrivateKey.
+	publicKey *ecdsa.PublicKey
+
+	// request is the ID of the IssuanceRequest this cert was approved
+	// under, set once an ApprovalPolicy has been satisfied. The CA's Log
+	// records it, so it can't be used twice.
+	request string
+
+	// uniqueName is set for member names, which the CA's Log, if any,
+	// refuses to see twice.
+	uniqueName bool
+
+	// only for CA certs
+	isCA        bool
+	constraints *NameConstraints
+}
+
+func (ca *CA) random() io.Reader {
+	if ca.Rand != nil {
+		return ca.Rand
+	}
+	return rand.Reader
+}
+
+func (ca *CA) now() time.Time {
+	if ca.Clock != nil {
+		return ca.Clock()
+	}
+	return time.Now()
+}
+
+// generateKey makes a P-256 key. The stdlib ignores custom readers, so with
+// a custom Rand the scalar is drawn directly from it, rejecting values
+// outside [1, N-1].
+func (ca *CA) generateKey() (*ecdsa.PrivateKey, error) {
+	if ca.Rand == nil {
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	scalar := make([]byte, 32)
+	for {
+		if _, err := io.ReadFull(ca.Rand, scalar); err != nil {
+			return nil, err
+		}
+		if key, err := ecdsa.ParseRawPrivateKey(elliptic.P256(), scalar); err == nil {
+			return key, nil
+		}
+	}
+}
+
+// signingRand is the reader handed to x509.CreateCertificate. nil asks for
+// deterministic RFC 6979 signatures, which is what a custom Rand wants.
+func (ca *CA) signingRand() io.Reader {
+	if ca.Rand != nil {
+		return nil
+	}
+	return rand.Reader
+}
 
+// signer returns whatever signs for the CA: Signer if set, otherwise the
+// in-memory key.
+func (ca *CA) signer() (crypto.Signer, error) {
+	if ca.Signer != nil {
+		return ca.Signer, nil
+	}
+	if ca.Raw.PrivateKey == nil {
+		return nil, errors.New("CA has no private key or signer")
+	}
+	return ca.Raw.PrivateKey, nil
 }
 
-func createCert(name pkix.Name, usage x509.KeyUsage, extUsage []x509.ExtKeyUsage, signer *RawCert) (c *RawCert, e error) {
+// createCert makes a key and cert from spec, signed by signer, or self
+// signed if signer is nil, using ca's randomness and clock.
+func (ca *CA) createCert(spec certSpec, signer *RawCert) (c *RawCert, e error) {
+
+	if ca.Approvals != nil && spec.info != nil && ca.Approvals.Requires(spec.info.Role) && len(spec.request) == 0 {
+		e = fmt.Errorf("%w: %s certs need %d admin approvals", ErrApprovalRequired, spec.info.Role, ca.Approvals.Threshold)
+		return
+	}
+	if len(spec.request) > 0 {
+		if e = ca.checkUnused(spec.request); e != nil {
+			return
+		}
+	}
+	if spec.uniqueName && ca.Log != nil && ca.Log.Named(spec.name.CommonName) {
+		e = fmt.Errorf("%s is already issued in this park", spec.name.CommonName)
+		return
+	}
+
+	if spec.info != nil && len(spec.info.ParkID) > 0 {
+		// legacy parks have no ID to record, so their certs go without
+		ext, err := spec.info.extension()
+		if err != nil {
+			e = err
+			return
+		}
+		spec.extensions = append(spec.extensions, ext)
+	}
+
+	if signer != nil {
+		if e = checkConstraints(&signer.Certificate, &spec); e != nil {
+			return
+		}
+	}
 
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	serialNumber, err := rand.Int(ca.random(), serialNumberLimit)
 	if err != nil {
 		e = fmt.Errorf("failed to generate serial number: %s", err)
 		return
 	}
 
-	ecdsaPriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	if err != nil {
-		e = fmt.Errorf("Failed to generate ECDSA key: %s", err)
+	var ecdsaPriv *ecdsa.PrivateKey
+	pub := spec.publicKey
+	if pub == nil {
+		if ecdsaPriv, err = ca.generateKey(); err != nil {
+			e = fmt.Errorf("Failed to generate ECDSA key: %s", err)
+			return
+		}
+		pub = &ecdsaPriv.PublicKey
+	} else if signer == nil {
+		e = errors.New("a self-signed cert needs its own private key")
 		return
 	}
 
+	now := ca.now()
 	template := x509.Certificate{
 		SerialNumber:          serialNumber,
-		Subject:               name,
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().AddDate(10, 0, 0), // years
+		Subject:               spec.name,
+		NotBefore:             now,
+		NotAfter:              now.AddDate(10, 0, 0), // years
 		SignatureAlgorithm:    x509.ECDSAWithSHA256,
-		KeyUsage:              usage,
-		PublicKey:             ecdsaPriv.PublicKey,
-		ExtKeyUsage:           extUsage,
+		KeyUsage:              spec.usage,
+		PublicKey:             pub,
+		DNSNames:              spec.dnsNames,
+		URIs:                  spec.uris,
+		ExtKeyUsage:           spec.extUsage,
+		ExtraExtensions:       spec.extensions,
 		BasicConstraintsValid: true,
+		IsCA:                  spec.isCA,
+	}
+	if spec.isCA && signer != nil {
+		// intermediates may only issue leaf certs
+		template.MaxPathLenZero = true
+	}
+	spec.constraints.apply(&template)
+
+	// Set the key ID ourselves, as the leftmost 160 bits of the SHA-256 of
+	// the whole SubjectPublicKeyInfo (the same key ID used everywhere else
+	// here, so not quite RFC 7093, which hashes only the key bits), rather
+	// than leave it to x509, whose choice depends on the Go version and would
+	// change every cert a given Rand makes.
+	skid, err := pubKeyID(pub)
+	if err != nil {
+		e = err
+		return
+	}
+	template.SubjectKeyId = skid[:20]
+
+	var caKey crypto.Signer
+	if signer != nil {
+		if caKey, e = ca.signer(); e != nil {
+			return
+		}
 	}
 
 	derBytes := []byte{}
 	if signer == nil {
 		// Make this a CA, and then self-sign
 		template.IsCA = true
-		derBytes, err = x509.CreateCertificate(rand.Reader, &template, &template, &ecdsaPriv.PublicKey, ecdsaPriv)
+		derBytes, err = x509.CreateCertificate(ca.signingRand(), &template, &template, pub, ecdsaPriv)
 	} else {
 		derBytes, err = x509.CreateCertificate(
-			rand.Reader,          // random source
-			&template,            // certificate parameters to set
-			&signer.Certificate,  // cert to sign with
-			&ecdsaPriv.PublicKey, // public key to sign
-			signer.PrivateKey,    // key to sign with
+			ca.signingRand(),    // random source
+			&template,           // certificate parameters to set
+			&signer.Certificate, // cert to sign with
+			pub,                 // public key to sign
+			caKey,               // key to sign with
 		)
 	}
 	if err != nil {
@@ -174,6 +530,13 @@ func createCert(name pkix.Name, usage x509.KeyUsage, extUsage []x509.ExtKeyUsage
 		return
 	}
 
+	if ca.Log != nil {
+		if _, e = ca.Log.append(cert, spec.request, spec.uniqueName); e != nil {
+			e = fmt.Errorf("failed to log certificate: %s", e)
+			return
+		}
+	}
+
 	c = &RawCert{Certificate: *cert, PrivateKey: ecdsaPriv}
 	return
 }
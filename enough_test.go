@@ -1,10 +1,14 @@
 package enough
 
 import (
+	"crypto/rand"
 	"crypto/x509"
 	"encoding/pem"
+	"math/big"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestNewCAFromCertAndKey(t *testing.T) {
@@ -132,3 +136,134 @@ func TestClientCerts(t *testing.T) {
 
 	}
 }
+
+func TestNamedClientCert(t *testing.T) {
+	t.Parallel()
+	ca, err := NewCA("testing")
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	for _, name := range []string{"billing-worker", "alice@ops", "node_1.syd"} {
+		c, err := ca.CreateNamedClientCert(name)
+		if err != nil {
+			t.Errorf("unable to create client cert %q: %s", name, err)
+			continue
+		}
+		if got := c.Certificate.Subject.CommonName; got != name {
+			t.Errorf("expected CN %q, got %q", name, got)
+		}
+	}
+	for _, name := range []string{"", "-leading", "../etc/passwd", "has space", "Server", "ca", "a@b@c", "a@.b", strings.Repeat("a", 65)} {
+		if _, err := ca.CreateNamedClientCert(name); err == nil {
+			t.Errorf("accepted bad name %q", name)
+		}
+	}
+}
+
+func TestCodeSigningCert(t *testing.T) {
+	t.Parallel()
+	ca, err := NewCA("testing")
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	c, err := ca.CreateCodeSigningCert("releases")
+	if err != nil {
+		t.Fatalf("unable to create code signing cert: %s", err)
+	}
+	if c.Certificate.KeyUsage != x509.KeyUsageDigitalSignature {
+		t.Errorf("unexpected key usage %v", c.Certificate.KeyUsage)
+	}
+	if role := memberRole(&c.Certificate); role != RoleCodeSigning {
+		t.Errorf("expected role %q, got %q", RoleCodeSigning, role)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(&ca.Raw.Certificate)
+	verifyFor := func(usage x509.ExtKeyUsage) error {
+		_, err := c.Certificate.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{usage}})
+		return err
+	}
+	if err := verifyFor(x509.ExtKeyUsageCodeSigning); err != nil {
+		t.Errorf("not valid for code signing: %s", err)
+	}
+	for _, usage := range []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth} {
+		if err := verifyFor(usage); err == nil {
+			t.Errorf("code signing cert valid for TLS usage %v", usage)
+		}
+	}
+
+	if _, err := ca.CreateCodeSigningCert("../releases"); err == nil {
+		t.Errorf("accepted bad name")
+	}
+}
+
+func TestValidityWindow(t *testing.T) {
+	t.Parallel()
+	issued := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	ca, err := NewCAWithOptions("testing", &CAOptions{Clock: func() time.Time { return issued }})
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	c, err := ca.CreateClientCert(0)
+	if err != nil {
+		t.Fatalf("unable to create client cert: %s", err)
+	}
+	if !c.Certificate.NotBefore.Equal(issued) || !c.Certificate.NotAfter.Equal(issued.AddDate(10, 0, 0)) {
+		t.Errorf("unexpected validity %s - %s", c.Certificate.NotBefore, c.Certificate.NotAfter)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(&ca.Raw.Certificate)
+	verifyAt := func(when time.Time) error {
+		_, err := c.Certificate.Verify(x509.VerifyOptions{
+			Roots:       roots,
+			CurrentTime: when,
+			KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		return err
+	}
+	if err := verifyAt(issued.AddDate(1, 0, 0)); err != nil {
+		t.Errorf("not valid inside its window: %s", err)
+	}
+	for _, when := range []time.Time{issued.AddDate(-1, 0, 0), issued.AddDate(11, 0, 0)} {
+		err := verifyAt(when)
+		if cie, ok := err.(x509.CertificateInvalidError); !ok || cie.Reason != x509.Expired {
+			t.Errorf("at %s: expected an expiry error, got %v", when, err)
+		}
+	}
+}
+
+func TestCARevocationList(t *testing.T) {
+	t.Parallel()
+	ca, err := NewCA("testing")
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	sub, err := ca.CreateIntermediateCA("sub", nil)
+	if err != nil {
+		t.Fatalf("failed to create intermediate CA: %s", err)
+	}
+	for _, issuer := range []*CA{ca, sub} {
+		c, err := issuer.CreateClientCert(0)
+		if err != nil {
+			t.Fatalf("unable to create client cert: %s", err)
+		}
+		now := time.Now()
+		der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+			Number:                    big.NewInt(1),
+			ThisUpdate:                now,
+			NextUpdate:                now.Add(time.Hour),
+			RevokedCertificateEntries: []x509.RevocationListEntry{{SerialNumber: c.Certificate.SerialNumber, RevocationTime: now}},
+		}, &issuer.Raw.Certificate, issuer.Raw.PrivateKey)
+		if err != nil {
+			t.Fatalf("%s: failed to create CRL: %s", issuer.Raw.Certificate.Subject.CommonName, err)
+		}
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			t.Fatalf("failed to parse CRL: %s", err)
+		}
+		if err := crl.CheckSignatureFrom(&issuer.Raw.Certificate); err != nil {
+			t.Errorf("%s: CRL doesn't verify: %s", issuer.Raw.Certificate.Subject.CommonName, err)
+		}
+	}
+}
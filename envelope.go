@@ -0,0 +1,388 @@
+package enough
+
+import (
+	"bytes"
+	"container/heap"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// An envelope carries a message between park members over something with
+// no TLS session, eg a queue or an object store. The sender signs it with
+// its member key and it's encrypted, once, to any number of recipient
+// certs:
+//
+//	Envelope ::= SEQUENCE {
+//	    version     INTEGER (1),
+//	    recipients  SEQUENCE OF RecipientKey,
+//	    nonce       OCTET STRING,
+//	    ciphertext  OCTET STRING }  -- AES-256-GCM of DER SignedMessage
+//
+//	RecipientKey ::= SEQUENCE {
+//	    recipient   OCTET STRING,   -- SHA-256 of recipient's PKIX public key
+//	    box         SealedBox }     -- the AES key, sealed to the recipient
+//
+//	SignedMessage ::= SEQUENCE {
+//	    tbs         MessageTBS,
+//	    chain       SEQUENCE OF Certificate,  -- sender first
+//	    signature   OCTET STRING }            -- ECDSA-SHA256 over tbs
+//
+//	MessageTBS ::= SEQUENCE {
+//	    id          OCTET STRING,   -- 16 random bytes
+//	    time        GeneralizedTime,
+//	    sender      OCTET STRING,   -- SHA-256 of the sender cert
+//	    recipients  SEQUENCE OF OCTET STRING,
+//	    payload     OCTET STRING }
+//
+// The recipients are signed too, so one recipient can't pass the message
+// on to someone else as if the sender had sent it to them.
+
+// EnvelopePEMType is the PEM block type of an envelope.
+const EnvelopePEMType = "ENOUGH ENVELOPE"
+
+const (
+	envelopeVersion = 1
+	envelopeKeyInfo = "enough envelope key v1"
+)
+
+// DefaultEnvelopeWindow is how far an envelope's time may be from the
+// receiver's clock if EnvelopeReceiver.Window isn't set.
+const DefaultEnvelopeWindow = 15 * time.Minute
+
+// ErrReplay is returned (wrapped) for an envelope the receiver has already
+// opened, or one too old or too far in the future to tell.
+var ErrReplay = errors.New("envelope replayed or outside the time window")
+
+type recipientKey struct {
+	Recipient []byte
+	Box       sealedBox
+}
+
+type envelope struct {
+	Version    int
+	Recipients []recipientKey
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+type messageTBS struct {
+	ID         []byte
+	Time       time.Time `asn1:"generalized"`
+	Sender     []byte
+	Recipients [][]byte
+	Payload    []byte
+}
+
+type signedMessage struct {
+	TBS       asn1.RawValue
+	Chain     []asn1.RawValue
+	Signature []byte
+}
+
+// Message is an opened envelope.
+type Message struct {
+	ID      string // hex
+	Time    time.Time
+	Sender  *x509.Certificate
+	Payload []byte
+}
+
+// SealEnvelope signs payload with sender's key and encrypts it to every
+// cert in recipients. when is recorded as the message time; receivers
+// refuse envelopes far from their own clock.
+func SealEnvelope(payload []byte, sender *RawCert, recipients []*x509.Certificate, when time.Time) (env []byte, e error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("no recipients")
+	}
+	if sender.PrivateKey == nil {
+		return nil, errors.New("sender has no private key to sign with")
+	}
+	if !sender.PrivateKey.PublicKey.Equal(sender.Certificate.PublicKey) {
+		return nil, errors.New("sender key does not match sender cert")
+	}
+	senderID := sha256.Sum256(sender.Certificate.Raw)
+	tbs := messageTBS{
+		ID:      make([]byte, 16),
+		Time:    when.UTC().Truncate(time.Second),
+		Sender:  senderID[:],
+		Payload: payload,
+	}
+	if _, e = rand.Read(tbs.ID); e != nil {
+		return
+	}
+	var pubs []*ecdsa.PublicKey
+	for _, c := range recipients {
+		pub, ok := c.PublicKey.(*ecdsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: recipient key is not ECDSA", c.Subject.CommonName)
+		}
+		rid, err := pubKeyID(pub)
+		if err != nil {
+			return nil, err
+		}
+		pubs = append(pubs, pub)
+		tbs.Recipients = append(tbs.Recipients, rid)
+	}
+
+	der, e := asn1.Marshal(tbs)
+	if e != nil {
+		return
+	}
+	digest := sha256.Sum256(der)
+	msg := signedMessage{
+		TBS:   asn1.RawValue{FullBytes: der},
+		Chain: []asn1.RawValue{{FullBytes: sender.Certificate.Raw}},
+	}
+	if msg.Signature, e = ecdsa.SignASN1(rand.Reader, sender.PrivateKey, digest[:]); e != nil {
+		return
+	}
+	plaintext, e := asn1.Marshal(msg)
+	if e != nil {
+		return
+	}
+
+	// One content key, sealed to each recipient.
+	key := make([]byte, 32)
+	if _, e = rand.Read(key); e != nil {
+		return
+	}
+	gcm, e := newGCM(key)
+	if e != nil {
+		return
+	}
+	out := envelope{Version: envelopeVersion, Nonce: make([]byte, gcm.NonceSize())}
+	if _, e = rand.Read(out.Nonce); e != nil {
+		return
+	}
+	out.Ciphertext = gcm.Seal(nil, out.Nonce, plaintext, nil)
+	for i, pub := range pubs {
+		rk := recipientKey{Recipient: tbs.Recipients[i]}
+		if rk.Box, e = sealTo(pub, key, rk.Recipient, envelopeKeyInfo); e != nil {
+			return
+		}
+		out.Recipients = append(out.Recipients, rk)
+	}
+	raw, e := asn1.Marshal(out)
+	if e != nil {
+		return
+	}
+	env = pem.EncodeToMemory(&pem.Block{Type: EnvelopePEMType, Bytes: raw})
+	return
+}
+
+// EnvelopeReceiver opens envelopes for one park member. It remembers the
+// IDs of the envelopes it has opened for as long as they're inside Window,
+// and refuses anything older, so a copy of an envelope is only ever opened
+// once by the same receiver. That memory isn't saved anywhere: keep one
+// receiver for the life of the process.
+type EnvelopeReceiver struct {
+	Key    *ecdsa.PrivateKey // the member's key
+	CACert *x509.Certificate // senders must chain to this
+
+	// CRL, if set, is checked for the sender, so it must come from the
+	// CA that issued the sender's cert.
+	CRL *x509.RevocationList
+
+	// Window is how far an envelope's time may be from now, either way.
+	// DefaultEnvelopeWindow if zero.
+	Window time.Duration
+
+	// Clock, if set, replaces time.Now.
+	Clock func() time.Time
+
+	mu      sync.Mutex
+	seen    map[string]bool // sender cert hash || ID
+	expires seenHeap        // the same keys, soonest to leave the window first
+}
+
+// seenEntry is an envelope the receiver has opened, which can be forgotten
+// once expires has passed.
+type seenEntry struct {
+	key     string
+	expires time.Time
+}
+
+// seenHeap is a container/heap of seenEntry, by expiry.
+type seenHeap []seenEntry
+
+func (h seenHeap) Len() int            { return len(h) }
+func (h seenHeap) Less(i, j int) bool  { return h[i].expires.Before(h[j].expires) }
+func (h seenHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *seenHeap) Push(x interface{}) { *h = append(*h, x.(seenEntry)) }
+func (h *seenHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// NewEnvelopeReceiver makes a receiver for the member holding key, trusting
+// senders in the park whose CA is caCert.
+func NewEnvelopeReceiver(key *ecdsa.PrivateKey, caCert *x509.Certificate) *EnvelopeReceiver {
+	return &EnvelopeReceiver{Key: key, CACert: caCert}
+}
+
+func (r *EnvelopeReceiver) now() time.Time {
+	if r.Clock != nil {
+		return r.Clock()
+	}
+	return time.Now()
+}
+
+func (r *EnvelopeReceiver) window() time.Duration {
+	if r.Window > 0 {
+		return r.Window
+	}
+	return DefaultEnvelopeWindow
+}
+
+// Open decrypts env, checks who sent it and that it hasn't been opened
+// before, and returns the message.
+func (r *EnvelopeReceiver) Open(env []byte) (*Message, error) {
+	block, _ := pem.Decode(env)
+	if block == nil || block.Type != EnvelopePEMType {
+		return nil, errors.New("invalid envelope PEM")
+	}
+	var outer envelope
+	if rest, err := asn1.Unmarshal(block.Bytes, &outer); err != nil || len(rest) != 0 {
+		return nil, errors.New("invalid envelope data")
+	}
+	if outer.Version != envelopeVersion {
+		return nil, fmt.Errorf("unsupported envelope version %d", outer.Version)
+	}
+	rid, err := pubKeyID(&r.Key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	var key []byte
+	for _, rk := range outer.Recipients {
+		if bytes.Equal(rk.Recipient, rid) {
+			if key, err = openWith(r.Key, rk.Box, rid, envelopeKeyInfo); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	if key == nil {
+		return nil, errors.New("envelope is not addressed to this key")
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(outer.Nonce) != gcm.NonceSize() {
+		return nil, errors.New("bad nonce length")
+	}
+	plaintext, err := gcm.Open(nil, outer.Nonce, outer.Ciphertext, nil)
+	if err != nil {
+		return nil, errors.New("decryption failed: corrupted envelope")
+	}
+
+	var msg signedMessage
+	if rest, err := asn1.Unmarshal(plaintext, &msg); err != nil || len(rest) != 0 {
+		return nil, errors.New("invalid signed message")
+	}
+	var tbs messageTBS
+	if rest, err := asn1.Unmarshal(msg.TBS.FullBytes, &tbs); err != nil || len(rest) != 0 {
+		return nil, errors.New("invalid signed message")
+	}
+	sender, err := r.checkSender(&msg, tbs.Sender)
+	if err != nil {
+		return nil, err
+	}
+	addressed := false
+	for _, id := range tbs.Recipients {
+		addressed = addressed || bytes.Equal(id, rid)
+	}
+	if !addressed {
+		return nil, fmt.Errorf("%s did not send this envelope to this key", sender.Subject.CommonName)
+	}
+	if err := r.checkFresh(tbs.Sender, tbs.ID, tbs.Time); err != nil {
+		return nil, err
+	}
+	return &Message{ID: hex.EncodeToString(tbs.ID), Time: tbs.Time, Sender: sender, Payload: tbs.Payload}, nil
+}
+
+// checkSender checks msg's signature, and that its sender is a member cert
+// that chains to the park CA and isn't revoked.
+func (r *EnvelopeReceiver) checkSender(msg *signedMessage, senderID []byte) (*x509.Certificate, error) {
+	if len(msg.Chain) == 0 {
+		return nil, errors.New("envelope has no sender cert")
+	}
+	var chain []*x509.Certificate
+	for _, raw := range msg.Chain {
+		c, err := x509.ParseCertificate(raw.FullBytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cert in envelope: %s", err)
+		}
+		chain = append(chain, c)
+	}
+	sender := chain[0]
+	if sum := sha256.Sum256(sender.Raw); !bytes.Equal(sum[:], senderID) {
+		return nil, errors.New("envelope names a different sender cert")
+	}
+	pub, ok := sender.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("sender key is not ECDSA")
+	}
+	digest := sha256.Sum256(msg.TBS.FullBytes)
+	if !ecdsa.VerifyASN1(pub, digest[:], msg.Signature) {
+		return nil, errors.New("bad sender signature")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(r.CACert)
+	inters := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		inters.AddCert(c)
+	}
+	now := r.now()
+	chains, err := verifyMember(sender, x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: inters,
+		CurrentTime:   now,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("sender %s is not in this park: %s", sender.Subject.CommonName, err)
+	}
+	if r.CRL != nil {
+		if err := CheckRevoked(chains[0], r.CRL, now, time.Time{}); err != nil {
+			return nil, err
+		}
+	}
+	return sender, nil
+}
+
+// checkFresh refuses envelopes outside the window, and ones from sender
+// with an ID seen before, then remembers them until they fall out of the
+// window. IDs are only unique per sender: they're the sender's to choose.
+func (r *EnvelopeReceiver) checkFresh(sender, id []byte, when time.Time) error {
+	now, window := r.now(), r.window()
+	if when.Before(now.Add(-window)) || when.After(now.Add(window)) {
+		return fmt.Errorf("%w: sent at %s", ErrReplay, when.Format(time.RFC3339))
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.seen == nil {
+		r.seen = make(map[string]bool)
+	}
+	for len(r.expires) > 0 && r.expires[0].expires.Before(now) {
+		delete(r.seen, heap.Pop(&r.expires).(seenEntry).key)
+	}
+	key := string(sender) + string(id)
+	if r.seen[key] {
+		return fmt.Errorf("%w: %x already opened", ErrReplay, id)
+	}
+	r.seen[key] = true
+	heap.Push(&r.expires, seenEntry{key: key, expires: when.Add(window)})
+	return nil
+}
@@ -0,0 +1,153 @@
+package enough
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnvelope(t *testing.T) {
+	t.Parallel()
+	ca, err := NewCAWithOptions("TestCerts", &CAOptions{Rand: seededRand(50), Clock: testClock})
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	alice, _ := ca.CreateClientCert(0)
+	bob, _ := ca.CreateClientCert(1)
+	carol, _ := ca.CreateClientCert(2)
+	server, _ := ca.CreateServerCert()
+
+	sent := testEpoch.Add(time.Hour)
+	payload := []byte("job 42 is done")
+	env, err := SealEnvelope(payload, alice, []*x509.Certificate{&bob.Certificate, &server.Certificate}, sent)
+	if err != nil {
+		t.Fatalf("failed to seal envelope: %s", err)
+	}
+	if bytes.Contains(env, payload) {
+		t.Error("envelope contains plaintext")
+	}
+
+	receiver := func(who *RawCert) *EnvelopeReceiver {
+		r := NewEnvelopeReceiver(who.PrivateKey, &ca.Raw.Certificate)
+		r.Clock = func() time.Time { return sent.Add(time.Minute) }
+		return r
+	}
+	toBob := receiver(bob)
+	for _, r := range []*EnvelopeReceiver{toBob, receiver(server)} {
+		m, err := r.Open(env)
+		if err != nil {
+			t.Fatalf("failed to open envelope: %s", err)
+		}
+		if !bytes.Equal(m.Payload, payload) || !m.Time.Equal(sent) || !m.Sender.Equal(&alice.Certificate) || len(m.ID) != 32 {
+			t.Errorf("unexpected message %+v", m)
+		}
+	}
+	if _, err := toBob.Open(env); !errors.Is(err, ErrReplay) {
+		t.Errorf("replayed envelope: got %v", err)
+	}
+	if _, err := receiver(carol).Open(env); err == nil {
+		t.Error("opened an envelope for someone else")
+	}
+	late := receiver(bob)
+	late.Clock = func() time.Time { return sent.Add(time.Hour) }
+	if _, err := late.Open(env); !errors.Is(err, ErrReplay) {
+		t.Errorf("stale envelope: got %v", err)
+	}
+
+	otherCA, _ := NewCAWithOptions("Other", &CAOptions{Clock: testClock})
+	mallory, _ := otherCA.CreateClientCert(0)
+	forged, _ := SealEnvelope(payload, mallory, []*x509.Certificate{&bob.Certificate}, sent)
+	if _, err := receiver(bob).Open(forged); err == nil {
+		t.Error("accepted an envelope from another park")
+	}
+}
+
+func TestEnvelopeSenderRole(t *testing.T) {
+	t.Parallel()
+	ca, err := NewCA("TestCerts")
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	bob, _ := ca.CreateClientCert(1)
+	r := NewEnvelopeReceiver(bob.PrivateKey, &ca.Raw.Certificate)
+
+	// certs that vouch for something else can't speak as members
+	signer, _ := ca.CreateCodeSigningCert("releases")
+	tsa, _ := ca.CreateTimestampingCert("tsa")
+	sub, _ := ca.CreateIntermediateCA("sub", nil)
+	for _, c := range []*RawCert{signer, tsa, &sub.Raw, &ca.Raw} {
+		env, err := SealEnvelope([]byte("hi"), c, []*x509.Certificate{&bob.Certificate}, time.Now())
+		if err != nil {
+			t.Fatalf("failed to seal envelope: %s", err)
+		}
+		if _, err := r.Open(env); err == nil {
+			t.Errorf("accepted an envelope from %s", c.Certificate.Subject.CommonName)
+		}
+	}
+	if _, err := SealEnvelope([]byte("hi"), &RawCert{Certificate: bob.Certificate}, []*x509.Certificate{&bob.Certificate}, time.Now()); err == nil {
+		t.Error("sealed an envelope with a sender that has no key")
+	}
+}
+
+func TestEnvelopeRevokedSender(t *testing.T) {
+	t.Parallel()
+	ca, err := NewCA("TestCerts")
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	alice, _ := ca.CreateClientCert(0)
+	bob, _ := ca.CreateClientCert(1)
+
+	now := time.Now()
+	env, _ := SealEnvelope([]byte("hi"), alice, []*x509.Certificate{&bob.Certificate}, now)
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{{SerialNumber: alice.Certificate.SerialNumber, RevocationTime: now}},
+	}, &ca.Raw.Certificate, ca.Raw.PrivateKey)
+	if err != nil {
+		t.Fatalf("failed to make CRL: %s", err)
+	}
+	r := NewEnvelopeReceiver(bob.PrivateKey, &ca.Raw.Certificate)
+	if r.CRL, err = x509.ParseRevocationList(crl); err != nil {
+		t.Fatalf("failed to parse CRL: %s", err)
+	}
+	if _, err := r.Open(env); err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Errorf("revoked sender: got %v", err)
+	}
+	r.CRL = nil
+	if _, err := r.Open(env); err != nil {
+		t.Errorf("failed to open envelope without the CRL: %s", err)
+	}
+}
+
+func TestEnvelopeReplayCache(t *testing.T) {
+	t.Parallel()
+	now := testEpoch
+	r := &EnvelopeReceiver{Clock: func() time.Time { return now }}
+	id := []byte("0123456789abcdef")
+	if err := r.checkFresh([]byte("alice"), id, now); err != nil {
+		t.Fatalf("fresh envelope: %s", err)
+	}
+	if err := r.checkFresh([]byte("alice"), id, now); !errors.Is(err, ErrReplay) {
+		t.Errorf("replayed ID: got %v", err)
+	}
+	if err := r.checkFresh([]byte("bob"), id, now); err != nil {
+		t.Errorf("same ID from another sender: %s", err)
+	}
+	for i := 0; i < 10; i++ {
+		r.checkFresh([]byte("alice"), []byte{byte(i)}, now.Add(time.Duration(i)*time.Minute))
+	}
+	now = now.Add(DefaultEnvelopeWindow + 5*time.Minute + time.Second)
+	r.checkFresh([]byte("carol"), id, now)
+	// alice's and bob's first two, and alice's 0-5, are out of the window
+	if len(r.seen) != 5 || len(r.expires) != 5 {
+		t.Errorf("remembering %d envelopes (%d to expire), want 5", len(r.seen), len(r.expires))
+	}
+}
@@ -0,0 +1,162 @@
+package enough
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// InventoryFile is where tlspark keeps a park's inventory.
+const InventoryFile = "inventory.json"
+
+const inventoryVersion = 1
+
+// Inventory lists the members issued by one park CA. Only the CA cert is
+// needed to keep it, so it can live on the online side of an offline park.
+type Inventory struct {
+	Version       int              `json:"version"`
+	Service       string           `json:"service"`
+	ParkID        string           `json:"park_id,omitempty"`
+	CAFingerprint string           `json:"ca_sha256"`
+	Members       []InventoryEntry `json:"members"`
+}
+
+// InventoryEntry records one issued cert.
+type InventoryEntry struct {
+	Name        string    `json:"name"`
+	Role        string    `json:"role"`
+	Index       int       `json:"index"`
+	Serial      string    `json:"serial"`
+	Fingerprint string    `json:"sha256_fingerprint"`
+	NotAfter    time.Time `json:"not_after"`
+	CertFile    string    `json:"cert_file,omitempty"`
+	Batch       string    `json:"batch,omitempty"` // ceremony batch ID, if issued offline
+
+	// Approval is the request and admin approvals it was issued under, if
+	// the park's approval policy required them.
+	Approval *PendingIssuance `json:"approval,omitempty"`
+}
+
+// NewInventory returns an empty inventory for the park whose CA is caCert.
+func NewInventory(caCert *x509.Certificate) *Inventory {
+	inv := &Inventory{Version: inventoryVersion, CAFingerprint: Fingerprint(caCert), Members: []InventoryEntry{}}
+	if info, err := ParkInfoFromCert(caCert); err == nil {
+		inv.Service = info.Service
+		inv.ParkID = info.ParkID
+	} else {
+		inv.Service = strings.TrimSuffix(caCert.Subject.CommonName, " CA")
+	}
+	return inv
+}
+
+// LoadInventory reads the inventory at path, which must belong to caCert. A
+// missing file is an empty inventory.
+func LoadInventory(path string, caCert *x509.Certificate) (*Inventory, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return NewInventory(caCert), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	inv := &Inventory{}
+	if err := json.Unmarshal(data, inv); err != nil {
+		return nil, fmt.Errorf("invalid inventory: %s", err)
+	}
+	if inv.Version != inventoryVersion {
+		return nil, fmt.Errorf("unsupported inventory version %d", inv.Version)
+	}
+	if inv.CAFingerprint != Fingerprint(caCert) {
+		return nil, errors.New("inventory belongs to a different CA")
+	}
+	return inv, nil
+}
+
+// Find returns the entry for name, compared case insensitively, or nil.
+func (inv *Inventory) Find(name string) *InventoryEntry {
+	for i := range inv.Members {
+		if strings.EqualFold(inv.Members[i].Name, name) {
+			return &inv.Members[i]
+		}
+	}
+	return nil
+}
+
+// Add records cert, which must not already be listed, by fingerprint or by
+// name. batch may be empty.
+func (inv *Inventory) Add(cert *x509.Certificate, certFile, batch string) error {
+	return inv.AddApproved(cert, certFile, batch, nil)
+}
+
+// Used reports whether a cert has already been issued under the approval
+// request with this ID. Approvals are good for one issuance.
+func (inv *Inventory) Used(requestID string) bool {
+	for _, m := range inv.Members {
+		if m.Approval != nil && m.Approval.Request.ID == requestID {
+			return true
+		}
+	}
+	return false
+}
+
+// AddApproved is Add for a cert issued under approval p, which may be nil.
+func (inv *Inventory) AddApproved(cert *x509.Certificate, certFile, batch string, p *PendingIssuance) error {
+	fp := Fingerprint(cert)
+	for _, m := range inv.Members {
+		if m.Fingerprint == fp {
+			return fmt.Errorf("%s is already in the inventory", cert.Subject.CommonName)
+		}
+	}
+	if p != nil && inv.Used(p.Request.ID) {
+		return fmt.Errorf("approval %s has already been used", p.Request.ID)
+	}
+	if inv.Find(cert.Subject.CommonName) != nil {
+		return fmt.Errorf("%s is already issued in this park", cert.Subject.CommonName)
+	}
+	entry := InventoryEntry{
+		Name:        cert.Subject.CommonName,
+		Role:        memberRole(cert),
+		Index:       -1,
+		Serial:      cert.SerialNumber.Text(16),
+		Fingerprint: fp,
+		NotAfter:    cert.NotAfter.UTC(),
+		CertFile:    certFile,
+		Batch:       batch,
+		Approval:    p,
+	}
+	if info, err := ParkInfoFromCert(cert); err == nil {
+		entry.Index = info.Index
+	}
+	inv.Members = append(inv.Members, entry)
+	return nil
+}
+
+// Save writes the inventory to path, replacing it atomically.
+func (inv *Inventory) Save(path string) error {
+	data, err := json.MarshalIndent(inv, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".inventory-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,44 @@
+package enough
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestInventory(t *testing.T) {
+	t.Parallel()
+	p := newTestPark(t, 1)
+	path := filepath.Join(t.TempDir(), InventoryFile)
+	caCert := &p.ca.Raw.Certificate
+
+	inv, err := LoadInventory(path, caCert)
+	if err != nil {
+		t.Fatalf("failed to start inventory: %s", err)
+	}
+	if err := inv.Add(&p.server.Certificate, "server_cert.pem", ""); err != nil {
+		t.Fatalf("failed to add server: %s", err)
+	}
+	if err := inv.Add(&p.client.Certificate, "client0_cert.pem", "abcd"); err != nil {
+		t.Fatalf("failed to add client: %s", err)
+	}
+	if err := inv.Add(&p.client.Certificate, "client0_cert.pem", ""); err == nil {
+		t.Error("added the same cert twice")
+	}
+	if err := inv.Save(path); err != nil {
+		t.Fatalf("failed to save: %s", err)
+	}
+
+	inv, err = LoadInventory(path, caCert)
+	if err != nil {
+		t.Fatalf("failed to load: %s", err)
+	}
+	e := inv.Find("client0")
+	if e == nil || e.Role != RoleClient || e.Index != 0 || e.Batch != "abcd" || inv.ParkID != p.ca.ParkID {
+		t.Errorf("bad inventory entry: %+v", e)
+	}
+
+	other := newTestPark(t, 2)
+	if _, err := LoadInventory(path, &other.ca.Raw.Certificate); err == nil {
+		t.Error("loaded another park's inventory")
+	}
+}
@@ -0,0 +1,505 @@
+package enough
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The issuance log is an append-only Merkle tree of every cert a park
+// issues, hashed as in RFC 6962: leaves are SHA-256(0x00 || DER) and
+// interior nodes SHA-256(0x01 || left || right). The CA signs tree heads,
+// so a member holding a signed head and an inclusion proof can check that a
+// cert was logged, and a consistency proof shows a later head only appended
+// to an earlier one.
+const (
+	IssuanceLogFile = "issuance_log.jsonl"
+	TreeHeadFile    = "issuance_log_sth.json"
+)
+
+// LeafHash is the Merkle leaf hash of a DER certificate.
+func LeafHash(der []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(der)
+	return h.Sum(nil)
+}
+
+func nodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// splitPoint is the largest power of two smaller than n.
+func splitPoint(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+func treeHash(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	case 1:
+		return leaves[0]
+	}
+	k := splitPoint(len(leaves))
+	return nodeHash(treeHash(leaves[:k]), treeHash(leaves[k:]))
+}
+
+func inclusionPath(m int, leaves [][]byte) [][]byte {
+	if len(leaves) <= 1 {
+		return nil
+	}
+	k := splitPoint(len(leaves))
+	if m < k {
+		return append(inclusionPath(m, leaves[:k]), treeHash(leaves[k:]))
+	}
+	return append(inclusionPath(m-k, leaves[k:]), treeHash(leaves[:k]))
+}
+
+// consistencyPath is PROOF(m, D[n]) from RFC 6962 section 2.1.2. Every
+// tree is consistent with the empty tree, so that proof is empty too.
+func consistencyPath(m int, leaves [][]byte, complete bool) [][]byte {
+	n := len(leaves)
+	if m == 0 {
+		return nil
+	}
+	if m == n {
+		if complete {
+			return nil
+		}
+		return [][]byte{treeHash(leaves)}
+	}
+	k := splitPoint(n)
+	if m <= k {
+		return append(consistencyPath(m, leaves[:k], complete), treeHash(leaves[k:]))
+	}
+	return append(consistencyPath(m-k, leaves[k:], false), treeHash(leaves[:k]))
+}
+
+// verifyInclusion checks an audit path, as in RFC 9162 section 2.1.3.2.
+func verifyInclusion(leaf []byte, index, size int, path [][]byte, root []byte) bool {
+	if index < 0 || index >= size {
+		return false
+	}
+	fn, sn := index, size-1
+	r := leaf
+	for _, p := range path {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			r = nodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = nodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(r, root)
+}
+
+// verifyConsistency checks a consistency proof, as in RFC 9162 section
+// 2.1.4.2.
+func verifyConsistency(m, n int, oldRoot, newRoot []byte, path [][]byte) bool {
+	switch {
+	case m < 0 || m > n:
+		return false
+	case m == n:
+		return len(path) == 0 && bytes.Equal(oldRoot, newRoot)
+	case m == 0:
+		return len(path) == 0
+	case len(path) == 0:
+		return false
+	}
+	if m&(m-1) == 0 {
+		path = append([][]byte{oldRoot}, path...)
+	}
+	fn, sn := m-1, n-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr, sr := path[0], path[0]
+	for _, c := range path[1:] {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = nodeHash(c, fr)
+			sr = nodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = nodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(fr, oldRoot) && bytes.Equal(sr, newRoot)
+}
+
+type logEntry struct {
+	Index   int    `json:"index"`
+	Cert    []byte `json:"cert"`              // DER
+	Request string `json:"request,omitempty"` // the approved IssuanceRequest it used up
+}
+
+// IssuanceLog is a park's issuance log, kept as a file of JSON lines, one
+// cert per line. It is safe for concurrent use.
+type IssuanceLog struct {
+	mu       sync.Mutex
+	f        *os.File // nil if read only
+	leaves   [][]byte
+	index    map[string]int  // by leaf hash
+	requests map[string]bool // IssuanceRequest IDs used
+	names    map[string]bool // lower case CNs of the certs logged
+}
+
+func readIssuanceLog(path string) (*IssuanceLog, error) {
+	l := newIssuanceLog()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var e logEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, len(l.leaves)+1, err)
+		}
+		if e.Index != len(l.leaves) {
+			return nil, fmt.Errorf("%s:%d: entry has index %d", path, len(l.leaves)+1, e.Index)
+		}
+		cert, err := x509.ParseCertificate(e.Cert)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, len(l.leaves)+1, err)
+		}
+		l.add(cert, e.Request)
+	}
+	return l, scanner.Err()
+}
+
+func newIssuanceLog() *IssuanceLog {
+	return &IssuanceLog{index: make(map[string]int), requests: make(map[string]bool), names: make(map[string]bool)}
+}
+
+func (l *IssuanceLog) add(cert *x509.Certificate, request string) {
+	leaf := LeafHash(cert.Raw)
+	l.index[string(leaf)] = len(l.leaves)
+	l.leaves = append(l.leaves, leaf)
+	if len(request) > 0 {
+		l.requests[request] = true
+	}
+	l.names[strings.ToLower(cert.Subject.CommonName)] = true
+}
+
+// OpenIssuanceLog opens the log at path for appending, creating it if
+// needed.
+func OpenIssuanceLog(path string) (*IssuanceLog, error) {
+	l, err := readIssuanceLog(path)
+	if err != nil {
+		return nil, err
+	}
+	if l.f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// CreateIssuanceLog starts a new, empty log at path for a new park. It
+// refuses to touch an existing file, which would belong to another park.
+func CreateIssuanceLog(path string) (*IssuanceLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l := newIssuanceLog()
+	l.f = f
+	return l, nil
+}
+
+// LoadIssuanceLog reads the log at path, read only. A missing file is an
+// empty log.
+func LoadIssuanceLog(path string) (*IssuanceLog, error) {
+	return readIssuanceLog(path)
+}
+
+// Append logs cert and returns its index.
+func (l *IssuanceLog) Append(cert *x509.Certificate) (int, error) {
+	return l.AppendApproved(cert, "")
+}
+
+// AppendApproved logs cert as issued under the approved IssuanceRequest
+// with ID request, which it uses up: the log refuses a second cert for the
+// same request. The request ID is kept alongside the cert, outside the
+// Merkle tree.
+func (l *IssuanceLog) AppendApproved(cert *x509.Certificate, request string) (int, error) {
+	return l.append(cert, request, false)
+}
+
+// append is AppendApproved that, if uniqueName is set, also refuses a cert
+// whose CN is already in the log, compared case insensitively.
+func (l *IssuanceLog) append(cert *x509.Certificate, request string, uniqueName bool) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return 0, errors.New("issuance log is read only")
+	}
+	if l.requests[request] {
+		return 0, fmt.Errorf("request %s has already been issued", request)
+	}
+	if uniqueName && l.names[strings.ToLower(cert.Subject.CommonName)] {
+		return 0, fmt.Errorf("%s is already issued in this park", cert.Subject.CommonName)
+	}
+	line, err := json.Marshal(logEntry{Index: len(l.leaves), Cert: cert.Raw, Request: request})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := l.f.Write(append(line, '\n')); err != nil {
+		return 0, err
+	}
+	l.add(cert, request)
+	return len(l.leaves) - 1, nil
+}
+
+// Issued reports whether a cert has been logged for the IssuanceRequest
+// with ID request.
+func (l *IssuanceLog) Issued(request string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.requests[request]
+}
+
+// Named reports whether a cert with CN name, compared case insensitively,
+// has been logged.
+func (l *IssuanceLog) Named(name string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.names[strings.ToLower(name)]
+}
+
+// Close flushes and closes the log file.
+func (l *IssuanceLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Sync()
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	l.f = nil
+	return err
+}
+
+// Size is the number of certs logged.
+func (l *IssuanceLog) Size() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.leaves)
+}
+
+// Root is the Merkle tree hash of the first size entries.
+func (l *IssuanceLog) Root(size int) ([]byte, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if size < 0 || size > len(l.leaves) {
+		return nil, fmt.Errorf("log has %d entries, not %d", len(l.leaves), size)
+	}
+	return treeHash(l.leaves[:size]), nil
+}
+
+// Index returns the position of cert in the log.
+func (l *IssuanceLog) Index(cert *x509.Certificate) (int, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i, ok := l.index[string(LeafHash(cert.Raw))]
+	return i, ok
+}
+
+// SignedTreeHead is the CA's signature over the log's size and root at a
+// point in time.
+type SignedTreeHead struct {
+	TreeSize  int       `json:"tree_size"`
+	Timestamp time.Time `json:"timestamp"`
+	RootHash  []byte    `json:"root_hash"`
+	Signature []byte    `json:"signature"`
+}
+
+func (sth *SignedTreeHead) digest() []byte {
+	h := sha256.New()
+	h.Write([]byte("enough tree head v1\x00"))
+	binary.Write(h, binary.BigEndian, uint64(sth.TreeSize))
+	binary.Write(h, binary.BigEndian, sth.Timestamp.UnixMilli())
+	h.Write(sth.RootHash)
+	return h.Sum(nil)
+}
+
+// SignTreeHead signs the current head of l with the CA key.
+func (ca *CA) SignTreeHead(l *IssuanceLog) (sth *SignedTreeHead, e error) {
+	size := l.Size()
+	root, e := l.Root(size)
+	if e != nil {
+		return
+	}
+	key, e := ca.signer()
+	if e != nil {
+		return
+	}
+	sth = &SignedTreeHead{TreeSize: size, Timestamp: ca.now().UTC().Truncate(time.Millisecond), RootHash: root}
+	if sth.Signature, e = key.Sign(rand.Reader, sth.digest(), crypto.SHA256); e != nil {
+		sth = nil
+	}
+	return
+}
+
+// Verify checks the tree head was signed by caCert's key.
+func (sth *SignedTreeHead) Verify(caCert *x509.Certificate) error {
+	pub, ok := caCert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return errors.New("CA key is not ECDSA")
+	}
+	if !ecdsa.VerifyASN1(pub, sth.digest(), sth.Signature) {
+		return errors.New("tree head not signed by this CA")
+	}
+	return nil
+}
+
+// InclusionProof shows that one cert is in the log at a signed tree head.
+type InclusionProof struct {
+	LeafIndex int            `json:"leaf_index"`
+	Path      [][]byte       `json:"audit_path"`
+	TreeHead  SignedTreeHead `json:"tree_head"`
+}
+
+// ConsistencyProof shows that the log at New only appended to the log at
+// Old.
+type ConsistencyProof struct {
+	Old  SignedTreeHead `json:"old"`
+	New  SignedTreeHead `json:"new"`
+	Path [][]byte       `json:"path"`
+}
+
+// ProveInclusion returns a proof that cert is in the log at sth, which must
+// be a head of this log.
+func (l *IssuanceLog) ProveInclusion(cert *x509.Certificate, sth *SignedTreeHead) (*InclusionProof, error) {
+	i, ok := l.Index(cert)
+	if !ok {
+		return nil, fmt.Errorf("%s is not in the issuance log", cert.Subject.CommonName)
+	}
+	if i >= sth.TreeSize {
+		return nil, errors.New("cert was logged after the tree head")
+	}
+	if err := l.CheckTreeHead(sth); err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return &InclusionProof{LeafIndex: i, Path: inclusionPath(i, l.leaves[:sth.TreeSize]), TreeHead: *sth}, nil
+}
+
+// ProveConsistency returns a proof that newer extends older, both heads of
+// this log.
+func (l *IssuanceLog) ProveConsistency(older, newer *SignedTreeHead) (*ConsistencyProof, error) {
+	if older.TreeSize > newer.TreeSize {
+		return nil, errors.New("old tree head is larger than the new one")
+	}
+	for _, sth := range []*SignedTreeHead{older, newer} {
+		if err := l.CheckTreeHead(sth); err != nil {
+			return nil, err
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return &ConsistencyProof{Old: *older, New: *newer, Path: consistencyPath(older.TreeSize, l.leaves[:newer.TreeSize], true)}, nil
+}
+
+// CheckTreeHead checks that sth is a head of this log: that the log's first
+// sth.TreeSize entries hash to its root. It does not check the signature.
+func (l *IssuanceLog) CheckTreeHead(sth *SignedTreeHead) error {
+	root, err := l.Root(sth.TreeSize)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(root, sth.RootHash) {
+		return fmt.Errorf("tree head of size %d does not match this log", sth.TreeSize)
+	}
+	return nil
+}
+
+// VerifyInclusion checks that cert is in the log, under a tree head signed
+// by caCert's key.
+func (p *InclusionProof) VerifyInclusion(cert *x509.Certificate, caCert *x509.Certificate) error {
+	if err := p.TreeHead.Verify(caCert); err != nil {
+		return err
+	}
+	if !verifyInclusion(LeafHash(cert.Raw), p.LeafIndex, p.TreeHead.TreeSize, p.Path, p.TreeHead.RootHash) {
+		return errors.New("inclusion proof does not verify")
+	}
+	return nil
+}
+
+// Verify checks both tree heads were signed by caCert's key and that the
+// newer one extends the older.
+func (p *ConsistencyProof) Verify(caCert *x509.Certificate) error {
+	for _, sth := range []*SignedTreeHead{&p.Old, &p.New} {
+		if err := sth.Verify(caCert); err != nil {
+			return err
+		}
+	}
+	if !verifyConsistency(p.Old.TreeSize, p.New.TreeSize, p.Old.RootHash, p.New.RootHash, p.Path) {
+		return errors.New("consistency proof does not verify: the log was rewritten")
+	}
+	return nil
+}
+
+// Extends checks that l is newer and only appended to older, eg before
+// replacing a local copy of the log with one from elsewhere.
+func (l *IssuanceLog) Extends(older *IssuanceLog) error {
+	m := older.Size()
+	oldRoot, err := older.Root(m)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if m > len(l.leaves) {
+		return errors.New("log is shorter than the one it replaces")
+	}
+	if !bytes.Equal(treeHash(l.leaves[:m]), oldRoot) {
+		return errors.New("log does not extend the one it replaces")
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package enough
+
+import (
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testLeaves(n int) [][]byte {
+	leaves := make([][]byte, n)
+	for i := range leaves {
+		leaves[i] = LeafHash([]byte{byte(i)})
+	}
+	return leaves
+}
+
+func TestMerkleProofs(t *testing.T) {
+	t.Parallel()
+	for n := 1; n <= 17; n++ {
+		leaves := testLeaves(n)
+		root := treeHash(leaves)
+		for i := 0; i < n; i++ {
+			path := inclusionPath(i, leaves)
+			if !verifyInclusion(leaves[i], i, n, path, root) {
+				t.Errorf("inclusion of %d in %d failed", i, n)
+			}
+			if verifyInclusion(leaves[(i+1)%n], i, n, path, root) && n > 1 {
+				t.Errorf("inclusion of the wrong leaf at %d in %d passed", i, n)
+			}
+		}
+		for m := 0; m <= n; m++ {
+			oldRoot := treeHash(leaves[:m])
+			path := consistencyPath(m, leaves, true)
+			if !verifyConsistency(m, n, oldRoot, root, path) {
+				t.Errorf("consistency of %d with %d failed", m, n)
+			}
+			if m > 0 && m < n {
+				forged := sha256.Sum256([]byte("forged"))
+				if verifyConsistency(m, n, forged[:], root, path) {
+					t.Errorf("consistency of a forged %d with %d passed", m, n)
+				}
+			}
+		}
+	}
+}
+
+func TestIssuanceLog(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), IssuanceLogFile)
+	l, err := OpenIssuanceLog(path)
+	if err != nil {
+		t.Fatalf("failed to open log: %s", err)
+	}
+	ca, err := NewCA("widget")
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	ca.Log = l
+	server, err := ca.CreateServerCert()
+	if err != nil {
+		t.Fatalf("unable to create server cert: %s", err)
+	}
+	older, err := ca.SignTreeHead(l)
+	if err != nil {
+		t.Fatalf("failed to sign tree head: %s", err)
+	}
+	for i := 0; i < 4; i++ {
+		if _, err := ca.CreateClientCert(i); err != nil {
+			t.Fatalf("unable to create client cert: %s", err)
+		}
+	}
+	newer, err := ca.SignTreeHead(l)
+	if err != nil {
+		t.Fatalf("failed to sign tree head: %s", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("failed to close log: %s", err)
+	}
+
+	// proofs from a reloaded copy, checked with only the CA cert
+	l, err = LoadIssuanceLog(path)
+	if err != nil {
+		t.Fatalf("failed to load log: %s", err)
+	}
+	if l.Size() != 5 {
+		t.Fatalf("log has %d entries, want 5", l.Size())
+	}
+	caCert := &ca.Raw.Certificate
+	ip, err := l.ProveInclusion(&server.Certificate, newer)
+	if err != nil {
+		t.Fatalf("failed to prove inclusion: %s", err)
+	}
+	if err := ip.VerifyInclusion(&server.Certificate, caCert); err != nil {
+		t.Errorf("inclusion proof failed: %s", err)
+	}
+	cp, err := l.ProveConsistency(older, newer)
+	if err != nil {
+		t.Fatalf("failed to prove consistency: %s", err)
+	}
+	if err := cp.Verify(caCert); err != nil {
+		t.Errorf("consistency proof failed: %s", err)
+	}
+
+	// a cert minted on the side is not in the log
+	ca.Log = nil
+	side, err := ca.CreateClientCert(99)
+	if err != nil {
+		t.Fatalf("unable to create client cert: %s", err)
+	}
+	if _, err := l.ProveInclusion(&side.Certificate, newer); err == nil {
+		t.Error("proved inclusion of an unlogged cert")
+	}
+	if err := ip.VerifyInclusion(&side.Certificate, caCert); err == nil {
+		t.Error("inclusion proof verified for the wrong cert")
+	}
+
+	// a tree head from someone else's CA is refused
+	other, _ := NewCA("other")
+	if err := newer.Verify(&other.Raw.Certificate); err == nil {
+		t.Error("tree head verified against the wrong CA")
+	}
+
+	// rewriting history is caught
+	data, _ := os.ReadFile(path)
+	rewritten, err := OpenIssuanceLog(filepath.Join(t.TempDir(), IssuanceLogFile))
+	if err != nil {
+		t.Fatalf("failed to open log: %s", err)
+	}
+	rewritten.Append(&side.Certificate)
+	if err := rewritten.Extends(l); err == nil {
+		t.Error("a rewritten log extends the original")
+	}
+	if len(data) == 0 {
+		t.Error("log file is empty")
+	}
+}
+
+func TestCreateIssuanceLog(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), IssuanceLogFile)
+	l, err := CreateIssuanceLog(path)
+	if err != nil {
+		t.Fatalf("failed to create log: %s", err)
+	}
+	ca, err := NewCA("widget")
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	if _, err := l.Append(&ca.Raw.Certificate); err != nil {
+		t.Fatalf("failed to log CA cert: %s", err)
+	}
+	l.Close()
+
+	// a second park in the same directory doesn't get the first one's log
+	if _, err := CreateIssuanceLog(path); !errors.Is(err, os.ErrExist) {
+		t.Errorf("created a log over an existing one: got %v", err)
+	}
+	if l, err = LoadIssuanceLog(path); err != nil || l.Size() != 1 {
+		t.Errorf("existing log was touched: %v, %d entries", err, l.Size())
+	}
+}
+
+func TestIssuanceLogNames(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), IssuanceLogFile)
+	l, err := OpenIssuanceLog(path)
+	if err != nil {
+		t.Fatalf("failed to open log: %s", err)
+	}
+	ca, err := NewCA("widget")
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	ca.Log = l
+	if _, err := ca.CreateNamedClientCert("billing"); err != nil {
+		t.Fatalf("unable to create client cert: %s", err)
+	}
+	if _, err := ca.CreateClientCert(3); err != nil {
+		t.Fatalf("unable to create client cert: %s", err)
+	}
+	for _, name := range []string{"billing", "Billing", "client3"} {
+		if _, err := ca.CreateNamedClientCert(name); err == nil {
+			t.Errorf("issued %s twice", name)
+		}
+	}
+	if _, err := ca.CreateCodeSigningCert("BILLING"); err == nil {
+		t.Error("issued a code signer with a client's name")
+	}
+	l.Close()
+
+	// the names come back with the log
+	if ca.Log, err = OpenIssuanceLog(path); err != nil {
+		t.Fatalf("failed to open log: %s", err)
+	}
+	defer ca.Log.Close()
+	if !ca.Log.Named("BILLING") {
+		t.Error("reopened log lost a name")
+	}
+	if _, err := ca.CreateNamedClientCert("billing"); err == nil {
+		t.Error("issued billing twice across runs")
+	}
+	if _, err := ca.CreateNamedClientCert("payroll"); err != nil {
+		t.Errorf("unable to create client cert: %s", err)
+	}
+}
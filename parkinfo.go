@@ -0,0 +1,119 @@
+package enough
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var oidParkInfo = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 59567, 1, 2}
+
+const (
+	parkInfoVersion  = 1
+	RoleIntermediate = "intermediate"
+)
+
+// ParkInfo is the metadata enough records in a private extension of every
+// cert it issues, so tools never have to guess from subject strings.
+// Index is the client number for CreateClientCert certs and -1 otherwise.
+type ParkInfo struct {
+	Version int
+	ParkID  string
+	Service string
+	Role    string
+	Index   int
+}
+
+type parkInfoExtension struct {
+	Version int
+	ParkID  []byte
+	Service string `asn1:"utf8"`
+	Role    string `asn1:"utf8"`
+	Index   int
+}
+
+func newParkID(r io.Reader) (string, error) {
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(r, id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func (ca *CA) parkInfo(role string, index int) *ParkInfo {
+	return &ParkInfo{Version: parkInfoVersion, ParkID: ca.ParkID, Service: ca.Service, Role: role, Index: index}
+}
+
+func (pi *ParkInfo) extension() (ext pkix.Extension, e error) {
+	id, e := hex.DecodeString(pi.ParkID)
+	if e != nil {
+		e = fmt.Errorf("bad park ID: %s", e)
+		return
+	}
+	value, e := asn1.Marshal(parkInfoExtension{
+		Version: pi.Version,
+		ParkID:  id,
+		Service: pi.Service,
+		Role:    pi.Role,
+		Index:   pi.Index,
+	})
+	if e != nil {
+		return
+	}
+	ext = pkix.Extension{Id: oidParkInfo, Value: value}
+	return
+}
+
+// ErrNoParkInfo means a cert has no park metadata, eg because it was issued
+// by an old version of enough.
+var ErrNoParkInfo = errors.New("certificate has no park metadata")
+
+// ParkInfoFromCert reads the park metadata extension from cert.
+func ParkInfoFromCert(cert *x509.Certificate) (*ParkInfo, error) {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidParkInfo) {
+			continue
+		}
+		var raw parkInfoExtension
+		if rest, err := asn1.Unmarshal(ext.Value, &raw); err != nil || len(rest) != 0 {
+			return nil, errors.New("malformed park metadata extension")
+		}
+		if raw.Version != parkInfoVersion {
+			return nil, fmt.Errorf("unsupported park metadata version %d", raw.Version)
+		}
+		return &ParkInfo{
+			Version: raw.Version,
+			ParkID:  hex.EncodeToString(raw.ParkID),
+			Service: raw.Service,
+			Role:    raw.Role,
+			Index:   raw.Index,
+		}, nil
+	}
+	return nil, ErrNoParkInfo
+}
+
+// PeerParkInfo returns the park metadata of the verified peer of a TLS
+// connection, and checks it against the CA the chain was verified to.
+func PeerParkInfo(state tls.ConnectionState) (*ParkInfo, error) {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil, errors.New("peer certificate not verified")
+	}
+	chain := state.VerifiedChains[0]
+	info, err := ParkInfoFromCert(chain[0])
+	if err != nil {
+		return nil, err
+	}
+	root, err := ParkInfoFromCert(chain[len(chain)-1])
+	if err != nil {
+		return nil, fmt.Errorf("peer's CA: %s", err)
+	}
+	if info.ParkID != root.ParkID {
+		return nil, fmt.Errorf("peer claims park %s but was verified by park %s", info.ParkID, root.ParkID)
+	}
+	return info, nil
+}
@@ -0,0 +1,106 @@
+package enough
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+)
+
+func TestParkInfo(t *testing.T) {
+	t.Parallel()
+	ca, err := NewCA("testing")
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	if len(ca.ParkID) != 32 {
+		t.Errorf("expected a 16 byte hex park ID, got %q", ca.ParkID)
+	}
+	server, err := ca.CreateServerCert()
+	if err != nil {
+		t.Fatalf("unable to create server cert: %s", err)
+	}
+	numbered, err := ca.CreateClientCert(7)
+	if err != nil {
+		t.Fatalf("unable to create client cert: %s", err)
+	}
+	named, err := ca.CreateNamedClientCert("worker")
+	if err != nil {
+		t.Fatalf("unable to create client cert: %s", err)
+	}
+
+	cases := []struct {
+		cert  *x509.Certificate
+		role  string
+		index int
+	}{
+		{&ca.Raw.Certificate, RoleCA, -1},
+		{&server.Certificate, RoleServer, -1},
+		{&numbered.Certificate, RoleClient, 7},
+		{&named.Certificate, RoleClient, -1},
+	}
+	for _, c := range cases {
+		info, err := ParkInfoFromCert(c.cert)
+		if err != nil {
+			t.Errorf("%s: %s", c.cert.Subject.CommonName, err)
+			continue
+		}
+		if info.ParkID != ca.ParkID || info.Service != "testing" || info.Role != c.role || info.Index != c.index {
+			t.Errorf("%s: unexpected park info %+v", c.cert.Subject.CommonName, info)
+		}
+	}
+
+	state := tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{&numbered.Certificate, &ca.Raw.Certificate}}}
+	info, err := PeerParkInfo(state)
+	if err != nil {
+		t.Fatalf("failed to read peer info: %s", err)
+	}
+	if info.Index != 7 {
+		t.Errorf("expected peer index 7, got %d", info.Index)
+	}
+
+	other, err := NewCA("testing")
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	state.VerifiedChains[0][1] = &other.Raw.Certificate
+	if _, err := PeerParkInfo(state); err == nil {
+		t.Error("accepted a peer from a different park")
+	}
+}
+
+func TestLoadLegacyCA(t *testing.T) {
+	t.Parallel()
+	// what NewCA made before park metadata existed
+	spec := certSpec{
+		name:  pkix.Name{Organization: []string{"Just Enough"}, CommonName: "Old Park CA"},
+		usage: x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	raw, err := (&CA{}).createCert(spec, nil)
+	if err != nil {
+		t.Fatalf("failed to create CA cert: %s", err)
+	}
+	pemCert, _ := raw.MarshalCertificate()
+	pemKey, err := raw.MarshalPrivateKey()
+	if err != nil {
+		t.Fatalf("failed to marshal private key: %s", err)
+	}
+	ca, err := NewCAFromCertAndKey(pemCert, pemKey)
+	if err != nil {
+		t.Fatalf("failed to load legacy CA: %s", err)
+	}
+	if ca.Service != "Old Park" || len(ca.ParkID) != 0 {
+		t.Errorf("unexpected legacy CA service %q, park %q", ca.Service, ca.ParkID)
+	}
+
+	spec.name.CommonName = "No Suffix"
+	raw, err = (&CA{}).createCert(spec, nil)
+	if err != nil {
+		t.Fatalf("failed to create CA cert: %s", err)
+	}
+	pemCert, _ = raw.MarshalCertificate()
+	pemKey, _ = raw.MarshalPrivateKey()
+	if _, err := NewCAFromCertAndKey(pemCert, pemKey); err == nil {
+		t.Error("guessed a service name from a CN without the CA suffix")
+	}
+}
@@ -0,0 +1,279 @@
+package enough
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ParkManifestFile is the signed list of a park directory's public files.
+const ParkManifestFile = "park_manifest.json"
+
+const parkManifestVersion = 1
+
+// Kinds of file in a park manifest.
+const (
+	ArtifactCert     = "cert"
+	ArtifactCRL      = "crl"
+	ArtifactMetadata = "metadata"
+)
+
+// parkMetadataFiles are the public files tlspark keeps about the park
+// itself.
+var parkMetadataFiles = map[string]bool{
+	InventoryFile:      true,
+	IssuanceLogFile:    true,
+	TreeHeadFile:       true,
+	ApprovalPolicyFile: true,
+}
+
+// ParkArtifact reports whether a file name in a park directory is a public
+// artifact the manifest covers, and what kind. Keys, bundles and key shares
+// are private and never listed.
+func ParkArtifact(name string) (kind string, ok bool) {
+	switch {
+	case parkMetadataFiles[name]:
+		return ArtifactMetadata, true
+	case strings.HasSuffix(name, "_cert.pem"):
+		return ArtifactCert, true
+	case strings.HasSuffix(name, ".crl"), strings.HasSuffix(name, "crl.pem"):
+		return ArtifactCRL, true
+	}
+	return "", false
+}
+
+// ManifestFile is one file listed in a ParkManifest.
+type ManifestFile struct {
+	Name   string `json:"name"`
+	Kind   string `json:"kind"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ParkManifest lists every public artifact in a park directory with its
+// hash, signed by the CA key.
+type ParkManifest struct {
+	Version       int            `json:"version"`
+	Service       string         `json:"service"`
+	ParkID        string         `json:"park_id,omitempty"`
+	CAFingerprint string         `json:"ca_sha256"`
+	Created       time.Time      `json:"created"`
+	Files         []ManifestFile `json:"files"`
+
+	// Approvals records that the park was signed with an ApprovalPolicy
+	// in force. It stays set, so taking the policy away can be noticed.
+	Approvals bool `json:"approvals_required,omitempty"`
+
+	Signature []byte `json:"signature,omitempty"`
+}
+
+func (m *ParkManifest) digest() ([]byte, error) {
+	unsigned := *m
+	unsigned.Signature = nil
+	data, err := json.Marshal(unsigned)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	h.Write([]byte("enough park manifest v1\x00"))
+	h.Write(data)
+	return h.Sum(nil), nil
+}
+
+func scanPark(dir string) (files []ManifestFile, e error) {
+	entries, e := os.ReadDir(dir)
+	if e != nil {
+		return
+	}
+	for _, ent := range entries {
+		kind, ok := ParkArtifact(ent.Name())
+		if !ok || !ent.Type().IsRegular() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, ent.Name()))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, ManifestFile{Name: ent.Name(), Kind: kind, Size: int64(len(data)), SHA256: sha256Hex(data)})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return
+}
+
+// NewParkManifest lists and hashes the public artifacts in dir and signs the
+// list with the CA key.
+func (ca *CA) NewParkManifest(dir string) (m *ParkManifest, e error) {
+	files, e := scanPark(dir)
+	if e != nil {
+		return
+	}
+	m = &ParkManifest{
+		Version:       parkManifestVersion,
+		Service:       ca.Service,
+		ParkID:        ca.ParkID,
+		CAFingerprint: Fingerprint(&ca.Raw.Certificate),
+		Created:       ca.now().UTC(),
+		Files:         files,
+		Approvals:     ca.Approvals != nil,
+	}
+	digest, e := m.digest()
+	if e != nil {
+		return nil, e
+	}
+	key, e := ca.signer()
+	if e != nil {
+		return nil, e
+	}
+	if m.Signature, e = key.Sign(rand.Reader, digest, crypto.SHA256); e != nil {
+		return nil, e
+	}
+	return
+}
+
+// Verify checks the manifest was signed by caCert's key.
+func (m *ParkManifest) Verify(caCert *x509.Certificate) error {
+	if m.Version != parkManifestVersion {
+		return fmt.Errorf("unsupported park manifest version %d", m.Version)
+	}
+	if m.CAFingerprint != Fingerprint(caCert) {
+		return errors.New("park manifest is for a different CA")
+	}
+	pub, ok := caCert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return errors.New("CA key is not ECDSA")
+	}
+	digest, err := m.digest()
+	if err != nil {
+		return err
+	}
+	if !ecdsa.VerifyASN1(pub, digest, m.Signature) {
+		return errors.New("park manifest not signed by this CA")
+	}
+	return nil
+}
+
+// ParkReport is what VerifyPark found wrong with a park directory.
+type ParkReport struct {
+	Missing  []string // listed, but not there
+	Modified []string // there, but different
+	Extra    []string // public artifacts that aren't listed
+	Foreign  []string // certs not issued by the park CA
+}
+
+// OK reports whether the park matched its manifest.
+func (r *ParkReport) OK() bool {
+	return len(r.Missing)+len(r.Modified)+len(r.Extra)+len(r.Foreign) == 0
+}
+
+// LoadParkManifest reads the manifest in dir and checks it was signed by
+// caCert's key. A missing manifest is an error satisfying
+// errors.Is(err, os.ErrNotExist).
+func LoadParkManifest(dir string, caCert *x509.Certificate) (*ParkManifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ParkManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	m := &ParkManifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("invalid park manifest: %s", err)
+	}
+	if err := m.Verify(caCert); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// VerifyPark checks the park in dir against its signed manifest, which
+// must be signed by caCert, and checks every cert in it was issued by
+// caCert or by an intermediate that was. An error means the manifest
+// itself can't be trusted; problems with the files are in the report.
+func VerifyPark(dir string, caCert *x509.Certificate) (*ParkReport, error) {
+	m, err := LoadParkManifest(dir, caCert)
+	if err != nil {
+		return nil, err
+	}
+
+	found, err := scanPark(dir)
+	if err != nil {
+		return nil, err
+	}
+	r := &ParkReport{}
+	listed := make(map[string]ManifestFile)
+	for _, f := range m.Files {
+		listed[f.Name] = f
+	}
+	onDisk := make(map[string]bool)
+	for _, f := range found {
+		onDisk[f.Name] = true
+		want, ok := listed[f.Name]
+		switch {
+		case !ok:
+			r.Extra = append(r.Extra, f.Name)
+		case want.SHA256 != f.SHA256 || want.Size != f.Size:
+			r.Modified = append(r.Modified, f.Name)
+		}
+	}
+	for _, f := range m.Files {
+		if !onDisk[f.Name] {
+			r.Missing = append(r.Missing, f.Name)
+		}
+	}
+
+	// Anything that isn't the CA must chain to it, directly or through an
+	// intermediate in the park.
+	var certs []*x509.Certificate
+	names := make(map[*x509.Certificate]string)
+	for _, f := range found {
+		if f.Kind != ArtifactCert {
+			continue
+		}
+		cert, err := readCertFile(filepath.Join(dir, f.Name))
+		if err != nil {
+			r.Foreign = append(r.Foreign, f.Name)
+			continue
+		}
+		certs = append(certs, cert)
+		names[cert] = f.Name
+	}
+	issuers := []*x509.Certificate{caCert}
+	for _, c := range certs {
+		if c.IsCA && !c.Equal(caCert) && c.CheckSignatureFrom(caCert) == nil {
+			issuers = append(issuers, c)
+		}
+	}
+	for _, c := range certs {
+		if c.Equal(caCert) {
+			continue
+		}
+		issued := false
+		for _, issuer := range issuers {
+			if issuer != c && c.CheckSignatureFrom(issuer) == nil {
+				issued = true
+				break
+			}
+		}
+		if !issued {
+			r.Foreign = append(r.Foreign, names[c])
+		}
+	}
+	sort.Strings(r.Foreign)
+	return r, nil
+}
+
+func readCertFile(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseCertPEM(data)
+}
@@ -0,0 +1,122 @@
+package enough
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeTestManifest(t *testing.T, ca *CA, dir string) {
+	m, err := ca.NewParkManifest(dir)
+	if err != nil {
+		t.Fatalf("failed to make manifest: %s", err)
+	}
+	data, _ := json.Marshal(m)
+	if err := os.WriteFile(filepath.Join(dir, ParkManifestFile), data, 0644); err != nil {
+		t.Fatalf("failed to write manifest: %s", err)
+	}
+}
+
+func TestVerifyPark(t *testing.T) {
+	t.Parallel()
+	p := newTestPark(t, 1)
+	dir := t.TempDir()
+	write := func(name string, data []byte) {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+	}
+	write("ca_cert.pem", p.caCert)
+	write("server_cert.pem", p.serverCert)
+	write("client0_cert.pem", p.clientCert)
+	write("client0_key.pem", p.clientKey) // private, not listed
+	write(InventoryFile, []byte("{}"))
+	writeTestManifest(t, p.ca, dir)
+
+	caCert := &p.ca.Raw.Certificate
+	r, err := VerifyPark(dir, caCert)
+	if err != nil {
+		t.Fatalf("failed to verify park: %s", err)
+	}
+	if !r.OK() {
+		t.Errorf("fresh park does not verify: %+v", r)
+	}
+
+	// keys can change without the manifest noticing
+	write("client0_key.pem", p.serverKey)
+	// but public artifacts can't
+	os.Remove(filepath.Join(dir, "server_cert.pem"))
+	write(InventoryFile, []byte("{ }"))
+	other := newTestPark(t, 2)
+	write("client9_cert.pem", other.clientCert)
+
+	r, err = VerifyPark(dir, caCert)
+	if err != nil {
+		t.Fatalf("failed to verify park: %s", err)
+	}
+	want := &ParkReport{
+		Missing:  []string{"server_cert.pem"},
+		Modified: []string{InventoryFile},
+		Extra:    []string{"client9_cert.pem"},
+		Foreign:  []string{"client9_cert.pem"},
+	}
+	if !reflect.DeepEqual(r, want) {
+		t.Errorf("got report %+v, want %+v", r, want)
+	}
+
+	if _, err := VerifyPark(dir, &other.ca.Raw.Certificate); err == nil {
+		t.Error("verified a park against the wrong CA")
+	}
+
+	// and the manifest itself can't be edited to match
+	var m ParkManifest
+	data, _ := os.ReadFile(filepath.Join(dir, ParkManifestFile))
+	json.Unmarshal(data, &m)
+	m.Files = m.Files[1:]
+	data, _ = json.Marshal(m)
+	write(ParkManifestFile, data)
+	if _, err := VerifyPark(dir, caCert); err == nil {
+		t.Error("verified an edited manifest")
+	}
+}
+
+func TestParkManifestApprovals(t *testing.T) {
+	t.Parallel()
+	ca, err := NewCA("widget")
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	caCert := &ca.Raw.Certificate
+	dir := t.TempDir()
+	if _, err := LoadParkManifest(dir, caCert); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("no manifest: got %v", err)
+	}
+	writeTestManifest(t, ca, dir)
+	m, err := LoadParkManifest(dir, caCert)
+	if err != nil {
+		t.Fatalf("failed to load manifest: %s", err)
+	}
+	if m.Approvals {
+		t.Error("manifest requires approvals without a policy")
+	}
+
+	ca.Approvals, _ = testApprovalPolicy(t, 2)
+	writeTestManifest(t, ca, dir)
+	if m, err = LoadParkManifest(dir, caCert); err != nil {
+		t.Fatalf("failed to load manifest: %s", err)
+	}
+	if !m.Approvals {
+		t.Error("manifest doesn't record the approval policy")
+	}
+
+	// and it can't be dropped without the CA
+	m.Approvals = false
+	data, _ := json.Marshal(m)
+	os.WriteFile(filepath.Join(dir, ParkManifestFile), data, 0644)
+	if _, err := LoadParkManifest(dir, caCert); err == nil {
+		t.Error("loaded a manifest with approvals switched off")
+	}
+}
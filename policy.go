@@ -0,0 +1,122 @@
+package enough
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// ErrDenied is returned (wrapped) when no policy rule allows an action.
+var ErrDenied = errors.New("not authorized")
+
+// Rule allows Action to any peer that matches every condition given. An
+// empty Roles or Identities list matches anyone; a peer needs only one of
+// the listed roles, but all of the listed attributes. Action "*" matches
+// every action.
+type Rule struct {
+	Action     string            `json:"action"`
+	Roles      []string          `json:"roles,omitempty"`
+	Identities []string          `json:"identities,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// Policy is a list of allow rules. Anything not allowed is denied. A policy
+// file is JSON, eg:
+//
+//	{"rules": [
+//	  {"action": "write", "roles": ["ingest"]},
+//	  {"action": "read",  "roles": ["ingest", "dashboard"]},
+//	  {"action": "*",     "identities": ["alice@ops"], "attributes": {"site": "syd"}}
+//	]}
+type Policy struct {
+	Rules []Rule `json:"rules"`
+}
+
+// ParsePolicy parses a JSON policy.
+func ParsePolicy(data []byte) (*Policy, error) {
+	p := &Policy{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("bad policy: %s", err)
+	}
+	for i, r := range p.Rules {
+		if len(r.Action) == 0 {
+			return nil, fmt.Errorf("bad policy: rule %d has no action", i)
+		}
+	}
+	return p, nil
+}
+
+// LoadPolicy reads a JSON policy from path.
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePolicy(data)
+}
+
+func (r *Rule) matches(identity string, claims *Claims, action string) bool {
+	if r.Action != "*" && r.Action != action {
+		return false
+	}
+	if len(r.Identities) > 0 {
+		found := false
+		for _, id := range r.Identities {
+			if id == identity {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.Roles) > 0 {
+		found := false
+		for _, role := range r.Roles {
+			if claims.HasRole(role) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for k, v := range r.Attributes {
+		if got, ok := claims.Attributes[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Authorize returns nil if some rule allows cert to perform action. cert
+// must already have been verified against the park CA, eg by the TLS
+// handshake; Authorize only reads its claims.
+func (p *Policy) Authorize(cert *x509.Certificate, action string) error {
+	claims, err := ClaimsFromCert(cert)
+	if err != nil {
+		return err
+	}
+	identity := cert.Subject.CommonName
+	for i := range p.Rules {
+		if p.Rules[i].matches(identity, claims, action) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s may not %s: %w", identity, action, ErrDenied)
+}
+
+// AuthorizeConn authorizes the verified peer of a TLS connection. It fails
+// if the peer cert was not verified, so use it with
+// tls.RequireAndVerifyClientCert on the server side.
+func (p *Policy) AuthorizeConn(state tls.ConnectionState, action string) error {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return fmt.Errorf("peer certificate not verified: %w", ErrDenied)
+	}
+	return p.Authorize(state.VerifiedChains[0][0], action)
+}
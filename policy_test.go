@@ -0,0 +1,60 @@
+package enough
+
+import (
+	"errors"
+	"testing"
+)
+
+var testPolicy = []byte(`{"rules": [
+	{"action": "write", "roles": ["ingest"]},
+	{"action": "read", "roles": ["ingest", "dashboard"]},
+	{"action": "*", "identities": ["alice@ops"], "attributes": {"site": "syd"}}
+]}`)
+
+func TestPolicy(t *testing.T) {
+	t.Parallel()
+	ca, err := NewCA("testing")
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	policy, err := ParsePolicy(testPolicy)
+	if err != nil {
+		t.Fatalf("failed to parse policy: %s", err)
+	}
+
+	mint := func(name string, claims *Claims) *RawCert {
+		c, err := ca.CreateClientCertWithClaims(name, claims)
+		if err != nil {
+			t.Fatalf("unable to create client cert: %s", err)
+		}
+		return c
+	}
+	ingest := mint("ingest-1", &Claims{Roles: []string{"ingest"}})
+	dash := mint("dash-1", &Claims{Roles: []string{"dashboard"}})
+	aliceSyd := mint("alice@ops", &Claims{Attributes: map[string]string{"site": "syd"}})
+	aliceMel := mint("alice@ops", &Claims{Attributes: map[string]string{"site": "mel"}})
+	plain := mint("plain", nil)
+
+	cases := []struct {
+		who    *RawCert
+		action string
+		ok     bool
+	}{
+		{ingest, "write", true},
+		{ingest, "read", true},
+		{dash, "read", true},
+		{dash, "write", false},
+		{aliceSyd, "delete", true},
+		{aliceMel, "delete", false},
+		{plain, "read", false},
+	}
+	for _, c := range cases {
+		err := policy.Authorize(&c.who.Certificate, c.action)
+		if c.ok && err != nil {
+			t.Errorf("%s %s: unexpected denial: %s", c.who.Certificate.Subject.CommonName, c.action, err)
+		}
+		if !c.ok && !errors.Is(err, ErrDenied) {
+			t.Errorf("%s %s: expected ErrDenied, got %v", c.who.Certificate.Subject.CommonName, c.action, err)
+		}
+	}
+}
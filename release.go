@@ -0,0 +1,268 @@
+package enough
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReleaseManifestFile is where a release directory's signed manifest lives,
+// at its top level. It's not listed in the manifest, and nor is
+// ReleaseTimestampFile, the optional timestamp over the manifest's signature.
+const (
+	ReleaseManifestFile  = "release_manifest.json"
+	ReleaseTimestampFile = "release_manifest.tsr"
+)
+
+const releaseManifestVersion = 1
+
+// ReleaseFile is one file listed in a ReleaseManifest. Path is relative to
+// the release directory, with forward slashes.
+type ReleaseFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ReleaseManifest lists every file in a release directory with its hash.
+// Signature is an ENOUGH SIGNATURE over the manifest's JSON without it, so
+// one signature from a code signing key covers the whole release.
+type ReleaseManifest struct {
+	Version   int           `json:"version"`
+	Created   time.Time     `json:"created"`
+	Files     []ReleaseFile `json:"files"`
+	Signature string        `json:"signature,omitempty"`
+}
+
+// checkReleasePath refuses paths that could point outside the release.
+func checkReleasePath(p string) error {
+	if p == "" || p != path.Clean(p) || path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") {
+		return fmt.Errorf("bad release path %q", p)
+	}
+	return nil
+}
+
+// scanRelease lists the regular files under dir, except the manifest and
+// its timestamp.
+// Anything else that isn't a directory, eg a symlink, is an error, since
+// what it points to wouldn't be covered.
+func scanRelease(dir string) (paths []string, e error) {
+	e = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		switch {
+		case d.IsDir():
+			return nil
+		case rel == ReleaseManifestFile, rel == ReleaseTimestampFile:
+			return nil
+		case !d.Type().IsRegular():
+			return fmt.Errorf("%s is not a regular file", rel)
+		}
+		paths = append(paths, rel)
+		return nil
+	})
+	sort.Strings(paths)
+	return
+}
+
+func hashReleaseFile(dir, rel string) (f ReleaseFile, e error) {
+	r, e := os.Open(filepath.Join(dir, filepath.FromSlash(rel)))
+	if e != nil {
+		return
+	}
+	defer r.Close()
+	h := sha256.New()
+	n, e := io.Copy(h, r)
+	if e != nil {
+		return
+	}
+	return ReleaseFile{Path: rel, Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// hashRelease hashes paths under dir across workers goroutines (GOMAXPROCS
+// if zero). The results are in the same order as paths.
+func hashRelease(dir string, paths []string, workers int) ([]ReleaseFile, error) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	files := make([]ReleaseFile, len(paths))
+	errs := make([]error, len(paths))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				files[i], errs[i] = hashReleaseFile(dir, paths[i])
+			}
+		}()
+	}
+	for i := range paths {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return files, errors.Join(errs...)
+}
+
+// NewReleaseManifest lists and hashes every file under dir. Sign it before
+// writing it out.
+func NewReleaseManifest(dir string) (*ReleaseManifest, error) {
+	paths, err := scanRelease(dir)
+	if err != nil {
+		return nil, err
+	}
+	files, err := hashRelease(dir, paths, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &ReleaseManifest{Version: releaseManifestVersion, Created: time.Now().UTC().Truncate(time.Second), Files: files}, nil
+}
+
+func (m *ReleaseManifest) signedBytes() ([]byte, error) {
+	unsigned := *m
+	unsigned.Signature = ""
+	return json.Marshal(unsigned)
+}
+
+// Sign signs m with key, whose cert is chain[0], as SignDetached does.
+func (m *ReleaseManifest) Sign(key crypto.Signer, chain []*x509.Certificate) error {
+	data, err := m.signedBytes()
+	if err != nil {
+		return err
+	}
+	s, err := SignDetached(strings.NewReader(string(data)), key, chain, crypto.SHA256, m.Created)
+	if err != nil {
+		return err
+	}
+	sig, err := s.Marshal()
+	if err != nil {
+		return err
+	}
+	m.Signature = string(sig)
+	return nil
+}
+
+// Verify checks m's signature and returns it, so the caller can decide
+// whether to trust the signer. It says nothing about the files.
+func (m *ReleaseManifest) Verify() (*DetachedSignature, error) {
+	if m.Version != releaseManifestVersion {
+		return nil, fmt.Errorf("unsupported release manifest version %d", m.Version)
+	}
+	if m.Signature == "" {
+		return nil, errors.New("release manifest is not signed")
+	}
+	s, err := ParseDetachedSignature([]byte(m.Signature))
+	if err != nil {
+		return nil, err
+	}
+	data, err := m.signedBytes()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Verify(strings.NewReader(string(data))); err != nil {
+		return nil, fmt.Errorf("release manifest: %s", err)
+	}
+	return s, nil
+}
+
+// ReadReleaseManifest reads a manifest from a JSON file.
+func ReadReleaseManifest(path string) (*ReleaseManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &ReleaseManifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("invalid release manifest: %s", err)
+	}
+	return m, nil
+}
+
+// Write writes m to a JSON file.
+func (m *ReleaseManifest) Write(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// ReleaseReport is what VerifyRelease found wrong with a release directory.
+type ReleaseReport struct {
+	Missing    []string // listed, but not there
+	Modified   []string // there, but different
+	Unexpected []string // there, but not listed
+}
+
+// OK reports whether the release matched its manifest.
+func (r *ReleaseReport) OK() bool {
+	return len(r.Missing)+len(r.Modified)+len(r.Unexpected) == 0
+}
+
+// VerifyRelease checks every file under dir against m, hashing across
+// workers goroutines (GOMAXPROCS if zero). It doesn't check m's signature;
+// call m.Verify first.
+func VerifyRelease(dir string, m *ReleaseManifest, workers int) (*ReleaseReport, error) {
+	listed := make(map[string]ReleaseFile)
+	for _, f := range m.Files {
+		if err := checkReleasePath(f.Path); err != nil {
+			return nil, err
+		}
+		listed[f.Path] = f
+	}
+	found, err := scanRelease(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &ReleaseReport{}
+	onDisk := make(map[string]bool)
+	var check []string
+	for _, p := range found {
+		onDisk[p] = true
+		if _, ok := listed[p]; ok {
+			check = append(check, p)
+		} else {
+			r.Unexpected = append(r.Unexpected, p)
+		}
+	}
+	for _, f := range m.Files {
+		if !onDisk[f.Path] {
+			r.Missing = append(r.Missing, f.Path)
+		}
+	}
+	sort.Strings(r.Missing)
+
+	files, err := hashRelease(dir, check, workers)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if want := listed[f.Path]; want.SHA256 != f.SHA256 || want.Size != f.Size {
+			r.Modified = append(r.Modified, f.Path)
+		}
+	}
+	return r, nil
+}
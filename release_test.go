@@ -0,0 +1,96 @@
+package enough
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReleaseManifest(t *testing.T) {
+	t.Parallel()
+	ca, err := NewCAWithOptions("TestCerts", &CAOptions{Rand: seededRand(46), Clock: testClock})
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	signer, err := ca.CreateCodeSigningCert("releases")
+	if err != nil {
+		t.Fatalf("unable to create code signing cert: %s", err)
+	}
+
+	dir := t.TempDir()
+	write := func(name, data string) {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		write(fmt.Sprintf("bin/tool%d", i), fmt.Sprintf("tool %d", i))
+	}
+	write("README", "read me")
+	write(ReleaseTimestampFile, "not listed")
+
+	m, err := NewReleaseManifest(dir)
+	if err != nil {
+		t.Fatalf("failed to make manifest: %s", err)
+	}
+	if len(m.Files) != 21 {
+		t.Fatalf("expected 21 files, got %d", len(m.Files))
+	}
+	if err := m.Sign(signer.PrivateKey, []*x509.Certificate{&signer.Certificate}); err != nil {
+		t.Fatalf("failed to sign manifest: %s", err)
+	}
+	path := filepath.Join(dir, ReleaseManifestFile)
+	if err := m.Write(path); err != nil {
+		t.Fatalf("failed to write manifest: %s", err)
+	}
+
+	back, err := ReadReleaseManifest(path)
+	if err != nil {
+		t.Fatalf("failed to read manifest: %s", err)
+	}
+	s, err := back.Verify()
+	if err != nil {
+		t.Fatalf("failed to verify manifest: %s", err)
+	}
+	if !s.Signer().Equal(&signer.Certificate) {
+		t.Errorf("manifest signed by %s", s.Signer().Subject.CommonName)
+	}
+	r, err := VerifyRelease(dir, back, 4)
+	if err != nil {
+		t.Fatalf("failed to verify release: %s", err)
+	}
+	if !r.OK() {
+		t.Errorf("fresh release does not verify: %+v", r)
+	}
+
+	os.Remove(filepath.Join(dir, "bin", "tool3"))
+	write("bin/tool7", "tool 7, but evil")
+	write("bin/extra", "surprise")
+	r, err = VerifyRelease(dir, back, 4)
+	if err != nil {
+		t.Fatalf("failed to verify release: %s", err)
+	}
+	want := &ReleaseReport{
+		Missing:    []string{"bin/tool3"},
+		Modified:   []string{"bin/tool7"},
+		Unexpected: []string{"bin/extra"},
+	}
+	if !reflect.DeepEqual(r, want) {
+		t.Errorf("got report %+v, want %+v", r, want)
+	}
+
+	// the manifest can't be edited to match
+	back.Files = back.Files[1:]
+	if _, err := back.Verify(); err == nil {
+		t.Error("verified an edited manifest")
+	}
+	back.Files = append(back.Files, ReleaseFile{Path: "../etc/passwd"})
+	if _, err := VerifyRelease(dir, back, 4); err == nil {
+		t.Error("accepted a path outside the release")
+	}
+}
@@ -0,0 +1,41 @@
+package enough
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// CheckRevoked returns these, wrapped with the details, so use errors.Is.
+var (
+	ErrRevoked = errors.New("revoked")
+	ErrCRL     = errors.New("CRL can't be used")
+)
+
+// CheckRevoked checks the leaf of chain (leaf first, as x509 Verify
+// returns it) against list, which must be signed by the leaf's issuer,
+// chain[1]. A CRL from any other CA in the chain says nothing about the
+// leaf, so it's ErrCRL rather than a pass. To check an intermediate too,
+// check chain[1:] against its issuer's CRL. Given a non-zero asOf, only
+// revocations up to then count, so eg a timestamped signature made before
+// its signer was revoked still passes. Either way list has to be current at
+// now.
+func CheckRevoked(chain []*x509.Certificate, list *x509.RevocationList, now, asOf time.Time) error {
+	if len(chain) == 0 {
+		return errors.New("no certs to check")
+	}
+	leaf := chain[0]
+	if len(chain) < 2 || list.CheckSignatureFrom(chain[1]) != nil {
+		return fmt.Errorf("%w: not signed by the issuer of %s", ErrCRL, leaf.Subject.CommonName)
+	}
+	if !list.NextUpdate.IsZero() && now.After(list.NextUpdate) {
+		return fmt.Errorf("%w: out of date, next update was due %s", ErrCRL, list.NextUpdate.Format(time.RFC3339))
+	}
+	for _, r := range list.RevokedCertificateEntries {
+		if r.SerialNumber.Cmp(leaf.SerialNumber) == 0 && (asOf.IsZero() || !r.RevocationTime.After(asOf)) {
+			return fmt.Errorf("%s (serial %x) was %w at %s", leaf.Subject.CommonName, leaf.SerialNumber, ErrRevoked, r.RevocationTime.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package enough
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestCheckRevoked(t *testing.T) {
+	t.Parallel()
+	ca, err := NewCA("testing")
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	sub, err := ca.CreateIntermediateCA("sub", nil)
+	if err != nil {
+		t.Fatalf("failed to create intermediate CA: %s", err)
+	}
+	c, _ := sub.CreateClientCert(0)
+	chain := []*x509.Certificate{&c.Certificate, &sub.Raw.Certificate, &ca.Raw.Certificate}
+
+	now := time.Now()
+	revoked := now.Add(-time.Hour)
+	crl := func(issuer *CA, serial *big.Int) *x509.RevocationList {
+		tmpl := &x509.RevocationList{Number: big.NewInt(1), ThisUpdate: now, NextUpdate: now.Add(time.Hour)}
+		if serial != nil {
+			tmpl.RevokedCertificateEntries = []x509.RevocationListEntry{{SerialNumber: serial, RevocationTime: revoked}}
+		}
+		der, err := x509.CreateRevocationList(rand.Reader, tmpl, &issuer.Raw.Certificate, issuer.Raw.PrivateKey)
+		if err != nil {
+			t.Fatalf("failed to create CRL: %s", err)
+		}
+		list, _ := x509.ParseRevocationList(der)
+		return list
+	}
+
+	if err := CheckRevoked(chain, crl(sub, nil), now, time.Time{}); err != nil {
+		t.Errorf("empty CRL: %s", err)
+	}
+	leaf := crl(sub, c.Certificate.SerialNumber)
+	if err := CheckRevoked(chain, leaf, now, time.Time{}); !errors.Is(err, ErrRevoked) {
+		t.Errorf("revoked leaf: got %v", err)
+	}
+	if err := CheckRevoked(chain, leaf, now, revoked.Add(-time.Minute)); err != nil {
+		t.Errorf("revoked after asOf: %s", err)
+	}
+	// the root's CRL covers the intermediate, not the leaf
+	rootCRL := crl(ca, sub.Raw.Certificate.SerialNumber)
+	if err := CheckRevoked(chain, rootCRL, now, time.Time{}); !errors.Is(err, ErrCRL) {
+		t.Errorf("CRL from the root for a leaf of the intermediate: got %v", err)
+	}
+	if err := CheckRevoked(chain, crl(ca, c.Certificate.SerialNumber), now, time.Time{}); !errors.Is(err, ErrCRL) {
+		t.Errorf("leaf revoked by the wrong CA: got %v", err)
+	}
+	if err := CheckRevoked(chain[1:], rootCRL, now, time.Time{}); !errors.Is(err, ErrRevoked) {
+		t.Errorf("revoked intermediate: got %v", err)
+	}
+	if err := CheckRevoked(chain[2:], rootCRL, now, time.Time{}); !errors.Is(err, ErrCRL) {
+		t.Errorf("CRL for the root itself: got %v", err)
+	}
+	if err := CheckRevoked(chain, crl(sub, nil), now.Add(2*time.Hour), time.Time{}); !errors.Is(err, ErrCRL) {
+		t.Errorf("stale CRL: got %v", err)
+	}
+	other, _ := NewCA("other")
+	if err := CheckRevoked(chain, crl(other, c.Certificate.SerialNumber), now, time.Time{}); !errors.Is(err, ErrCRL) {
+		t.Errorf("CRL from another park: got %v", err)
+	}
+}
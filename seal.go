@@ -0,0 +1,249 @@
+package enough
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// Everything sealed by this package uses the same construction: an ephemeral
+// P-256 key, ECDH with the recipient's key, HKDF-SHA256 over the shared
+// secret and AES-256-GCM. The info string binds the derived key to its use.
+
+const sealedBundleInfo = "enough sealed bundle v1"
+
+type sealedBox struct {
+	Ephemeral  []byte // uncompressed point
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+func boxKey(shared, ephemeral, recipient []byte, info string) ([]byte, error) {
+	salt := append(append([]byte{}, ephemeral...), recipient...)
+	return hkdf.Key(sha256.New, shared, salt, info, 32)
+}
+
+func sealTo(pub *ecdsa.PublicKey, plaintext, aad []byte, info string) (box sealedBox, e error) {
+	recipient, e := pub.ECDH()
+	if e != nil {
+		return
+	}
+	eph, e := recipient.Curve().GenerateKey(rand.Reader)
+	if e != nil {
+		return
+	}
+	shared, e := eph.ECDH(recipient)
+	if e != nil {
+		return
+	}
+	box.Ephemeral = eph.PublicKey().Bytes()
+	key, e := boxKey(shared, box.Ephemeral, recipient.Bytes(), info)
+	if e != nil {
+		return
+	}
+	gcm, e := newGCM(key)
+	if e != nil {
+		return
+	}
+	box.Nonce = make([]byte, gcm.NonceSize())
+	if _, e = rand.Read(box.Nonce); e != nil {
+		return
+	}
+	box.Ciphertext = gcm.Seal(nil, box.Nonce, plaintext, aad)
+	return
+}
+
+func openWith(priv *ecdsa.PrivateKey, box sealedBox, aad []byte, info string) ([]byte, error) {
+	key, err := priv.ECDH()
+	if err != nil {
+		return nil, err
+	}
+	eph, err := key.Curve().NewPublicKey(box.Ephemeral)
+	if err != nil {
+		return nil, fmt.Errorf("bad ephemeral key: %s", err)
+	}
+	shared, err := key.ECDH(eph)
+	if err != nil {
+		return nil, err
+	}
+	aesKey, err := boxKey(shared, box.Ephemeral, key.PublicKey().Bytes(), info)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(box.Nonce) != gcm.NonceSize() {
+		return nil, errors.New("bad nonce length")
+	}
+	plaintext, err := gcm.Open(nil, box.Nonce, box.Ciphertext, aad)
+	if err != nil {
+		return nil, errors.New("decryption failed: wrong key or corrupted data")
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// GenerateRecipientKey makes a fresh P-256 key that a host can publish so
+// that bundles can be sealed to it.
+func GenerateRecipientKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// MarshalPublicKey returns pub as a PKIX "PUBLIC KEY" PEM block.
+func MarshalPublicKey(pub *ecdsa.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// ParsePublicKeyPEM parses an ECDSA "PUBLIC KEY" PEM block.
+func ParsePublicKeyPEM(data []byte) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("invalid public key PEM")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecPub, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not ECDSA")
+	}
+	return ecPub, nil
+}
+
+// ParsePrivateKeyPEM parses an "EC PRIVATE KEY" PEM block as written by
+// MarshalPrivateKey.
+func ParsePrivateKeyPEM(data []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "EC PRIVATE KEY" {
+		return nil, errors.New("invalid private key PEM")
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+type sealedBundleTBS struct {
+	Version   int
+	Recipient []byte // SHA-256 of the recipient's PKIX public key
+	Issuer    []byte // SHA-256 of the CA cert
+	Box       sealedBox
+}
+
+type sealedBundle struct {
+	TBS       []byte // DER sealedBundleTBS
+	Signature []byte // ECDSA-SHA256 by the CA key over TBS
+}
+
+func pubKeyID(pub *ecdsa.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+	return sum[:], nil
+}
+
+// SealBundle encrypts a bundle archive so that only the holder of the private
+// half of recipient can open it, and signs the result with the CA key so the
+// recipient can tell it came from this park. The result is PEM.
+func (ca *CA) SealBundle(archive []byte, recipient *ecdsa.PublicKey) (sealed []byte, e error) {
+	rid, e := pubKeyID(recipient)
+	if e != nil {
+		return
+	}
+	issuer := sha256.Sum256(ca.Raw.Certificate.Raw)
+	tbs := sealedBundleTBS{Version: 1, Recipient: rid, Issuer: issuer[:]}
+
+	// The recipient and issuer are bound into the ciphertext too, so a box
+	// can't be lifted into a differently-addressed envelope.
+	aad := append(append([]byte{}, rid...), issuer[:]...)
+	if tbs.Box, e = sealTo(recipient, archive, aad, sealedBundleInfo); e != nil {
+		return
+	}
+
+	der, e := asn1.Marshal(tbs)
+	if e != nil {
+		return
+	}
+	digest := sha256.Sum256(der)
+	key, e := ca.signer()
+	if e != nil {
+		return
+	}
+	sig, e := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if e != nil {
+		return
+	}
+	outer, e := asn1.Marshal(sealedBundle{TBS: der, Signature: sig})
+	if e != nil {
+		return
+	}
+	sealed = pem.EncodeToMemory(&pem.Block{Type: "ENOUGH SEALED BUNDLE", Bytes: outer})
+	return
+}
+
+// OpenSealedBundle checks that sealed was signed by caCert's key and
+// addressed to key, and returns the bundle archive inside.
+func OpenSealedBundle(sealed []byte, key *ecdsa.PrivateKey, caCert *x509.Certificate) ([]byte, error) {
+	block, _ := pem.Decode(sealed)
+	if block == nil || block.Type != "ENOUGH SEALED BUNDLE" {
+		return nil, errors.New("invalid sealed bundle PEM")
+	}
+	var outer sealedBundle
+	if rest, err := asn1.Unmarshal(block.Bytes, &outer); err != nil || len(rest) != 0 {
+		return nil, errors.New("invalid sealed bundle data")
+	}
+
+	caPub, ok := caCert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("CA key is not ECDSA")
+	}
+	digest := sha256.Sum256(outer.TBS)
+	if !ecdsa.VerifyASN1(caPub, digest[:], outer.Signature) {
+		return nil, errors.New("sealed bundle not signed by this CA")
+	}
+
+	var tbs sealedBundleTBS
+	if rest, err := asn1.Unmarshal(outer.TBS, &tbs); err != nil || len(rest) != 0 {
+		return nil, errors.New("invalid sealed bundle data")
+	}
+	if tbs.Version != 1 {
+		return nil, fmt.Errorf("unsupported sealed bundle version %d", tbs.Version)
+	}
+	issuer := sha256.Sum256(caCert.Raw)
+	if string(tbs.Issuer) != string(issuer[:]) {
+		return nil, errors.New("sealed bundle names a different issuer")
+	}
+	rid, err := pubKeyID(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if string(tbs.Recipient) != string(rid) {
+		return nil, errors.New("sealed bundle is addressed to a different key")
+	}
+
+	aad := append(append([]byte{}, rid...), issuer[:]...)
+	return openWith(key, tbs.Box, aad, sealedBundleInfo)
+}
@@ -0,0 +1,70 @@
+package enough
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSealBundle(t *testing.T) {
+	t.Parallel()
+	ca, err := NewCA("testing")
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	recipient, err := GenerateRecipientKey()
+	if err != nil {
+		t.Fatalf("failed to create recipient key: %s", err)
+	}
+	archive := []byte("not really a tarball")
+
+	sealed, err := ca.SealBundle(archive, &recipient.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to seal: %s", err)
+	}
+	if bytes.Contains(sealed, archive) {
+		t.Error("sealed bundle contains plaintext")
+	}
+
+	opened, err := OpenSealedBundle(sealed, recipient, &ca.Raw.Certificate)
+	if err != nil {
+		t.Fatalf("failed to open: %s", err)
+	}
+	if !bytes.Equal(opened, archive) {
+		t.Error("archive changed in seal roundtrip")
+	}
+
+	other, err := GenerateRecipientKey()
+	if err != nil {
+		t.Fatalf("failed to create recipient key: %s", err)
+	}
+	if _, err := OpenSealedBundle(sealed, other, &ca.Raw.Certificate); err == nil {
+		t.Error("opened bundle with the wrong recipient key")
+	}
+
+	otherCA, err := NewCA("other")
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	if _, err := OpenSealedBundle(sealed, recipient, &otherCA.Raw.Certificate); err == nil {
+		t.Error("accepted bundle signed by a different CA")
+	}
+}
+
+func TestPublicKeyPEMRoundtrip(t *testing.T) {
+	t.Parallel()
+	key, err := GenerateRecipientKey()
+	if err != nil {
+		t.Fatalf("failed to create key: %s", err)
+	}
+	pemBytes, err := MarshalPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to marshal: %s", err)
+	}
+	pub, err := ParsePublicKeyPEM(pemBytes)
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	if !pub.Equal(&key.PublicKey) {
+		t.Error("public key changed in roundtrip")
+	}
+}
@@ -0,0 +1,204 @@
+package enough
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// A sealed file is arbitrary data (a config blob, some secrets) encrypted to
+// one park member's cert key, so only whoever holds that member's key file
+// can read it. It's sealed as bundles are, but needn't come from the CA:
+//
+//	SealedFile ::= SEQUENCE {
+//	    tbs        OCTET STRING,  -- DER SealedFileTBS
+//	    sender     [0] EXPLICIT OCTET STRING OPTIONAL,  -- sender cert, DER
+//	    signature  [1] EXPLICIT OCTET STRING OPTIONAL } -- ECDSA-SHA256 over tbs
+//
+//	SealedFileTBS ::= SEQUENCE {
+//	    version    INTEGER (1),
+//	    recipient  OCTET STRING,  -- SHA-256 of recipient's PKIX public key
+//	    sender     [0] EXPLICIT OCTET STRING OPTIONAL,  -- SHA-256 of sender cert
+//	    box        SealedBox }
+//
+// recipient || sender is the AEAD additional data, so a signature can't be
+// stripped or swapped without breaking the box.
+
+// SealedFilePEMType is the PEM block type of a sealed file.
+const SealedFilePEMType = "ENOUGH SEALED FILE"
+
+const sealedFileInfo = "enough sealed file v1"
+
+type sealedFileTBS struct {
+	Version   int
+	Recipient []byte
+	Sender    []byte `asn1:"optional,explicit,tag:0"`
+	Box       sealedBox
+}
+
+type sealedFile struct {
+	TBS       []byte
+	Sender    []byte `asn1:"optional,explicit,tag:0"`
+	Signature []byte `asn1:"optional,explicit,tag:1"`
+}
+
+// SealFile encrypts data so that only the holder of recipient's private key
+// can open it. If sender is set, the file is also signed with its key, so
+// the recipient can tell which park member sent it. The result is PEM.
+func SealFile(data []byte, recipient *x509.Certificate, sender *RawCert) (sealed []byte, e error) {
+	pub, ok := recipient.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		e = errors.New("recipient key is not ECDSA")
+		return
+	}
+	rid, e := pubKeyID(pub)
+	if e != nil {
+		return
+	}
+	tbs := sealedFileTBS{Version: 1, Recipient: rid}
+	if sender != nil {
+		if sender.PrivateKey == nil {
+			e = errors.New("sender has no private key to sign with")
+			return
+		}
+		if !sender.PrivateKey.PublicKey.Equal(sender.Certificate.PublicKey) {
+			e = errors.New("sender key does not match sender cert")
+			return
+		}
+		sum := sha256.Sum256(sender.Certificate.Raw)
+		tbs.Sender = sum[:]
+	}
+	aad := append(append([]byte{}, rid...), tbs.Sender...)
+	if tbs.Box, e = sealTo(pub, data, aad, sealedFileInfo); e != nil {
+		return
+	}
+
+	der, e := asn1.Marshal(tbs)
+	if e != nil {
+		return
+	}
+	outer := sealedFile{TBS: der}
+	if sender != nil {
+		digest := sha256.Sum256(der)
+		if outer.Signature, e = ecdsa.SignASN1(rand.Reader, sender.PrivateKey, digest[:]); e != nil {
+			return
+		}
+		outer.Sender = sender.Certificate.Raw
+	}
+	raw, e := asn1.Marshal(outer)
+	if e != nil {
+		return
+	}
+	sealed = pem.EncodeToMemory(&pem.Block{Type: SealedFilePEMType, Bytes: raw})
+	return
+}
+
+// OpenSealedFile decrypts sealed with key, the recipient's private key. If
+// the file was signed, the sender cert must be a member cert issued by
+// caCert, not revoked in crl if that is set, and is returned; an anonymous
+// file returns a nil sender, so callers that care who sent it must check.
+func OpenSealedFile(sealed []byte, key *ecdsa.PrivateKey, caCert *x509.Certificate, crl *x509.RevocationList) (data []byte, sender *x509.Certificate, e error) {
+	block, _ := pem.Decode(sealed)
+	if block == nil || block.Type != SealedFilePEMType {
+		e = errors.New("invalid sealed file PEM")
+		return
+	}
+	var outer sealedFile
+	if rest, err := asn1.Unmarshal(block.Bytes, &outer); err != nil || len(rest) != 0 {
+		e = errors.New("invalid sealed file data")
+		return
+	}
+	var tbs sealedFileTBS
+	if rest, err := asn1.Unmarshal(outer.TBS, &tbs); err != nil || len(rest) != 0 {
+		e = errors.New("invalid sealed file data")
+		return
+	}
+	if tbs.Version != 1 {
+		e = fmt.Errorf("unsupported sealed file version %d", tbs.Version)
+		return
+	}
+	rid, e := pubKeyID(&key.PublicKey)
+	if e != nil {
+		return
+	}
+	if string(tbs.Recipient) != string(rid) {
+		e = errors.New("sealed file is addressed to a different key")
+		return
+	}
+
+	if len(tbs.Sender) != 0 {
+		if sender, e = checkFileSender(&outer, tbs.Sender, caCert, crl); e != nil {
+			return
+		}
+	} else if len(outer.Sender) != 0 || len(outer.Signature) != 0 {
+		e = errors.New("sealed file has a signature but names no sender")
+		return
+	}
+
+	aad := append(append([]byte{}, rid...), tbs.Sender...)
+	data, e = openWith(key, tbs.Box, aad, sealedFileInfo)
+	return
+}
+
+// checkFileSender checks outer is signed by the cert named in its TBS, and
+// that it's a member of caCert's park in good standing.
+func checkFileSender(outer *sealedFile, senderID []byte, caCert *x509.Certificate, crl *x509.RevocationList) (*x509.Certificate, error) {
+	if caCert == nil {
+		return nil, errors.New("sealed file is signed, the park CA cert is needed to check it")
+	}
+	sender, err := x509.ParseCertificate(outer.Sender)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender cert: %s", err)
+	}
+	if sum := sha256.Sum256(sender.Raw); string(sum[:]) != string(senderID) {
+		return nil, errors.New("sealed file is signed by a different sender")
+	}
+	pub, ok := sender.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("sender key is not ECDSA")
+	}
+	digest := sha256.Sum256(outer.TBS)
+	if !ecdsa.VerifyASN1(pub, digest[:], outer.Signature) {
+		return nil, errors.New("bad sender signature")
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	now := time.Now()
+	chains, err := verifyMember(sender, x509.VerifyOptions{Roots: roots, CurrentTime: now})
+	if err != nil {
+		return nil, fmt.Errorf("sender %s is not in this park: %s", sender.Subject.CommonName, err)
+	}
+	if crl != nil {
+		if err := CheckRevoked(chains[0], crl, now, time.Time{}); err != nil {
+			return nil, err
+		}
+	}
+	return sender, nil
+}
+
+// memberUsages are the extended key usages of a park member's own cert.
+var memberUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth}
+
+// verifyMember is cert.Verify(opts) for a park member speaking for itself:
+// a client or server, not a CA, code signer or TSA, whose certs vouch for
+// other things.
+func verifyMember(cert *x509.Certificate, opts x509.VerifyOptions) ([][]*x509.Certificate, error) {
+	if cert.IsCA {
+		return nil, errors.New("a CA cert is not a member")
+	}
+	// Verify lets a cert without any EKUs through for anything
+	if len(cert.ExtKeyUsage) == 0 {
+		return nil, errors.New("cert has no extended key usages")
+	}
+	if info, err := ParkInfoFromCert(cert); err == nil && info.Role != RoleClient && info.Role != RoleServer {
+		return nil, fmt.Errorf("a %s cert is not a member", info.Role)
+	}
+	opts.KeyUsages = memberUsages
+	return cert.Verify(opts)
+}
@@ -0,0 +1,115 @@
+package enough
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestSealFile(t *testing.T) {
+	t.Parallel()
+	ca, err := NewCA("testing")
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	to, _ := ca.CreateClientCert(0)
+	from, _ := ca.CreateClientCert(1)
+	secrets := []byte("password=hunter2")
+
+	sealed, err := SealFile(secrets, &to.Certificate, nil)
+	if err != nil {
+		t.Fatalf("failed to seal: %s", err)
+	}
+	if bytes.Contains(sealed, secrets) {
+		t.Error("sealed file contains plaintext")
+	}
+	opened, sender, err := OpenSealedFile(sealed, to.PrivateKey, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to open: %s", err)
+	}
+	if !bytes.Equal(opened, secrets) || sender != nil {
+		t.Errorf("anonymous roundtrip gave %q from %v", opened, sender)
+	}
+	if _, _, err := OpenSealedFile(sealed, from.PrivateKey, nil, nil); err == nil {
+		t.Error("opened file with the wrong key")
+	}
+
+	signed, err := SealFile(secrets, &to.Certificate, from)
+	if err != nil {
+		t.Fatalf("failed to seal: %s", err)
+	}
+	opened, sender, err = OpenSealedFile(signed, to.PrivateKey, &ca.Raw.Certificate, nil)
+	if err != nil {
+		t.Fatalf("failed to open signed file: %s", err)
+	}
+	if !bytes.Equal(opened, secrets) || sender == nil || !sender.Equal(&from.Certificate) {
+		t.Errorf("signed roundtrip gave %q from %v", opened, sender)
+	}
+	if _, _, err := OpenSealedFile(signed, to.PrivateKey, nil, nil); err == nil {
+		t.Error("opened signed file without checking the sender")
+	}
+
+	otherCA, _ := NewCA("other")
+	if _, _, err := OpenSealedFile(signed, to.PrivateKey, &otherCA.Raw.Certificate, nil); err == nil {
+		t.Error("accepted a sender from another park")
+	}
+	outsider, _ := otherCA.CreateClientCert(0)
+	bad, _ := SealFile(secrets, &to.Certificate, outsider)
+	if _, _, err := OpenSealedFile(bad, to.PrivateKey, &ca.Raw.Certificate, nil); err == nil {
+		t.Error("accepted a sender from another park")
+	}
+
+	if _, err := SealFile(secrets, &to.Certificate, &RawCert{Certificate: from.Certificate}); err == nil {
+		t.Error("sealed with a sender that has no key")
+	}
+
+	// only members can send, not certs that vouch for something else
+	signer, _ := ca.CreateCodeSigningCert("releases")
+	tsa, _ := ca.CreateTimestampingCert("tsa")
+	sub, _ := ca.CreateIntermediateCA("sub", nil)
+	for _, c := range []*RawCert{signer, tsa, &sub.Raw} {
+		bad, err := SealFile(secrets, &to.Certificate, c)
+		if err != nil {
+			t.Fatalf("failed to seal: %s", err)
+		}
+		if _, _, err := OpenSealedFile(bad, to.PrivateKey, &ca.Raw.Certificate, nil); err == nil {
+			t.Errorf("accepted %s as a sender", c.Certificate.Subject.CommonName)
+		}
+	}
+
+	// nor revoked ones
+	now := time.Now()
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{{SerialNumber: from.Certificate.SerialNumber, RevocationTime: now}},
+	}, &ca.Raw.Certificate, ca.Raw.PrivateKey)
+	if err != nil {
+		t.Fatalf("failed to create CRL: %s", err)
+	}
+	crl, _ := x509.ParseRevocationList(der)
+	if _, _, err := OpenSealedFile(signed, to.PrivateKey, &ca.Raw.Certificate, crl); !errors.Is(err, ErrRevoked) {
+		t.Errorf("revoked sender: got %v", err)
+	}
+
+	// stripping the signature leaves a box that won't open
+	block, _ := pem.Decode(signed)
+	var outer sealedFile
+	asn1.Unmarshal(block.Bytes, &outer)
+	var tbs sealedFileTBS
+	asn1.Unmarshal(outer.TBS, &tbs)
+	tbs.Sender = nil
+	stripped := sealedFile{}
+	stripped.TBS, _ = asn1.Marshal(tbs)
+	raw, _ := asn1.Marshal(stripped)
+	if _, _, err := OpenSealedFile(pem.EncodeToMemory(&pem.Block{Type: SealedFilePEMType, Bytes: raw}), to.PrivateKey, nil, nil); err == nil {
+		t.Error("opened a file with its signature stripped")
+	}
+}
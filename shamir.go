@@ -0,0 +1,230 @@
+package enough
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Shamir secret sharing over GF(2^8), byte by byte, with the AES field
+// polynomial x^8 + x^4 + x^3 + x + 1. Share i is the random polynomial of
+// degree threshold-1 evaluated at x = i; the secret is its value at 0.
+
+func gfMul(a, b byte) byte {
+	var p byte
+	for b != 0 {
+		if b&1 != 0 {
+			p ^= a
+		}
+		hi := a & 0x80
+		a <<= 1
+		if hi != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+	return p
+}
+
+func gfInv(a byte) byte {
+	// a^254 == a^-1 in GF(2^8)
+	r := byte(1)
+	for i := 0; i < 254; i++ {
+		r = gfMul(r, a)
+	}
+	return r
+}
+
+// SplitSecret splits secret into n shares, any threshold of which recover
+// it with CombineShares. Share i (1-based) is returned at index i-1, and its
+// first byte is its x coordinate.
+func SplitSecret(secret []byte, n, threshold int) ([][]byte, error) {
+	if threshold < 2 || threshold > n || n > 255 {
+		return nil, fmt.Errorf("need 2 <= threshold (%d) <= shares (%d) <= 255", threshold, n)
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("empty secret")
+	}
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][0] = byte(i + 1)
+	}
+	coeffs := make([]byte, threshold)
+	for j, s := range secret {
+		coeffs[0] = s
+		if _, err := rand.Read(coeffs[1:]); err != nil {
+			return nil, err
+		}
+		for i := range shares {
+			x := shares[i][0]
+			// Horner's rule
+			var y byte
+			for k := threshold - 1; k >= 0; k-- {
+				y = gfMul(y, x) ^ coeffs[k]
+			}
+			shares[i][j+1] = y
+		}
+	}
+	for i := range coeffs {
+		coeffs[i] = 0
+	}
+	return shares, nil
+}
+
+// CombineShares recovers a secret from shares made by SplitSecret. Given
+// fewer shares than the threshold it returns garbage, not an error, so
+// callers need some way to check the result.
+func CombineShares(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errors.New("need at least 2 shares")
+	}
+	size := len(shares[0])
+	seen := make(map[byte]bool)
+	for _, s := range shares {
+		if len(s) != size || size < 2 {
+			return nil, errors.New("shares are different lengths")
+		}
+		if s[0] == 0 || seen[s[0]] {
+			return nil, fmt.Errorf("bad or repeated share index %d", s[0])
+		}
+		seen[s[0]] = true
+	}
+
+	secret := make([]byte, size-1)
+	for i, si := range shares {
+		// Lagrange basis polynomial for share i, evaluated at 0. In
+		// GF(2^8) subtraction is xor.
+		basis := byte(1)
+		for j, sj := range shares {
+			if i == j {
+				continue
+			}
+			basis = gfMul(basis, gfMul(sj[0], gfInv(sj[0]^si[0])))
+		}
+		for k := range secret {
+			secret[k] ^= gfMul(basis, si[k+1])
+		}
+	}
+	return secret, nil
+}
+
+// KeyShare is one share of a split CA key.
+type KeyShare struct {
+	Threshold     int
+	Shares        int
+	CAFingerprint string // hex SHA-256 of the CA cert the key belongs to
+	Data          []byte // x coordinate, then the share bytes
+}
+
+const keySharePEMType = "ENOUGH CA KEY SHARE"
+
+// SplitKey splits the CA private key into n shares, any threshold of which
+// can rebuild it with RecoverCA.
+func (ca *CA) SplitKey(n, threshold int) ([]*KeyShare, error) {
+	if ca.Raw.PrivateKey == nil {
+		return nil, errors.New("CA private key is not in memory")
+	}
+	secret, err := ca.Raw.PrivateKey.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	parts, err := SplitSecret(secret, n, threshold)
+	for i := range secret {
+		secret[i] = 0
+	}
+	if err != nil {
+		return nil, err
+	}
+	fp := Fingerprint(&ca.Raw.Certificate)
+	shares := make([]*KeyShare, n)
+	for i, p := range parts {
+		shares[i] = &KeyShare{Threshold: threshold, Shares: n, CAFingerprint: fp, Data: p}
+	}
+	return shares, nil
+}
+
+// Index returns the share's number, from 1.
+func (ks *KeyShare) Index() int {
+	if len(ks.Data) == 0 {
+		return 0
+	}
+	return int(ks.Data[0])
+}
+
+// Marshal returns the share as PEM. The headers are informational, so
+// whoever holds a share knows what it is and how many are needed.
+func (ks *KeyShare) Marshal() []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type: keySharePEMType,
+		Headers: map[string]string{
+			"Share":          fmt.Sprintf("%d of %d", ks.Index(), ks.Shares),
+			"Threshold":      strconv.Itoa(ks.Threshold),
+			"CA-Fingerprint": ks.CAFingerprint,
+		},
+		Bytes: ks.Data,
+	})
+}
+
+// ParseKeyShare parses a share written by Marshal.
+func ParseKeyShare(data []byte) (*KeyShare, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != keySharePEMType {
+		return nil, errors.New("invalid key share PEM")
+	}
+	ks := &KeyShare{CAFingerprint: block.Headers["CA-Fingerprint"], Data: block.Bytes}
+	var err error
+	if ks.Threshold, err = strconv.Atoi(block.Headers["Threshold"]); err != nil {
+		return nil, errors.New("key share has no threshold")
+	}
+	var index int
+	if _, err := fmt.Sscanf(block.Headers["Share"], "%d of %d", &index, &ks.Shares); err != nil {
+		return nil, errors.New("key share has no share count")
+	}
+	if index != ks.Index() {
+		return nil, errors.New("key share header does not match its data")
+	}
+	return ks, nil
+}
+
+// RecoverCA rebuilds a CA from its cert and at least threshold shares of its
+// key, and checks that the recovered key matches the cert.
+func RecoverCA(certPemData []byte, shares []*KeyShare) (*CA, error) {
+	cert, err := parseCertPEM(certPemData)
+	if err != nil {
+		return nil, err
+	}
+	fp := Fingerprint(cert)
+	parts := make([][]byte, len(shares))
+	for i, ks := range shares {
+		if ks.CAFingerprint != fp {
+			return nil, fmt.Errorf("share %d is for a different CA", ks.Index())
+		}
+		parts[i] = ks.Data
+	}
+	if len(shares) > 0 && len(shares) < shares[0].Threshold {
+		return nil, fmt.Errorf("need %d shares, have %d", shares[0].Threshold, len(shares))
+	}
+
+	secret, err := CombineShares(parts)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.ParseRawPrivateKey(elliptic.P256(), secret)
+	for i := range secret {
+		secret[i] = 0
+	}
+	if err != nil || !key.PublicKey.Equal(cert.PublicKey) {
+		return nil, errors.New("recovered key does not match the CA cert: wrong or corrupt shares")
+	}
+
+	ca := &CA{Raw: RawCert{Certificate: *cert, PrivateKey: key}}
+	if err := ca.loadParkInfo(); err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
@@ -0,0 +1,80 @@
+package enough
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSplitCombine(t *testing.T) {
+	t.Parallel()
+	secret := []byte("the quick brown fox jumps over the lazy dog")
+	shares, err := SplitSecret(secret, 5, 3)
+	if err != nil {
+		t.Fatalf("failed to split: %s", err)
+	}
+	// every 3-subset recovers the secret
+	for a := 0; a < 5; a++ {
+		for b := a + 1; b < 5; b++ {
+			for c := b + 1; c < 5; c++ {
+				got, err := CombineShares([][]byte{shares[a], shares[b], shares[c]})
+				if err != nil {
+					t.Fatalf("failed to combine: %s", err)
+				}
+				if !bytes.Equal(got, secret) {
+					t.Errorf("shares %d,%d,%d recovered the wrong secret", a, b, c)
+				}
+			}
+		}
+	}
+	got, err := CombineShares([][]byte{shares[0], shares[4]})
+	if err != nil {
+		t.Fatalf("failed to combine: %s", err)
+	}
+	if bytes.Equal(got, secret) {
+		t.Error("recovered the secret from fewer than threshold shares")
+	}
+	if _, err := CombineShares([][]byte{shares[0], shares[0]}); err == nil {
+		t.Error("combined a repeated share")
+	}
+}
+
+func TestRecoverCA(t *testing.T) {
+	t.Parallel()
+	ca, err := NewCA("testing")
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	shares, err := ca.SplitKey(4, 2)
+	if err != nil {
+		t.Fatalf("failed to split key: %s", err)
+	}
+	// through PEM and back, as tlspark does
+	parsed := []*KeyShare{}
+	for _, i := range []int{3, 1} {
+		ks, err := ParseKeyShare(shares[i].Marshal())
+		if err != nil {
+			t.Fatalf("failed to parse share: %s", err)
+		}
+		parsed = append(parsed, ks)
+	}
+	pemCert, _ := ca.Raw.MarshalCertificate()
+	recovered, err := RecoverCA(pemCert, parsed)
+	if err != nil {
+		t.Fatalf("failed to recover CA: %s", err)
+	}
+	if !recovered.Raw.PrivateKey.Equal(ca.Raw.PrivateKey) || recovered.ParkID != ca.ParkID {
+		t.Error("recovered a different CA")
+	}
+	if _, err := RecoverCA(pemCert, parsed[:1]); err == nil {
+		t.Error("recovered from a single share")
+	}
+
+	other, err := NewCA("other")
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	otherCert, _ := other.Raw.MarshalCertificate()
+	if _, err := RecoverCA(otherCert, parsed); err == nil {
+		t.Error("recovered shares against the wrong CA cert")
+	}
+}
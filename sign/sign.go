@@ -0,0 +1,422 @@
+// Package sign signs files with park code signing certs, and checks them,
+// as sign_ecdsa and verify_ecdsa do. It's for services that need to verify
+// updates themselves: nothing here logs or exits, and every way a
+// verification can fail has its own error, so callers can tell a corrupt
+// download from a rogue signer.
+package sign
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/bnagy/enough"
+	"io"
+	"time"
+)
+
+// Verify and VerifyRelease return these, wrapped with the details, so use
+// errors.Is. Anything else means the inputs couldn't be used at all, eg a
+// malformed signature or inconsistent options.
+var (
+	ErrSignature = errors.New("signature does not verify")
+	ErrUntrusted = errors.New("signer is not trusted")
+	ErrExpired   = errors.New("signer is not valid")
+	ErrPurpose   = errors.New("signer may not sign code")
+	ErrRevoked   = enough.ErrRevoked
+	ErrCRL       = enough.ErrCRL
+	ErrTimestamp = errors.New("timestamp is not valid")
+)
+
+// Signer is a code signing key and its cert chain, key's cert first.
+type Signer struct {
+	Key   crypto.Signer
+	Chain []*x509.Certificate
+
+	// Hash is the digest to sign with, SHA-256 if zero.
+	Hash crypto.Hash
+
+	// Clock, if set, replaces time.Now for the signing time.
+	Clock func() time.Time
+}
+
+// isCodeSigning reports whether c has the code signing extended key usage.
+// x509 Verify lets a cert with no EKU at all do anything, so chain checks
+// aren't enough on their own.
+func isCodeSigning(c *x509.Certificate) bool {
+	for _, u := range c.ExtKeyUsage {
+		if u == x509.ExtKeyUsageCodeSigning {
+			return true
+		}
+	}
+	return false
+}
+
+// NewSigner checks key is the key in chain[0], and that it's a code signing
+// cert, since Verify won't accept anything else.
+func NewSigner(key crypto.Signer, chain []*x509.Certificate) (*Signer, error) {
+	if len(chain) == 0 {
+		return nil, errors.New("no signer cert")
+	}
+	pub, ok := chain[0].PublicKey.(*ecdsa.PublicKey)
+	if !ok || !pub.Equal(key.Public()) {
+		return nil, errors.New("key does not match signer cert")
+	}
+	if !isCodeSigning(chain[0]) {
+		return nil, fmt.Errorf("%s is not a code signing cert", chain[0].Subject.CommonName)
+	}
+	return &Signer{Key: key, Chain: chain}, nil
+}
+
+// Sign reads r to the end and returns an "ENOUGH SIGNATURE" PEM over it.
+func Sign(r io.Reader, s *Signer) ([]byte, error) {
+	h := s.Hash
+	if h == 0 {
+		h = crypto.SHA256
+	}
+	now := time.Now
+	if s.Clock != nil {
+		now = s.Clock
+	}
+	d, err := enough.SignDetached(r, s.Key, s.Chain, h, now())
+	if err != nil {
+		return nil, err
+	}
+	return d.Marshal()
+}
+
+// VerifyOptions says what to trust. The zero value checks only that the
+// signature is good and the signer is a code signing cert, which anyone can
+// make; set Root.
+type VerifyOptions struct {
+	// Root is the park CA the signer must chain to.
+	Root *x509.Certificate
+
+	// CRL, if set, is checked for the signer and the TSA, so it must come
+	// from the CA that issued them. Needs Root.
+	CRL *x509.RevocationList
+
+	// Timestamp, if set, is an RFC 3161 reply over the signature bytes. Its
+	// TSA must chain to Root, and the signer is then checked as of the
+	// stamped time, not now, so the signature outlives the signer.
+	Timestamp []byte
+
+	// Intermediates go between a bare signature's cert and Root. An ENOUGH
+	// SIGNATURE carries its own.
+	Intermediates []*x509.Certificate
+
+	// PublicKey is a bare signer key, instead of a cert. For an ENOUGH
+	// SIGNATURE it only pins the signer, whose chain is checked as usual.
+	PublicKey *ecdsa.PublicKey
+
+	// TrustBareKey accepts a bare signature from PublicKey. Nothing says
+	// what that key is for or who it belongs to, so it can't be checked
+	// against Root or for code signing, and is refused without this.
+	TrustBareKey bool
+
+	// Format is a bare signature's encoding, enough.SigFormatAuto if empty.
+	// Anything else skips looking for an ENOUGH SIGNATURE.
+	Format string
+
+	// Hash is a bare signature's digest. If zero it's guessed from the
+	// signer cert's signature algorithm, or SHA-256 for a bare key.
+	Hash crypto.Hash
+
+	// Clock, if set, replaces time.Now for expiry and CRL freshness.
+	Clock func() time.Time
+}
+
+func (opts *VerifyOptions) now() time.Time {
+	if opts.Clock != nil {
+		return opts.Clock()
+	}
+	return time.Now()
+}
+
+// Result is what Verify found out about a good signature.
+type Result struct {
+	Signer      *x509.Certificate   // nil for a bare public key
+	Chain       []*x509.Certificate // up to Root, signer first, if Root was set
+	Hash        crypto.Hash
+	SigningTime time.Time         // the signer's claim, zero for a bare signature
+	Timestamp   *enough.Timestamp // if opts.Timestamp was set
+	Detached    bool              // sig was an ENOUGH SIGNATURE
+}
+
+// checkSigner validates the signer's chain up to opts.Root, as of at, for
+// code signing. It returns the chain, signer first.
+func checkSigner(certs []*x509.Certificate, opts *VerifyOptions, at time.Time) ([]*x509.Certificate, error) {
+	roots := x509.NewCertPool()
+	roots.AddCert(opts.Root)
+	inters := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		inters.AddCert(c)
+	}
+	chains, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: inters,
+		CurrentTime:   at,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+	if err != nil {
+		var invalid x509.CertificateInvalidError
+		if errors.As(err, &invalid) {
+			switch invalid.Reason {
+			case x509.Expired:
+				return nil, fmt.Errorf("%w at %s: %s", ErrExpired, at.Format(time.RFC3339), err)
+			case x509.IncompatibleUsage:
+				return nil, fmt.Errorf("%w: %s", ErrPurpose, err)
+			}
+		}
+		return nil, fmt.Errorf("%w: %s", ErrUntrusted, err)
+	}
+	return chains[0], nil
+}
+
+// checkPurpose insists on a code signing cert, with or without a Root, so a
+// TLS key can't sign releases.
+func checkPurpose(c *x509.Certificate) error {
+	if !isCodeSigning(c) {
+		return fmt.Errorf("%w: no code signing extended key usage", ErrPurpose)
+	}
+	if c.KeyUsage != 0 && c.KeyUsage&x509.KeyUsageDigitalSignature == 0 {
+		return fmt.Errorf("%w: key usage does not allow digital signatures", ErrPurpose)
+	}
+	return nil
+}
+
+// checkRevoked checks chain against opts.CRL. Given a stamped time, only
+// revocations up to then count, so a timestamped signature made before its
+// signer was revoked still verifies.
+func checkRevoked(chain []*x509.Certificate, opts *VerifyOptions, stamped time.Time) error {
+	return enough.CheckRevoked(chain, opts.CRL, opts.now(), stamped)
+}
+
+// checkTimestamp checks opts.Timestamp is over sig and comes from a TSA
+// that chains to opts.Root and hasn't been revoked at all. The stamp's own
+// time is no use there: a compromised TSA can stamp whatever time it likes,
+// including one before it was revoked.
+func checkTimestamp(sig []byte, opts *VerifyOptions) (*enough.Timestamp, error) {
+	ts, err := enough.ParseTimestampResponse(opts.Timestamp)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrTimestamp, err)
+	}
+	if err := ts.Covers(sig); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrTimestamp, err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(opts.Root)
+	inters := x509.NewCertPool()
+	for _, c := range ts.Certs {
+		inters.AddCert(c)
+	}
+	chains, err := ts.Signer.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: inters,
+		CurrentTime:   ts.Time,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: TSA %s is not trusted: %s", ErrTimestamp, ts.Signer.Subject.CommonName, err)
+	}
+	if opts.CRL != nil {
+		if err := checkRevoked(chains[0], opts, time.Time{}); err != nil {
+			return nil, err
+		}
+	}
+	return ts, nil
+}
+
+// checkTrust checks the signer's certs, signer first, against opts, as of
+// now or the timestamp over sig. It fills in res.Chain and res.Timestamp.
+// certs is nil for a bare public key, which has nothing to check.
+func checkTrust(certs []*x509.Certificate, sig []byte, opts *VerifyOptions, res *Result) (err error) {
+	if opts.CRL != nil && opts.Root == nil {
+		return errors.New("a CRL needs a root")
+	}
+	if opts.Timestamp != nil && opts.Root == nil {
+		return errors.New("a timestamp needs a root")
+	}
+	if opts.Root != nil && !opts.Root.IsCA {
+		return errors.New("root is not a CA cert")
+	}
+	if certs == nil {
+		if opts.Root != nil {
+			return errors.New("a root needs a signer cert, not a bare public key")
+		}
+		return nil
+	}
+	var stamped time.Time
+	if opts.Timestamp != nil {
+		if res.Timestamp, err = checkTimestamp(sig, opts); err != nil {
+			return
+		}
+		stamped = res.Timestamp.Time
+	}
+	if opts.Root != nil {
+		at := stamped
+		if at.IsZero() {
+			at = opts.now()
+		}
+		if res.Chain, err = checkSigner(certs, opts, at); err != nil {
+			return
+		}
+		if opts.CRL != nil {
+			if err = checkRevoked(res.Chain, opts, stamped); err != nil {
+				return
+			}
+		}
+	}
+	return checkPurpose(certs[0])
+}
+
+// checkDetached checks who made d, before anything checks what they signed.
+// want, if set, must be d's signer's key.
+func checkDetached(d *enough.DetachedSignature, sig []byte, want *ecdsa.PublicKey, opts *VerifyOptions) (*Result, error) {
+	signer := d.Signer()
+	if want != nil && !want.Equal(signer.PublicKey) {
+		return nil, fmt.Errorf("%w: signed by %s, not the expected key", ErrUntrusted, signer.Subject.CommonName)
+	}
+	res := &Result{Signer: signer, Hash: d.Hash, SigningTime: d.SigningTime, Detached: true}
+	if err := checkTrust(d.Chain, sig, opts, res); err != nil {
+		return nil, err
+	}
+	if d.SigningTime.Before(signer.NotBefore) || d.SigningTime.After(signer.NotAfter) {
+		return nil, fmt.Errorf("%w: signing time %s is outside its validity", ErrExpired, d.SigningTime.Format(time.RFC3339))
+	}
+	return res, nil
+}
+
+// bareHash picks the digest for a bare signature, which doesn't say.
+// Apparently there's no standard way to know: it's literally just R and S.
+// verify_ecdsa always guessed from the signer cert's SignatureAlgorithm,
+// which isn't sensible, but it's what old signatures were made with.
+func bareHash(signer *x509.Certificate, opts *VerifyOptions) (h crypto.Hash, e error) {
+	switch {
+	case opts.Hash != 0:
+		h = opts.Hash
+	case signer == nil:
+		h = crypto.SHA256
+	case signer.SignatureAlgorithm == x509.ECDSAWithSHA1:
+		h = crypto.SHA1
+	case signer.SignatureAlgorithm == x509.ECDSAWithSHA256:
+		h = crypto.SHA256
+	case signer.SignatureAlgorithm == x509.ECDSAWithSHA384:
+		h = crypto.SHA384
+	case signer.SignatureAlgorithm == x509.ECDSAWithSHA512:
+		h = crypto.SHA512
+	}
+	if !h.Available() {
+		e = errors.New("unsupported hash algorithm")
+	}
+	return
+}
+
+// Verify checks sig is a good signature over what r reads, from a signer
+// opts trusts. sig is an ENOUGH SIGNATURE, which carries its signer, or a
+// bare ECDSA signature (see enough.DecodeECDSASignature) from cert, or from
+// opts.PublicKey. cert may be nil for an ENOUGH SIGNATURE; if set, it must
+// be the signer. The signer is checked before r is read, so an untrusted
+// signature costs nothing to reject.
+func Verify(r io.Reader, sig []byte, cert *x509.Certificate, opts *VerifyOptions) (*Result, error) {
+	if opts == nil {
+		opts = &VerifyOptions{}
+	}
+	want := opts.PublicKey
+	if cert != nil {
+		pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+		if !ok {
+			return nil, errors.New("signer cert key is not ECDSA")
+		}
+		want = pub
+	}
+
+	format := opts.Format
+	if format == "" {
+		format = enough.SigFormatAuto
+	}
+	if format == enough.SigFormatAuto {
+		d, err := enough.ParseDetachedSignature(sig)
+		if err == nil {
+			res, err := checkDetached(d, sig, want, opts)
+			if err != nil {
+				return nil, err
+			}
+			if err := d.Verify(r); err != nil {
+				return nil, fmt.Errorf("%w: %s", ErrSignature, err)
+			}
+			return res, nil
+		}
+		if !errors.Is(err, enough.ErrNotDetachedSignature) {
+			return nil, err
+		}
+	}
+
+	// A bare signature, so the signer has to come from the caller.
+	if want == nil {
+		return nil, errors.New("a bare signature needs a signer cert or public key")
+	}
+	if cert == nil && !opts.TrustBareKey {
+		return nil, fmt.Errorf("%w: a bare public key can't be checked for code signing, and must be trusted explicitly", ErrUntrusted)
+	}
+	var certs []*x509.Certificate
+	if cert != nil {
+		certs = append([]*x509.Certificate{cert}, opts.Intermediates...)
+	}
+	res := &Result{Signer: cert}
+	if err := checkTrust(certs, sig, opts, res); err != nil {
+		return nil, err
+	}
+	rr, ss, err := enough.DecodeECDSASignature(sig, format, want)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrSignature, err)
+	}
+	if res.Hash, err = bareHash(cert, opts); err != nil {
+		return nil, err
+	}
+	// Hash as we read, rather than reading all of r into a []byte.
+	h := res.Hash.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	if !ecdsa.Verify(want, h.Sum(nil), rr, ss) {
+		return nil, ErrSignature
+	}
+	return res, nil
+}
+
+// VerifyRelease checks the release directory dir against m, its signed
+// manifest: m's signer as Verify does, then every file, hashed across
+// workers goroutines (GOMAXPROCS if zero). opts.Timestamp is over
+// m.Signature. If the files don't match, the error wraps ErrSignature and
+// the report says how.
+func VerifyRelease(dir string, m *enough.ReleaseManifest, cert *x509.Certificate, opts *VerifyOptions, workers int) (*Result, *enough.ReleaseReport, error) {
+	if opts == nil {
+		opts = &VerifyOptions{}
+	}
+	want := opts.PublicKey
+	if cert != nil {
+		pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+		if !ok {
+			return nil, nil, errors.New("signer cert key is not ECDSA")
+		}
+		want = pub
+	}
+	d, err := m.Verify()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrSignature, err)
+	}
+	res, err := checkDetached(d, []byte(m.Signature), want, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	report, err := enough.VerifyRelease(dir, m, workers)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !report.OK() {
+		return res, report, fmt.Errorf("%w: %s does not match its manifest", ErrSignature, dir)
+	}
+	return res, report, nil
+}
@@ -0,0 +1,209 @@
+package sign
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"github.com/bnagy/enough"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var epoch = time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func fixedClock(t time.Time) func() time.Time { return func() time.Time { return t } }
+
+func TestSignVerify(t *testing.T) {
+	ca, err := enough.NewCAWithOptions("TestCerts", &enough.CAOptions{Clock: fixedClock(epoch)})
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	other, _ := enough.NewCAWithOptions("Other", &enough.CAOptions{Clock: fixedClock(epoch)})
+	releases, err := ca.CreateCodeSigningCert("releases")
+	if err != nil {
+		t.Fatalf("unable to create code signing cert: %s", err)
+	}
+	client, _ := ca.CreateClientCert(1)
+	root := &ca.Raw.Certificate
+	cert := &releases.Certificate
+
+	if _, err := NewSigner(client.PrivateKey, []*x509.Certificate{&client.Certificate}); err == nil {
+		t.Error("made a signer from a client cert")
+	}
+	if _, err := NewSigner(client.PrivateKey, []*x509.Certificate{cert}); err == nil {
+		t.Error("made a signer with the wrong key")
+	}
+	s, err := NewSigner(releases.PrivateKey, []*x509.Certificate{cert})
+	if err != nil {
+		t.Fatalf("failed to make signer: %s", err)
+	}
+	s.Clock = fixedClock(epoch.Add(time.Hour))
+
+	data := []byte("an update")
+	sig, err := Sign(bytes.NewReader(data), s)
+	if err != nil {
+		t.Fatalf("failed to sign: %s", err)
+	}
+	opts := &VerifyOptions{Root: root, Clock: fixedClock(epoch.Add(2 * time.Hour))}
+	res, err := Verify(bytes.NewReader(data), sig, nil, opts)
+	if err != nil {
+		t.Fatalf("failed to verify: %s", err)
+	}
+	if !res.Detached || !res.Signer.Equal(cert) || !res.SigningTime.Equal(epoch.Add(time.Hour)) || len(res.Chain) != 2 {
+		t.Errorf("unexpected result %+v", res)
+	}
+
+	// a different error for each way it can go wrong
+	legacy, _ := ecdsa.SignASN1(rand.Reader, client.PrivateKey, sha256Sum(data))
+	clientSig, _ := enough.SignDetached(bytes.NewReader(data), client.PrivateKey, []*x509.Certificate{&client.Certificate}, crypto.SHA256, epoch)
+	clientPEM, _ := clientSig.Marshal()
+	for _, tc := range []struct {
+		name string
+		data []byte
+		sig  []byte
+		cert *x509.Certificate
+		opts *VerifyOptions
+		want error
+	}{
+		{"tampered", []byte("an upgrade"), sig, nil, opts, ErrSignature},
+		{"other park", data, sig, nil, &VerifyOptions{Root: &other.Raw.Certificate, Clock: opts.Clock}, ErrUntrusted},
+		{"wrong cert", data, sig, &client.Certificate, opts, ErrUntrusted},
+		{"expired", data, sig, nil, &VerifyOptions{Root: root, Clock: fixedClock(epoch.AddDate(11, 0, 0))}, ErrExpired},
+		{"client cert", data, clientPEM, nil, opts, ErrPurpose},
+		{"bare client cert", data, legacy, &client.Certificate, nil, ErrPurpose},
+	} {
+		if _, err := Verify(bytes.NewReader(tc.data), tc.sig, tc.cert, tc.opts); !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+
+	// bare signatures need the signer from the caller
+	legacy, _ = ecdsa.SignASN1(rand.Reader, releases.PrivateKey, sha256Sum(data))
+	if _, err := Verify(bytes.NewReader(data), legacy, cert, opts); err != nil {
+		t.Errorf("failed to verify bare signature: %s", err)
+	}
+	bare := &VerifyOptions{PublicKey: &releases.PrivateKey.PublicKey}
+	if _, err := Verify(bytes.NewReader(data), legacy, nil, bare); !errors.Is(err, ErrUntrusted) {
+		t.Errorf("bare key without TrustBareKey: got %v", err)
+	}
+	bare.TrustBareKey = true
+	if _, err := Verify(bytes.NewReader(data), legacy, nil, bare); err != nil {
+		t.Errorf("failed to verify bare signature with a bare key: %s", err)
+	}
+	if _, err := Verify(bytes.NewReader(data), legacy, nil, opts); err == nil {
+		t.Error("verified a bare signature with no signer")
+	}
+}
+
+func sha256Sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+func TestVerifyTimestamped(t *testing.T) {
+	ca, err := enough.NewCAWithOptions("TestCerts", &enough.CAOptions{Clock: fixedClock(epoch)})
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	releases, _ := ca.CreateCodeSigningCert("releases")
+	tsaCert, _ := ca.CreateTimestampingCert("tsa")
+	tsa, err := enough.NewTimestampAuthority(&tsaCert.Certificate, tsaCert.PrivateKey)
+	if err != nil {
+		t.Fatalf("failed to make TSA: %s", err)
+	}
+	tsa.Clock = fixedClock(epoch.Add(time.Hour))
+	srv := httptest.NewServer(tsa)
+	defer srv.Close()
+
+	s, _ := NewSigner(releases.PrivateKey, []*x509.Certificate{&releases.Certificate})
+	s.Clock = tsa.Clock
+	data := []byte("an update")
+	sig, _ := Sign(bytes.NewReader(data), s)
+	_, stamp, err := enough.RequestTimestamp(srv.URL, sig)
+	if err != nil {
+		t.Fatalf("failed to get timestamp: %s", err)
+	}
+
+	// long after the signer expired, the timestamp still vouches for it
+	opts := &VerifyOptions{Root: &ca.Raw.Certificate, Timestamp: stamp, Clock: fixedClock(epoch.AddDate(11, 0, 0))}
+	res, err := Verify(bytes.NewReader(data), sig, nil, opts)
+	if err != nil {
+		t.Fatalf("failed to verify timestamped signature: %s", err)
+	}
+	if res.Timestamp == nil || !res.Timestamp.Time.Equal(epoch.Add(time.Hour)) {
+		t.Errorf("unexpected timestamp %+v", res.Timestamp)
+	}
+
+	other, _ := Sign(bytes.NewReader([]byte("another update")), s)
+	if _, err := Verify(bytes.NewReader([]byte("another update")), other, nil, opts); !errors.Is(err, ErrTimestamp) {
+		t.Errorf("timestamp for another signature: got %v", err)
+	}
+	opts.Timestamp = nil
+	if _, err := Verify(bytes.NewReader(data), sig, nil, opts); !errors.Is(err, ErrExpired) {
+		t.Errorf("without the timestamp: got %v", err)
+	}
+
+	// once the TSA is revoked its stamps are worthless, even ones claiming
+	// to be from before, since it can claim any time it likes
+	tsa.Clock = fixedClock(epoch.Add(time.Minute))
+	_, backdated, err := enough.RequestTimestamp(srv.URL, sig)
+	if err != nil {
+		t.Fatalf("failed to get timestamp: %s", err)
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                epoch.Add(2 * time.Hour),
+		NextUpdate:                epoch.AddDate(12, 0, 0),
+		RevokedCertificateEntries: []x509.RevocationListEntry{{SerialNumber: tsaCert.Certificate.SerialNumber, RevocationTime: epoch.Add(2 * time.Hour)}},
+	}, &ca.Raw.Certificate, ca.Raw.PrivateKey)
+	if err != nil {
+		t.Fatalf("failed to create CRL: %s", err)
+	}
+	opts.CRL, _ = x509.ParseRevocationList(der)
+	opts.Timestamp = backdated
+	if _, err := Verify(bytes.NewReader(data), sig, nil, opts); !errors.Is(err, enough.ErrRevoked) {
+		t.Errorf("backdated stamp from a revoked TSA: got %v", err)
+	}
+}
+
+func TestVerifyRelease(t *testing.T) {
+	ca, err := enough.NewCAWithOptions("TestCerts", &enough.CAOptions{Clock: fixedClock(epoch)})
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	releases, _ := ca.CreateCodeSigningCert("releases")
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "tool"), []byte("tool"), 0644)
+	m, err := enough.NewReleaseManifest(dir)
+	if err != nil {
+		t.Fatalf("failed to make manifest: %s", err)
+	}
+	m.Created = epoch.Add(time.Hour)
+	if err := m.Sign(releases.PrivateKey, []*x509.Certificate{&releases.Certificate}); err != nil {
+		t.Fatalf("failed to sign manifest: %s", err)
+	}
+
+	opts := &VerifyOptions{Root: &ca.Raw.Certificate, Clock: fixedClock(epoch.Add(2 * time.Hour))}
+	if _, _, err := VerifyRelease(dir, m, nil, opts, 0); err != nil {
+		t.Fatalf("failed to verify release: %s", err)
+	}
+	notECDSA := releases.Certificate
+	notECDSA.PublicKey = ed25519.PublicKey(make([]byte, ed25519.PublicKeySize))
+	if _, _, err := VerifyRelease(dir, m, &notECDSA, opts, 0); err == nil {
+		t.Error("verified a release against a non-ECDSA signer cert")
+	}
+	os.WriteFile(filepath.Join(dir, "tool"), []byte("evil tool"), 0644)
+	_, r, err := VerifyRelease(dir, m, nil, opts, 0)
+	if !errors.Is(err, ErrSignature) || r == nil || len(r.Modified) != 1 {
+		t.Errorf("modified release: got %v, %+v", err, r)
+	}
+}
@@ -0,0 +1,264 @@
+package enough
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// A detached signature says how it was made, so verifiers don't have to
+// guess the digest from the signer cert's own signature algorithm, which has
+// nothing to do with how the file was hashed. It is DER, in a PEM block of
+// type "ENOUGH SIGNATURE":
+//
+//	EnoughSignature ::= SEQUENCE {
+//	    tbs        SignedAttributes,
+//	    chain      SEQUENCE OF Certificate, -- signer first, then intermediates
+//	    signature  OCTET STRING             -- ECDSA-Sig-Value over H(tbs)
+//	}
+//
+//	SignedAttributes ::= SEQUENCE {
+//	    version          INTEGER (1),
+//	    digestAlgorithm  AlgorithmIdentifier, -- id-sha256, id-sha384 or id-sha512
+//	    digest           OCTET STRING,        -- H(file)
+//	    signingTime      GeneralizedTime,
+//	    signer           OCTET STRING         -- SHA-256 of the signer cert DER
+//	}
+//
+// H is digestAlgorithm throughout. The signing time is the signer's claim,
+// not proof; the signer hash stops the chain being swapped for another cert
+// with the same key.
+
+// SignaturePEMType is the PEM block type of a DetachedSignature.
+const SignaturePEMType = "ENOUGH SIGNATURE"
+
+const signatureVersion = 1
+
+// ErrNotDetachedSignature means the data isn't a DetachedSignature, eg
+// because it's a bare (R,S) signature.
+var ErrNotDetachedSignature = errors.New("not an " + SignaturePEMType)
+
+var signatureHashes = []struct {
+	hash crypto.Hash
+	name string
+	oid  asn1.ObjectIdentifier
+}{
+	{crypto.SHA256, "sha256", asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}},
+	{crypto.SHA384, "sha384", asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}},
+	{crypto.SHA512, "sha512", asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}},
+}
+
+// ParseHash returns the digest called name: sha256, sha384 or sha512.
+func ParseHash(name string) (crypto.Hash, error) {
+	for _, h := range signatureHashes {
+		if strings.EqualFold(name, h.name) {
+			return h.hash, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported hash %q, use sha256, sha384 or sha512", name)
+}
+
+func hashOID(h crypto.Hash) (asn1.ObjectIdentifier, error) {
+	for _, sh := range signatureHashes {
+		if sh.hash == h {
+			return sh.oid, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported hash %s", h)
+}
+
+func oidHash(oid asn1.ObjectIdentifier) (crypto.Hash, error) {
+	for _, sh := range signatureHashes {
+		if sh.oid.Equal(oid) {
+			return sh.hash, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported digest algorithm %s", oid)
+}
+
+type signedAttributes struct {
+	Version         int
+	DigestAlgorithm pkix.AlgorithmIdentifier
+	Digest          []byte
+	SigningTime     time.Time `asn1:"generalized"`
+	Signer          []byte
+}
+
+type signatureEnvelope struct {
+	TBS       asn1.RawValue
+	Chain     []asn1.RawValue
+	Signature []byte
+}
+
+// DetachedSignature is a signature over a file, with everything needed to
+// check it except the file.
+type DetachedSignature struct {
+	Hash        crypto.Hash
+	Digest      []byte // of the file
+	SigningTime time.Time
+	Chain       []*x509.Certificate // signer first
+	Signature   []byte              // ASN.1 ECDSA, over the hash of tbs
+
+	tbs []byte
+}
+
+// Signer returns the signer's cert.
+func (s *DetachedSignature) Signer() *x509.Certificate {
+	return s.Chain[0]
+}
+
+func hashReader(r io.Reader, h crypto.Hash) ([]byte, error) {
+	if !h.Available() {
+		return nil, fmt.Errorf("unsupported hash %s", h)
+	}
+	hh := h.New()
+	if _, err := io.Copy(hh, r); err != nil {
+		return nil, err
+	}
+	return hh.Sum(nil), nil
+}
+
+// SignDetached reads r to the end and signs it with key, whose cert is
+// chain[0]; any further certs are intermediates for verifiers to chain
+// through. when is recorded as the signing time.
+func SignDetached(r io.Reader, key crypto.Signer, chain []*x509.Certificate, h crypto.Hash, when time.Time) (s *DetachedSignature, e error) {
+	if len(chain) == 0 {
+		return nil, errors.New("no signer cert")
+	}
+	pub, ok := chain[0].PublicKey.(*ecdsa.PublicKey)
+	if !ok || !pub.Equal(key.Public()) {
+		return nil, errors.New("key does not match the signer cert")
+	}
+	oid, e := hashOID(h)
+	if e != nil {
+		return
+	}
+	digest, e := hashReader(r, h)
+	if e != nil {
+		return
+	}
+	signer := sha256.Sum256(chain[0].Raw)
+	s = &DetachedSignature{
+		Hash:        h,
+		Digest:      digest,
+		SigningTime: when.UTC().Truncate(time.Second),
+		Chain:       chain,
+	}
+	s.tbs, e = asn1.Marshal(signedAttributes{
+		Version:         signatureVersion,
+		DigestAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oid},
+		Digest:          digest,
+		SigningTime:     s.SigningTime,
+		Signer:          signer[:],
+	})
+	if e != nil {
+		return nil, e
+	}
+	tbsDigest, e := hashReader(bytes.NewReader(s.tbs), h)
+	if e != nil {
+		return nil, e
+	}
+	if s.Signature, e = key.Sign(rand.Reader, tbsDigest, h); e != nil {
+		return nil, e
+	}
+	return
+}
+
+// Marshal returns s as an "ENOUGH SIGNATURE" PEM block.
+func (s *DetachedSignature) Marshal() ([]byte, error) {
+	env := signatureEnvelope{
+		TBS:       asn1.RawValue{FullBytes: s.tbs},
+		Signature: s.Signature,
+	}
+	for _, c := range s.Chain {
+		env.Chain = append(env.Chain, asn1.RawValue{FullBytes: c.Raw})
+	}
+	der, err := asn1.Marshal(env)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: SignaturePEMType, Bytes: der}), nil
+}
+
+// ParseDetachedSignature parses an "ENOUGH SIGNATURE" PEM block. It returns
+// ErrNotDetachedSignature if data isn't one, so callers can fall back to
+// other formats. It does not check the signature; Verify does.
+func ParseDetachedSignature(data []byte) (*DetachedSignature, error) {
+	block, _ := pem.Decode(bytes.TrimSpace(data))
+	if block == nil || block.Type != SignaturePEMType {
+		return nil, ErrNotDetachedSignature
+	}
+	env := signatureEnvelope{}
+	if rest, err := asn1.Unmarshal(block.Bytes, &env); err != nil || len(rest) != 0 {
+		return nil, errors.New("invalid signature envelope")
+	}
+	attrs := signedAttributes{}
+	if rest, err := asn1.Unmarshal(env.TBS.FullBytes, &attrs); err != nil || len(rest) != 0 {
+		return nil, errors.New("invalid signed attributes")
+	}
+	if attrs.Version != signatureVersion {
+		return nil, fmt.Errorf("unsupported signature version %d", attrs.Version)
+	}
+	h, err := oidHash(attrs.DigestAlgorithm.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if len(env.Chain) == 0 {
+		return nil, errors.New("signature has no signer cert")
+	}
+	s := &DetachedSignature{
+		Hash:        h,
+		Digest:      attrs.Digest,
+		SigningTime: attrs.SigningTime,
+		Signature:   env.Signature,
+		tbs:         env.TBS.FullBytes,
+	}
+	for _, raw := range env.Chain {
+		c, err := x509.ParseCertificate(raw.FullBytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cert in signature: %s", err)
+		}
+		s.Chain = append(s.Chain, c)
+	}
+	signer := sha256.Sum256(s.Chain[0].Raw)
+	if !bytes.Equal(signer[:], attrs.Signer) {
+		return nil, errors.New("signature names a different signer cert")
+	}
+	return s, nil
+}
+
+// Verify checks that s was made by the key in its signer cert, over what r
+// reads. It doesn't decide whether to trust the signer; validate the chain
+// for that.
+func (s *DetachedSignature) Verify(r io.Reader) error {
+	pub, ok := s.Signer().PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return errors.New("signer key is not ECDSA")
+	}
+	tbsDigest, err := hashReader(bytes.NewReader(s.tbs), s.Hash)
+	if err != nil {
+		return err
+	}
+	if !ecdsa.VerifyASN1(pub, tbsDigest, s.Signature) {
+		return errors.New("bad signature")
+	}
+	digest, err := hashReader(r, s.Hash)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(digest, s.Digest) {
+		return errors.New("file does not match signature")
+	}
+	return nil
+}
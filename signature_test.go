@@ -0,0 +1,77 @@
+package enough
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDetachedSignature(t *testing.T) {
+	t.Parallel()
+	ca, err := NewCAWithOptions("TestCerts", &CAOptions{Rand: seededRand(44), Clock: testClock})
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	signer, err := ca.CreateCodeSigningCert("releases")
+	if err != nil {
+		t.Fatalf("unable to create code signing cert: %s", err)
+	}
+	chain := []*x509.Certificate{&signer.Certificate}
+	file := []byte(strings.Repeat("release ", 1000))
+
+	for _, h := range []crypto.Hash{crypto.SHA256, crypto.SHA384, crypto.SHA512} {
+		s, err := SignDetached(bytes.NewReader(file), signer.PrivateKey, chain, h, testEpoch)
+		if err != nil {
+			t.Fatalf("%s: failed to sign: %s", h, err)
+		}
+		data, err := s.Marshal()
+		if err != nil {
+			t.Fatalf("%s: failed to marshal: %s", h, err)
+		}
+		back, err := ParseDetachedSignature(data)
+		if err != nil {
+			t.Fatalf("%s: failed to parse: %s", h, err)
+		}
+		if back.Hash != h || !back.SigningTime.Equal(testEpoch) || !back.Signer().Equal(&signer.Certificate) {
+			t.Errorf("%s: round trip changed the signature: %+v", h, back)
+		}
+		if err := back.Verify(bytes.NewReader(file)); err != nil {
+			t.Errorf("%s: failed to verify: %s", h, err)
+		}
+		if err := back.Verify(bytes.NewReader(append(file, '!'))); err == nil {
+			t.Errorf("%s: verified a modified file", h)
+		}
+	}
+
+	// The signing time is covered by the signature.
+	s, _ := SignDetached(bytes.NewReader(file), signer.PrivateKey, chain, crypto.SHA256, testEpoch)
+	s.SigningTime = testEpoch.AddDate(1, 0, 0)
+	attrs := signedAttributes{}
+	if _, err := asn1.Unmarshal(s.tbs, &attrs); err != nil {
+		t.Fatalf("bad tbs: %s", err)
+	}
+	attrs.SigningTime = s.SigningTime
+	if s.tbs, err = asn1.Marshal(attrs); err != nil {
+		t.Fatalf("bad tbs: %s", err)
+	}
+	if err := s.Verify(bytes.NewReader(file)); err == nil {
+		t.Errorf("verified with a changed signing time")
+	}
+
+	// A cert for someone else's key can't sign.
+	if _, err := SignDetached(bytes.NewReader(file), signer.PrivateKey, []*x509.Certificate{&ca.Raw.Certificate}, crypto.SHA256, testEpoch); err == nil {
+		t.Errorf("signed with a key that doesn't match the cert")
+	}
+	if _, err := SignDetached(bytes.NewReader(file), signer.PrivateKey, chain, crypto.SHA1, testEpoch); err == nil {
+		t.Errorf("signed with SHA-1")
+	}
+
+	// Bare (R,S) signatures are for the legacy path.
+	if _, err := ParseDetachedSignature([]byte{0x30, 0x06, 0x02, 0x01, 0x01, 0x02, 0x01, 0x01}); !errors.Is(err, ErrNotDetachedSignature) {
+		t.Errorf("expected ErrNotDetachedSignature, got %v", err)
+	}
+}
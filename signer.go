@@ -0,0 +1,203 @@
+package enough
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// The signing daemon protocol is one JSON request and one JSON response per
+// line over a Unix socket. The daemon only ever signs digests; it never
+// hands out the key.
+//
+//	{"op": "public"}                               -> {"public": <PKIX DER>}
+//	{"op": "sign", "hash": 5, "digest": <bytes>}   -> {"signature": <ASN.1 DER>}
+//
+// hash is a crypto.Hash. Failures come back as {"error": "..."}.
+
+type signerRequest struct {
+	Op     string      `json:"op"`
+	Hash   crypto.Hash `json:"hash,omitempty"`
+	Digest []byte      `json:"digest,omitempty"`
+}
+
+type signerResponse struct {
+	Public    []byte `json:"public,omitempty"`
+	Signature []byte `json:"signature,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// signerHashes are the digests the daemon will sign. Anything else is
+// refused rather than guessed at.
+var signerHashes = map[crypto.Hash]bool{
+	crypto.SHA256: true,
+	crypto.SHA384: true,
+	crypto.SHA512: true,
+}
+
+// ServeSigner answers signing requests on l with s until l is closed. If
+// logger is set, every signature is logged to it. It is meant to run in its
+// own locked-down process which is the only thing that can read the CA key.
+func ServeSigner(l net.Listener, s crypto.Signer, logger *log.Logger) error {
+	pub, err := x509.MarshalPKIXPublicKey(s.Public())
+	if err != nil {
+		return err
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go serveSignerConn(conn, s, pub, logger)
+	}
+}
+
+func serveSignerConn(conn net.Conn, s crypto.Signer, pub []byte, logger *log.Logger) {
+	defer conn.Close()
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	enc := json.NewEncoder(conn)
+	for {
+		var req signerRequest
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		var resp signerResponse
+		switch req.Op {
+		case "public":
+			resp.Public = pub
+		case "sign":
+			if !signerHashes[req.Hash] {
+				resp.Error = fmt.Sprintf("unsupported hash %v", req.Hash)
+			} else if len(req.Digest) != req.Hash.Size() {
+				resp.Error = "digest length does not match hash"
+			} else {
+				sig, err := s.Sign(rand.Reader, req.Digest, req.Hash)
+				if err != nil {
+					resp.Error = err.Error()
+				} else {
+					resp.Signature = sig
+					if logger != nil {
+						logger.Printf("signer: signed %v digest %x", req.Hash, req.Digest)
+					}
+				}
+			}
+		default:
+			resp.Error = fmt.Sprintf("unknown op %q", req.Op)
+		}
+		if err := enc.Encode(&resp); err != nil {
+			return
+		}
+	}
+}
+
+// DefaultSignerTimeout bounds each call to the signing daemon if
+// RemoteSigner.Timeout isn't set.
+const DefaultSignerTimeout = 30 * time.Second
+
+// RemoteSigner is a crypto.Signer backed by a ServeSigner daemon on a Unix
+// socket. Each Sign makes a fresh connection, so a restarted daemon is
+// picked up transparently. Make one with DialSigner, which fetches the
+// daemon's public key.
+type RemoteSigner struct {
+	Path    string
+	Timeout time.Duration // DefaultSignerTimeout if zero
+	public  crypto.PublicKey
+}
+
+// DialSigner connects to the signing daemon at path and fetches its public
+// key.
+func DialSigner(path string) (*RemoteSigner, error) {
+	rs := &RemoteSigner{Path: path}
+	resp, err := rs.call(&signerRequest{Op: "public"})
+	if err != nil {
+		return nil, err
+	}
+	pub, err := x509.ParsePKIXPublicKey(resp.Public)
+	if err != nil {
+		return nil, fmt.Errorf("signer sent a bad public key: %s", err)
+	}
+	if _, ok := pub.(*ecdsa.PublicKey); !ok {
+		return nil, errors.New("signer key is not ECDSA")
+	}
+	rs.public = pub
+	return rs, nil
+}
+
+func (rs *RemoteSigner) call(req *signerRequest) (*signerResponse, error) {
+	timeout := rs.Timeout
+	if timeout <= 0 {
+		timeout = DefaultSignerTimeout
+	}
+	conn, err := net.DialTimeout("unix", rs.Path, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+	resp := &signerResponse{}
+	if err := json.NewDecoder(conn).Decode(resp); err != nil {
+		if err == io.EOF {
+			err = errors.New("signer closed the connection")
+		}
+		return nil, err
+	}
+	if len(resp.Error) > 0 {
+		return nil, fmt.Errorf("signer: %s", resp.Error)
+	}
+	return resp, nil
+}
+
+// Public returns the daemon's public key.
+func (rs *RemoteSigner) Public() crypto.PublicKey {
+	return rs.public
+}
+
+// Sign asks the daemon to sign digest. The daemon uses its own randomness,
+// so rand is ignored.
+func (rs *RemoteSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	pub, ok := rs.public.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("signer has no public key, use DialSigner")
+	}
+	resp, err := rs.call(&signerRequest{Op: "sign", Hash: opts.HashFunc(), Digest: digest})
+	if err != nil {
+		return nil, err
+	}
+	// don't hand back anything that wouldn't verify
+	if !ecdsa.VerifyASN1(pub, digest, resp.Signature) {
+		return nil, errors.New("signer returned an invalid signature")
+	}
+	return resp.Signature, nil
+}
+
+// NewCAFromCertAndSigner is NewCAFromCertAndKey for a CA whose key is only
+// reachable through s, eg a RemoteSigner.
+func NewCAFromCertAndSigner(certPemData []byte, s crypto.Signer) (ca *CA, e error) {
+	cert, e := parseCertPEM(certPemData)
+	if e != nil {
+		return
+	}
+	pub, ok := s.Public().(*ecdsa.PublicKey)
+	if !ok || !pub.Equal(cert.PublicKey) {
+		e = errors.New("signer key does not match CA cert")
+		return
+	}
+	ca = &CA{Raw: RawCert{Certificate: *cert}, Signer: s}
+	if e = ca.loadParkInfo(); e != nil {
+		ca = nil
+	}
+	return
+}
@@ -0,0 +1,79 @@
+package enough
+
+import (
+	"crypto"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoteSigner(t *testing.T) {
+	t.Parallel()
+	ca, err := NewCA("testing")
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	sock := filepath.Join(t.TempDir(), "signer.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer l.Close()
+	go ServeSigner(l, ca.Raw.PrivateKey, nil)
+
+	rs, err := DialSigner(sock)
+	if err != nil {
+		t.Fatalf("failed to dial signer: %s", err)
+	}
+	pemCert, _ := ca.Raw.MarshalCertificate()
+	remote, err := NewCAFromCertAndSigner(pemCert, rs)
+	if err != nil {
+		t.Fatalf("failed to load CA with signer: %s", err)
+	}
+	if remote.Raw.PrivateKey != nil {
+		t.Error("remote CA holds a private key")
+	}
+	if remote.Service != "testing" || remote.ParkID != ca.ParkID {
+		t.Errorf("remote CA lost park info: %q %q", remote.Service, remote.ParkID)
+	}
+
+	c, err := remote.CreateNamedClientCert("worker")
+	if err != nil {
+		t.Fatalf("unable to create client cert: %s", err)
+	}
+	if err := c.Certificate.CheckSignatureFrom(&ca.Raw.Certificate); err != nil {
+		t.Errorf("CA signature invalid: %s", err)
+	}
+
+	recipient, err := GenerateRecipientKey()
+	if err != nil {
+		t.Fatalf("failed to create key: %s", err)
+	}
+	sealed, err := remote.SealBundle([]byte("archive"), &recipient.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to seal with remote signer: %s", err)
+	}
+	if _, err := OpenSealedBundle(sealed, recipient, &ca.Raw.Certificate); err != nil {
+		t.Errorf("failed to open bundle sealed by remote signer: %s", err)
+	}
+
+	other, err := NewCA("other")
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	otherCert, _ := other.Raw.MarshalCertificate()
+	if _, err := NewCAFromCertAndSigner(otherCert, rs); err == nil {
+		t.Error("accepted a signer that doesn't match the CA cert")
+	}
+
+	// a zero Timeout is the default, not an instant deadline, but the public
+	// key only comes from DialSigner
+	digest := make([]byte, 32)
+	if _, err := (&RemoteSigner{Path: sock}).Sign(nil, digest, crypto.SHA256); err == nil {
+		t.Error("signed without the daemon's public key")
+	}
+	rs.Timeout = 0
+	if _, err := rs.Sign(nil, digest, crypto.SHA256); err != nil {
+		t.Errorf("failed to sign with a zero timeout: %s", err)
+	}
+}
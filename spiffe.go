@@ -0,0 +1,156 @@
+package enough
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Park members get a SPIFFE ID as a URI SAN, so SPIFFE-aware proxies and
+// tooling can identify them:
+//
+//	spiffe://<trust domain>/server
+//	spiffe://<trust domain>/client/<name>
+//	spiffe://<trust domain>/client/<domain>/<user>   for user@domain names
+
+// TrustDomain returns the park's SPIFFE trust domain: the service name,
+// lowercased, with anything SPIFFE doesn't allow replaced by '-'.
+func (ca *CA) TrustDomain() string {
+	td := []byte(strings.ToLower(ca.Service))
+	for i, b := range td {
+		if !(b >= 'a' && b <= 'z' || b >= '0' && b <= '9' || b == '.' || b == '-' || b == '_') {
+			td[i] = '-'
+		}
+	}
+	return string(td)
+}
+
+func (ca *CA) spiffeID(p string) *url.URL {
+	return &url.URL{Scheme: "spiffe", Host: ca.TrustDomain(), Path: "/" + p}
+}
+
+func clientSPIFFEPath(name string) string {
+	if i := strings.Index(name, "@"); i >= 0 {
+		return "client/" + name[i+1:] + "/" + name[:i]
+	}
+	return "client/" + name
+}
+
+// SPIFFEID returns the SPIFFE ID of cert, which must have exactly one
+// spiffe:// URI SAN.
+func SPIFFEID(cert *x509.Certificate) (*url.URL, error) {
+	var id *url.URL
+	for _, u := range cert.URIs {
+		if u.Scheme != "spiffe" {
+			continue
+		}
+		if id != nil {
+			return nil, errors.New("certificate has more than one SPIFFE ID")
+		}
+		id = u
+	}
+	if id == nil {
+		return nil, errors.New("certificate has no SPIFFE ID")
+	}
+	if len(id.Host) == 0 || len(id.User.String()) > 0 || len(id.Port()) > 0 || len(id.RawQuery) > 0 || len(id.Fragment) > 0 {
+		return nil, fmt.Errorf("malformed SPIFFE ID %s", id)
+	}
+	return id, nil
+}
+
+// VerifySPIFFEID checks that cert's SPIFFE ID matches pattern, a spiffe://
+// URI whose path may contain path.Match wildcards, eg
+// "spiffe://widget/client/*". The trust domain must match exactly.
+func VerifySPIFFEID(cert *x509.Certificate, pattern string) error {
+	want, err := url.Parse(pattern)
+	if err != nil || want.Scheme != "spiffe" {
+		return fmt.Errorf("bad SPIFFE ID pattern %q", pattern)
+	}
+	id, err := SPIFFEID(cert)
+	if err != nil {
+		return err
+	}
+	if id.Host != want.Host {
+		return fmt.Errorf("SPIFFE ID %s is not in trust domain %s", id, want.Host)
+	}
+	ok, err := path.Match(want.Path, id.Path)
+	if err != nil {
+		return fmt.Errorf("bad SPIFFE ID pattern %q: %s", pattern, err)
+	}
+	if !ok {
+		return fmt.Errorf("SPIFFE ID %s does not match %s", id, pattern)
+	}
+	return nil
+}
+
+// SPIFFEVerifier returns a function for tls.Config.VerifyPeerCertificate
+// that requires the verified peer to match pattern (see VerifySPIFFEID).
+// Normal chain verification must still be on; this only adds the ID check.
+func SPIFFEVerifier(pattern string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(verifiedChains) == 0 || len(verifiedChains[0]) == 0 {
+			return errors.New("peer certificate not verified")
+		}
+		return VerifySPIFFEID(verifiedChains[0][0], pattern)
+	}
+}
+
+// VerifyConnSPIFFEID checks the verified peer of an established TLS
+// connection against pattern.
+func VerifyConnSPIFFEID(state tls.ConnectionState, pattern string) error {
+	return SPIFFEVerifier(pattern)(nil, state.VerifiedChains)
+}
+
+type jwk struct {
+	Use string   `json:"use"`
+	Kty string   `json:"kty"`
+	Crv string   `json:"crv"`
+	X   string   `json:"x"`
+	Y   string   `json:"y"`
+	X5c []string `json:"x5c"`
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+// SPIFFEBundle returns caCerts as a SPIFFE trust bundle: a JWK Set with one
+// x509-svid key per CA cert.
+func SPIFFEBundle(caCerts ...*x509.Certificate) ([]byte, error) {
+	set := jwks{Keys: []jwk{}}
+	for _, cert := range caCerts {
+		pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+		if !ok {
+			return nil, errors.New("CA key is not ECDSA")
+		}
+		if pub.Curve.Params().Name != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", pub.Curve.Params().Name)
+		}
+		ecdhPub, err := pub.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		point := ecdhPub.Bytes() // 0x04 || X || Y, fixed length
+		set.Keys = append(set.Keys, jwk{
+			Use: "x509-svid",
+			Kty: "EC",
+			Crv: "P-256",
+			X:   base64.RawURLEncoding.EncodeToString(point[1:33]),
+			Y:   base64.RawURLEncoding.EncodeToString(point[33:]),
+			X5c: []string{base64.StdEncoding.EncodeToString(cert.Raw)},
+		})
+	}
+	return json.MarshalIndent(&set, "", "  ")
+}
+
+// SPIFFEBundle returns the park CA as a SPIFFE trust bundle.
+func (ca *CA) SPIFFEBundle() ([]byte, error) {
+	return SPIFFEBundle(&ca.Raw.Certificate)
+}
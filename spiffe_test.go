@@ -0,0 +1,81 @@
+package enough
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSPIFFEIDs(t *testing.T) {
+	t.Parallel()
+	ca, err := NewCA("Widget Cluster")
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	if got := ca.TrustDomain(); got != "widget-cluster" {
+		t.Errorf("expected trust domain widget-cluster, got %s", got)
+	}
+
+	server, err := ca.CreateServerCert()
+	if err != nil {
+		t.Fatalf("unable to create server cert: %s", err)
+	}
+	alice, err := ca.CreateNamedClientCert("alice@ops")
+	if err != nil {
+		t.Fatalf("unable to create client cert: %s", err)
+	}
+	worker, err := ca.CreateNamedClientCert("billing-worker")
+	if err != nil {
+		t.Fatalf("unable to create client cert: %s", err)
+	}
+
+	cases := []struct {
+		who     *RawCert
+		pattern string
+		ok      bool
+	}{
+		{server, "spiffe://widget-cluster/server", true},
+		{server, "spiffe://widget-cluster/client/*", false},
+		{alice, "spiffe://widget-cluster/client/ops/alice", true},
+		{alice, "spiffe://widget-cluster/client/ops/*", true},
+		{alice, "spiffe://widget-cluster/client/*", false},
+		{worker, "spiffe://widget-cluster/client/*", true},
+		{worker, "spiffe://other/client/*", false},
+	}
+	for _, c := range cases {
+		err := VerifySPIFFEID(&c.who.Certificate, c.pattern)
+		if c.ok && err != nil {
+			t.Errorf("%s: unexpected failure: %s", c.pattern, err)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("%s: unexpected match for %s", c.pattern, c.who.Certificate.URIs[0])
+		}
+	}
+}
+
+func TestSPIFFEBundle(t *testing.T) {
+	t.Parallel()
+	ca, err := NewCA("testing")
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	data, err := ca.SPIFFEBundle()
+	if err != nil {
+		t.Fatalf("failed to create bundle: %s", err)
+	}
+	var set struct {
+		Keys []map[string]interface{} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		t.Fatalf("bundle is not JSON: %s", err)
+	}
+	if len(set.Keys) != 1 {
+		t.Fatalf("expected 1 key, got %d", len(set.Keys))
+	}
+	k := set.Keys[0]
+	if k["use"] != "x509-svid" || k["kty"] != "EC" || k["crv"] != "P-256" {
+		t.Errorf("unexpected key parameters: %v", k)
+	}
+	if x, _ := k["x"].(string); len(x) != 43 {
+		t.Errorf("x coordinate is not 32 bytes base64url: %q", x)
+	}
+}
@@ -0,0 +1,578 @@
+package enough
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// An RFC 3161 timestamp proves a digest existed at a time, signed by a
+// timestamp authority (TSA) whose cert the park CA issued. Timestamping a
+// signature keeps it checkable after the signer's cert expires or is
+// revoked: what matters is whether the cert was good when the timestamp
+// says the signature already existed.
+//
+// Tokens are CMS SignedData over a TSTInfo, as RFC 3161 and RFC 5816
+// describe, signed with ECDSA-SHA256 and identifying the TSA cert with
+// SigningCertificateV2, so openssl ts can read them.
+
+// TimestampQueryType and TimestampReplyType are the RFC 3161 HTTP media
+// types.
+const (
+	TimestampQueryType = "application/timestamp-query"
+	TimestampReplyType = "application/timestamp-reply"
+)
+
+var (
+	oidSignedData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidTSTInfo             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+	oidContentType         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningCertV2       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 47}
+	oidECDSAWithSHA256     = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidExtKeyUsage         = asn1.ObjectIdentifier{2, 5, 29, 37}
+	oidKeyPurposeTimestamp = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 8}
+
+	// OIDTimestampPolicy is the TSA policy a park TSA stamps under.
+	OIDTimestampPolicy = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 59567, 1, 3}
+)
+
+// PKIStatus values and PKIFailureInfo bits from RFC 3161.
+const (
+	tsGranted   = 0
+	tsRejection = 2
+
+	tsBadAlg              = 0
+	tsBadRequest          = 2
+	tsBadDataFormat       = 5
+	tsUnacceptedPolicy    = 15
+	tsUnacceptedExtension = 16
+	tsSystemFailure       = 25
+)
+
+// CreateTimestampingCert issues a cert for a timestamp authority whose CN
+// is name. Its only purpose is timestamping, marked critical as RFC 3161
+// requires.
+func (ca *CA) CreateTimestampingCert(tsaName string) (c *RawCert, e error) {
+	spec, e := ca.timestampingSpec(tsaName)
+	if e != nil {
+		return
+	}
+	c, e = ca.createCert(spec, &ca.Raw)
+	return
+}
+
+func (ca *CA) timestampingSpec(tsaName string) (spec certSpec, e error) {
+	if e = ValidateMemberName(tsaName); e != nil {
+		return
+	}
+	eku, e := asn1.Marshal([]asn1.ObjectIdentifier{oidKeyPurposeTimestamp})
+	if e != nil {
+		return
+	}
+	name := pkix.Name{
+		Organization: []string{"Just Enough"},
+		CommonName:   tsaName,
+	}
+	spec = certSpec{
+		name:       name,
+		info:       ca.parkInfo(RoleTimestamping, -1),
+		usage:      x509.KeyUsageDigitalSignature,
+		extensions: []pkix.Extension{{Id: oidExtKeyUsage, Critical: true, Value: eku}},
+		uniqueName: true,
+	}
+	return
+}
+
+type messageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+type timeStampReq struct {
+	Version        int
+	MessageImprint messageImprint
+	ReqPolicy      asn1.ObjectIdentifier `asn1:"optional"`
+	Nonce          *big.Int              `asn1:"optional"`
+	CertReq        bool                  `asn1:"optional,default:false"`
+	Extensions     []pkix.Extension      `asn1:"optional,tag:0"`
+}
+
+type pkiStatusInfo struct {
+	Status       int
+	StatusString []asn1.RawValue `asn1:"optional"`
+	FailInfo     asn1.BitString  `asn1:"optional"`
+}
+
+type timeStampResp struct {
+	Status         pkiStatusInfo
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+type accuracy struct {
+	Seconds int `asn1:"optional"`
+	Millis  int `asn1:"optional,tag:0"`
+	Micros  int `asn1:"optional,tag:1"`
+}
+
+type tstInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint messageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time        `asn1:"generalized"`
+	Accuracy       accuracy         `asn1:"optional"`
+	Ordering       bool             `asn1:"optional,default:false"`
+	Nonce          *big.Int         `asn1:"optional"`
+	TSA            asn1.RawValue    `asn1:"optional,tag:0"`
+	Extensions     []pkix.Extension `asn1:"optional,tag:1"`
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue // [0] EXPLICIT
+}
+
+type encapsulatedContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     asn1.RawValue // [0] EXPLICIT OCTET STRING
+}
+
+type issuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type cmsAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+type signerInfo struct {
+	Version            int
+	SID                issuerAndSerial
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnsignedAttrs      asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo encapsulatedContentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type essCertIDv2 struct {
+	CertHash []byte // SHA-256, the default algorithm, so not named
+}
+
+type signingCertificateV2 struct {
+	Certs []essCertIDv2
+}
+
+// explicit wraps DER in a [0] EXPLICIT tag.
+func explicit(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+// TimestampAuthority answers RFC 3161 requests, signing with Key, whose
+// cert is Cert. It is an http.Handler.
+type TimestampAuthority struct {
+	Cert  *x509.Certificate
+	Key   crypto.Signer
+	Clock func() time.Time // defaults to time.Now
+}
+
+// NewTimestampAuthority checks cert is a timestamping cert for key.
+func NewTimestampAuthority(cert *x509.Certificate, key crypto.Signer) (*TimestampAuthority, error) {
+	pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok || !pub.Equal(key.Public()) {
+		return nil, errors.New("key does not match the TSA cert")
+	}
+	if !hasTimestampingEKU(cert) {
+		return nil, errors.New("not a timestamping cert")
+	}
+	return &TimestampAuthority{Cert: cert, Key: key}, nil
+}
+
+// hasTimestampingEKU reports whether cert is for timestamping and only
+// that, as RFC 3161 requires.
+func hasTimestampingEKU(cert *x509.Certificate) bool {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidExtKeyUsage) && !ext.Critical {
+			return false
+		}
+	}
+	return len(cert.ExtKeyUsage) == 1 && cert.ExtKeyUsage[0] == x509.ExtKeyUsageTimeStamping && len(cert.UnknownExtKeyUsage) == 0
+}
+
+func rejection(failBit int, text string) ([]byte, error) {
+	fail := asn1.BitString{Bytes: make([]byte, 4), BitLength: failBit + 1}
+	fail.Bytes[failBit/8] |= 0x80 >> uint(failBit%8)
+	fail.Bytes = fail.Bytes[:failBit/8+1]
+	return asn1.Marshal(timeStampResp{Status: pkiStatusInfo{
+		Status:       tsRejection,
+		StatusString: []asn1.RawValue{{Tag: asn1.TagUTF8String, Bytes: []byte(text)}},
+		FailInfo:     fail,
+	}})
+}
+
+// Respond answers a DER TimeStampReq with a DER TimeStampResp. Requests it
+// won't stamp get a rejection response, not an error; errors mean the TSA
+// itself failed.
+func (tsa *TimestampAuthority) Respond(der []byte) ([]byte, error) {
+	req := timeStampReq{}
+	if rest, err := asn1.Unmarshal(der, &req); err != nil || len(rest) != 0 || req.Version != 1 {
+		return rejection(tsBadDataFormat, "malformed request")
+	}
+	h, err := oidHash(req.MessageImprint.HashAlgorithm.Algorithm)
+	if err != nil {
+		return rejection(tsBadAlg, err.Error())
+	}
+	if len(req.MessageImprint.HashedMessage) != h.Size() {
+		return rejection(tsBadRequest, "digest is the wrong length")
+	}
+	if len(req.ReqPolicy) != 0 && !req.ReqPolicy.Equal(OIDTimestampPolicy) {
+		return rejection(tsUnacceptedPolicy, "unknown policy")
+	}
+	if len(req.Extensions) != 0 {
+		return rejection(tsUnacceptedExtension, "no extensions are supported")
+	}
+
+	token, err := tsa.stamp(req)
+	if err != nil {
+		return rejection(tsSystemFailure, "TSA failure")
+	}
+	return asn1.Marshal(timeStampResp{Status: pkiStatusInfo{Status: tsGranted}, TimeStampToken: asn1.RawValue{FullBytes: token}})
+}
+
+func (tsa *TimestampAuthority) stamp(req timeStampReq) ([]byte, error) {
+	now := time.Now
+	if tsa.Clock != nil {
+		now = tsa.Clock
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	info, err := asn1.Marshal(tstInfo{
+		Version:        1,
+		Policy:         OIDTimestampPolicy,
+		MessageImprint: req.MessageImprint,
+		SerialNumber:   serial,
+		GenTime:        now().UTC().Truncate(time.Second),
+		Accuracy:       accuracy{Seconds: 1},
+		Nonce:          req.Nonce,
+	})
+	if err != nil {
+		return nil, err
+	}
+	eContent, err := asn1.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+
+	// The signature is over the signed attributes, DER encoded as a SET OF,
+	// which means sorted.
+	infoSum := sha256.Sum256(info)
+	certSum := sha256.Sum256(tsa.Cert.Raw)
+	var attrs [][]byte
+	for _, a := range []struct {
+		oid   asn1.ObjectIdentifier
+		value interface{}
+	}{
+		{oidContentType, oidTSTInfo},
+		{oidMessageDigest, infoSum[:]},
+		{oidSigningCertV2, signingCertificateV2{Certs: []essCertIDv2{{CertHash: certSum[:]}}}},
+	} {
+		v, err := asn1.Marshal(a.value)
+		if err != nil {
+			return nil, err
+		}
+		attr, err := asn1.Marshal(cmsAttribute{Type: a.oid, Values: []asn1.RawValue{{FullBytes: v}}})
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, attr)
+	}
+	sort.Slice(attrs, func(i, j int) bool { return bytes.Compare(attrs[i], attrs[j]) < 0 })
+	attrBytes := bytes.Join(attrs, nil)
+	attrSet, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: attrBytes})
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(attrSet)
+	sig, err := tsa.Key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	sha256Alg := pkix.AlgorithmIdentifier{Algorithm: signatureHashes[0].oid}
+	sd := signedData{
+		Version:          3,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256Alg},
+		EncapContentInfo: encapsulatedContentInfo{EContentType: oidTSTInfo, EContent: explicit(eContent)},
+		SignerInfos: []signerInfo{{
+			Version:            1,
+			SID:                issuerAndSerial{Issuer: asn1.RawValue{FullBytes: tsa.Cert.RawIssuer}, Serial: tsa.Cert.SerialNumber},
+			DigestAlgorithm:    sha256Alg,
+			SignedAttrs:        asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: attrBytes},
+			SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256},
+			Signature:          sig,
+		}},
+	}
+	if req.CertReq {
+		sd.Certificates = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: tsa.Cert.Raw}
+	}
+	sdBytes, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(contentInfo{ContentType: oidSignedData, Content: explicit(sdBytes)})
+}
+
+// ServeHTTP answers RFC 3161 requests POSTed as application/timestamp-query.
+func (tsa *TimestampAuthority) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") != TimestampQueryType {
+		http.Error(w, "POST an "+TimestampQueryType, http.StatusBadRequest)
+		return
+	}
+	req, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	resp, err := tsa.Respond(req)
+	if err != nil {
+		http.Error(w, "TSA failure", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", TimestampReplyType)
+	w.Write(resp)
+}
+
+// NewTimestampRequest makes a DER TimeStampReq for data's digest under h,
+// asking for the TSA cert to be included. It returns the nonce to check the
+// response against.
+func NewTimestampRequest(data []byte, h crypto.Hash) (req []byte, nonce *big.Int, e error) {
+	oid, e := hashOID(h)
+	if e != nil {
+		return
+	}
+	digest, e := hashReader(bytes.NewReader(data), h)
+	if e != nil {
+		return
+	}
+	if nonce, e = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64)); e != nil {
+		return
+	}
+	req, e = asn1.Marshal(timeStampReq{
+		Version:        1,
+		MessageImprint: messageImprint{HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oid}, HashedMessage: digest},
+		Nonce:          nonce,
+		CertReq:        true,
+	})
+	return
+}
+
+// Timestamp is a verified RFC 3161 timestamp token.
+type Timestamp struct {
+	Time   time.Time
+	Hash   crypto.Hash
+	Digest []byte // what was stamped
+	Serial *big.Int
+	Nonce  *big.Int // nil if the request had none
+	Policy asn1.ObjectIdentifier
+	Signer *x509.Certificate   // the TSA
+	Certs  []*x509.Certificate // everything in the token, for chain building
+}
+
+// Covers checks that ts is a timestamp of data.
+func (ts *Timestamp) Covers(data []byte) error {
+	digest, err := hashReader(bytes.NewReader(data), ts.Hash)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(digest, ts.Digest) {
+		return errors.New("timestamp is for something else")
+	}
+	return nil
+}
+
+// ParseTimestampResponse checks a DER TimeStampResp was granted and returns
+// its verified token, as ParseTimestampToken does.
+func ParseTimestampResponse(der []byte) (*Timestamp, error) {
+	resp := timeStampResp{}
+	if rest, err := asn1.Unmarshal(der, &resp); err != nil || len(rest) != 0 {
+		return nil, errors.New("invalid timestamp response")
+	}
+	if resp.Status.Status > 1 { // granted, or granted with mods
+		msg := ""
+		for _, s := range resp.Status.StatusString {
+			msg += " " + string(s.Bytes)
+		}
+		return nil, fmt.Errorf("timestamp refused (status %d):%s", resp.Status.Status, msg)
+	}
+	return ParseTimestampToken(resp.TimeStampToken.FullBytes)
+}
+
+// ParseTimestampToken parses a DER TimeStampToken and checks it was signed
+// by the timestamping cert it contains. It doesn't decide whether to trust
+// that cert; verify ts.Signer against the park CA for that, for
+// x509.ExtKeyUsageTimeStamping, as of ts.Time.
+func ParseTimestampToken(der []byte) (*Timestamp, error) {
+	ci := contentInfo{}
+	if rest, err := asn1.Unmarshal(der, &ci); err != nil || len(rest) != 0 || !ci.ContentType.Equal(oidSignedData) {
+		return nil, errors.New("invalid timestamp token")
+	}
+	sd := signedData{}
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, fmt.Errorf("invalid timestamp token: %s", err)
+	}
+	if !sd.EncapContentInfo.EContentType.Equal(oidTSTInfo) || len(sd.SignerInfos) != 1 {
+		return nil, errors.New("not a timestamp token")
+	}
+	var info []byte
+	if _, err := asn1.Unmarshal(sd.EncapContentInfo.EContent.Bytes, &info); err != nil {
+		return nil, errors.New("invalid timestamp token content")
+	}
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cert in timestamp token: %s", err)
+	}
+
+	si := sd.SignerInfos[0]
+	var signer *x509.Certificate
+	for _, c := range certs {
+		if bytes.Equal(c.RawIssuer, si.SID.Issuer.FullBytes) && c.SerialNumber.Cmp(si.SID.Serial) == 0 {
+			signer = c
+		}
+	}
+	if signer == nil {
+		return nil, errors.New("timestamp token doesn't include the TSA cert")
+	}
+	if !hasTimestampingEKU(signer) {
+		return nil, errors.New("timestamp signed by a cert that isn't for timestamping")
+	}
+	if err := checkTimestampAttrs(si, info, signer); err != nil {
+		return nil, err
+	}
+	if !si.SignatureAlgorithm.Algorithm.Equal(oidECDSAWithSHA256) {
+		return nil, fmt.Errorf("unsupported timestamp signature algorithm %s", si.SignatureAlgorithm.Algorithm)
+	}
+	pub, ok := signer.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("TSA key is not ECDSA")
+	}
+	attrSet, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: si.SignedAttrs.Bytes})
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(attrSet)
+	if !ecdsa.VerifyASN1(pub, digest[:], si.Signature) {
+		return nil, errors.New("bad timestamp signature")
+	}
+
+	tst := tstInfo{}
+	if rest, err := asn1.Unmarshal(info, &tst); err != nil || len(rest) != 0 || tst.Version != 1 {
+		return nil, errors.New("invalid TSTInfo")
+	}
+	h, err := oidHash(tst.MessageImprint.HashAlgorithm.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return &Timestamp{
+		Time:   tst.GenTime,
+		Hash:   h,
+		Digest: tst.MessageImprint.HashedMessage,
+		Serial: tst.SerialNumber,
+		Nonce:  tst.Nonce,
+		Policy: tst.Policy,
+		Signer: signer,
+		Certs:  certs,
+	}, nil
+}
+
+// checkTimestampAttrs checks the signed attributes bind the signature to
+// info and to the TSA cert.
+func checkTimestampAttrs(si signerInfo, info []byte, signer *x509.Certificate) error {
+	if !si.DigestAlgorithm.Algorithm.Equal(signatureHashes[0].oid) {
+		return errors.New("timestamp not signed with SHA-256")
+	}
+	found := make(map[string][]byte)
+	for rest := si.SignedAttrs.Bytes; len(rest) > 0; {
+		a := cmsAttribute{}
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &a); err != nil || len(a.Values) != 1 {
+			return errors.New("invalid timestamp signed attributes")
+		}
+		found[a.Type.String()] = a.Values[0].FullBytes
+	}
+	var ct asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(found[oidContentType.String()], &ct); err != nil || !ct.Equal(oidTSTInfo) {
+		return errors.New("timestamp content type mismatch")
+	}
+	var md []byte
+	infoSum := sha256.Sum256(info)
+	if _, err := asn1.Unmarshal(found[oidMessageDigest.String()], &md); err != nil || !bytes.Equal(md, infoSum[:]) {
+		return errors.New("timestamp message digest mismatch")
+	}
+	// SigningCertificateV2 stops the token being passed off as signed by
+	// another cert for the same key.
+	scv2 := signingCertificateV2{}
+	certSum := sha256.Sum256(signer.Raw)
+	if _, err := asn1.Unmarshal(found[oidSigningCertV2.String()], &scv2); err != nil || len(scv2.Certs) == 0 || !bytes.Equal(scv2.Certs[0].CertHash, certSum[:]) {
+		return errors.New("timestamp doesn't identify its TSA cert")
+	}
+	return nil
+}
+
+// RequestTimestamp asks the TSA at url to timestamp data, checks the
+// response answers the request, and returns the verified timestamp and the
+// DER response to keep alongside data.
+func RequestTimestamp(url string, data []byte) (*Timestamp, []byte, error) {
+	req, nonce, err := NewTimestampRequest(data, crypto.SHA256)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := http.Post(url, TimestampQueryType, bytes.NewReader(req))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("TSA said %s", resp.Status)
+	}
+	der, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	ts, err := ParseTimestampResponse(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ts.Nonce == nil || ts.Nonce.Cmp(nonce) != 0 {
+		return nil, nil, errors.New("timestamp response is for a different request")
+	}
+	if err := ts.Covers(data); err != nil {
+		return nil, nil, err
+	}
+	return ts, der, nil
+}
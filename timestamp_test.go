@@ -0,0 +1,90 @@
+package enough
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTimestampAuthority(t *testing.T) {
+	t.Parallel()
+	ca, err := NewCAWithOptions("TestCerts", &CAOptions{Rand: seededRand(47), Clock: testClock})
+	if err != nil {
+		t.Fatalf("failed to create CA: %s", err)
+	}
+	tsaCert, err := ca.CreateTimestampingCert("tsa")
+	if err != nil {
+		t.Fatalf("unable to create timestamping cert: %s", err)
+	}
+	if memberRole(&tsaCert.Certificate) != RoleTimestamping {
+		t.Errorf("unexpected role %q", memberRole(&tsaCert.Certificate))
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(&ca.Raw.Certificate)
+	if _, err := tsaCert.Certificate.Verify(x509.VerifyOptions{Roots: roots, CurrentTime: testEpoch, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping}}); err != nil {
+		t.Errorf("TSA cert not valid for timestamping: %s", err)
+	}
+
+	signer, _ := ca.CreateCodeSigningCert("releases")
+	if _, err := NewTimestampAuthority(&signer.Certificate, signer.PrivateKey); err == nil {
+		t.Error("made a TSA from a code signing cert")
+	}
+	tsa, err := NewTimestampAuthority(&tsaCert.Certificate, tsaCert.PrivateKey)
+	if err != nil {
+		t.Fatalf("failed to make TSA: %s", err)
+	}
+	stampTime := testEpoch.Add(time.Hour)
+	tsa.Clock = func() time.Time { return stampTime }
+
+	srv := httptest.NewServer(tsa)
+	defer srv.Close()
+	sig := []byte("a signature")
+	ts, der, err := RequestTimestamp(srv.URL, sig)
+	if err != nil {
+		t.Fatalf("failed to get timestamp: %s", err)
+	}
+	if !ts.Time.Equal(stampTime) || !ts.Signer.Equal(&tsaCert.Certificate) || !ts.Policy.Equal(OIDTimestampPolicy) {
+		t.Errorf("unexpected timestamp %+v", ts)
+	}
+
+	back, err := ParseTimestampResponse(der)
+	if err != nil {
+		t.Fatalf("failed to parse response: %s", err)
+	}
+	if err := back.Covers(sig); err != nil {
+		t.Errorf("timestamp doesn't cover what was stamped: %s", err)
+	}
+	if err := back.Covers([]byte("another signature")); err == nil {
+		t.Error("timestamp covers something else")
+	}
+
+	// any change to the token breaks it
+	for i := len(der) - 80; i < len(der); i += 7 {
+		bad := append([]byte{}, der...)
+		bad[i] ^= 1
+		if _, err := ParseTimestampResponse(bad); err == nil {
+			t.Errorf("accepted a token changed at byte %d", i)
+		}
+	}
+
+	// and the TSA refuses requests it can't honour
+	req := timeStampReq{
+		Version:        1,
+		MessageImprint: messageImprint{HashedMessage: []byte("short")},
+	}
+	req.MessageImprint.HashAlgorithm.Algorithm = signatureHashes[0].oid
+	data, _ := asn1.Marshal(req)
+	resp, err := tsa.Respond(data)
+	if err != nil {
+		t.Fatalf("TSA failed: %s", err)
+	}
+	if _, err := ParseTimestampResponse(resp); err == nil {
+		t.Error("TSA stamped a digest of the wrong length")
+	}
+	if _, _, err := NewTimestampRequest(sig, crypto.SHA1); err == nil {
+		t.Error("made a SHA-1 timestamp request")
+	}
+}